@@ -1,7 +1,8 @@
 /*
-Healthcheck is a simple program that sends an HTTP request to the local host (self) to a configured port number.
-It's used in environment where you need a simple probe for health checks (e.g., an empty container in docker).
-The probe URL is http://localhost:3000/liveness . Only the port can be changed.
+Healthcheck is a simple program that sends an HTTP request to a probe of the API server and exits with the result.
+It's used in environment where you need a simple probe for health checks (e.g., an empty container in docker), and to
+gate the startup of the containers that depend on the server.
+The probe URL is http://<host>:<port>/<probe> (by default, http://localhost:3000/readiness).
 
 Usage:
 
@@ -9,38 +10,70 @@ Usage:
 
 The flags are:
 
+	-probe <liveness | readiness>
+		Choose the probe: "liveness" checks that the server is running, "readiness" (the default) also checks its
+		dependencies (database, migrations, blob store, disk space).
+
+	-host <name>
+		Change the host where the request is sent (default "localhost").
+
 	-port <1-65535>
 		Change the port where the request is sent.
 
+	-timeout <duration>
+		Give up if the server has not replied within this time, e.g. "2s" (default 5s).
+
 Return values (exit codes):
 
 	0
 		The request was successful (HTTP 200 or HTTP 204)
 
 	> 0
-		The request was not successful (connection error or unexpected HTTP status code)
+		The request was not successful (connection error, timeout or unexpected HTTP status code). The reply of the
+		server, if any, is printed on the standard error.
 */
 package main
 
 import (
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 )
 
 func main() {
+	var probe = flag.String("probe", "readiness", "Probe to check: liveness or readiness")
+	var host = flag.String("host", "localhost", "HTTP host for healthcheck")
 	var port = flag.Int("port", 3000, "HTTP port for healthcheck")
+	var timeout = flag.Duration("timeout", 5*time.Second, "Maximum time to wait for the reply")
 
 	flag.Parse()
 
-	res, err := http.Get(fmt.Sprintf("http://localhost:%d/liveness", *port))
+	if *probe != "liveness" && *probe != "readiness" {
+		_, _ = fmt.Fprintf(os.Stderr, "Unknown probe %q: use liveness or readiness\n", *probe)
+		os.Exit(2)
+	}
+	if *port < 1 || *port > 65535 {
+		_, _ = fmt.Fprintf(os.Stderr, "Invalid port %d\n", *port)
+		os.Exit(2)
+	}
+
+	client := http.Client{Timeout: *timeout}
+	res, err := client.Get("http://" + net.JoinHostPort(*host, strconv.Itoa(*port)) + "/" + *probe)
 	if err != nil {
 		_, _ = fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	} else if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		// The readiness reply tells which checks failed
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
 		_ = res.Body.Close()
 		_, _ = fmt.Fprintln(os.Stderr, "Healthcheck request not OK: ", res.Status)
+		_, _ = os.Stderr.Write(body)
 		os.Exit(1)
 	}
 	_ = res.Body.Close()
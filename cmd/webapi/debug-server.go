@@ -0,0 +1,24 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/metrics"
+)
+
+// debugHandler returns the handler of the debug server: the expvar variables at /debug/vars, the pprof profiles under
+// /debug/pprof/ and the metrics in the Prometheus format at /metrics. The handlers are registered on their own mux, not
+// on http.DefaultServeMux, so that they are never exposed by the API server.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/metrics", metrics.Handler())
+	return mux
+}
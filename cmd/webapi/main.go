@@ -1,15 +1,22 @@
 /*
 Webapi is the executable for the main web server.
 It builds a web server around APIs from `service/api`.
-Webapi connects to external resources needed (database) and starts two web servers: the API web server, and the debug.
-Everything is served via the API web server, except debug variables (/debug/vars) and profiler infos (pprof).
+Webapi connects to external resources needed (database, blob store) and starts two web servers: the API web server, and the debug.
+Everything is served via the API web server, except debug variables (/debug/vars), profiler infos (pprof) and metrics in
+the Prometheus format (/metrics), which are served by the debug server (see `debug-server.go`). The debug server listens
+on 127.0.0.1:4000 by default; bind it elsewhere only on an internal network, as it reveals the command line (secrets
+passed as flags included) and the internals of the process. Set an empty debug host (`--web-debug-host ""`) to disable
+the debug server.
 
 Usage:
 
 	webapi [flags]
+	webapi [flags] migrate [up | down | to <version> | status]
 
 Flags and configurations are handled automatically by the code in `load-configuration.go`.
 
+The `migrate` subcommand manages the database schema explicitly (see `migrate.go`) and exits without starting any server.
+
 Return values (exit codes):
 
 	0
@@ -25,19 +32,26 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
 	"errors"
 	"fmt"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/notifications"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/session"
 	"github.com/ardanlabs/conf"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
-	"math/rand"
+	mathrand "math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 )
 
@@ -56,10 +70,11 @@ func main() {
 // * connects to any external resources (like databases, authenticators, etc.)
 // * creates an instance of the service/api package
 // * starts the principal web server (using the service/api.Router.Handler() for HTTP handlers)
+// * starts the debug web server, if enabled
 // * waits for any termination event: SIGTERM signal (UNIX), non-recoverable server error, etc.
-// * closes the principal web server
+// * closes the principal and the debug web servers
 func run() error {
-	rand.Seed(globaltime.Now().UnixNano())
+	mathrand.Seed(globaltime.Now().UnixNano())
 	// Load Configuration and defaults
 	cfg, err := loadConfiguration()
 	if err != nil {
@@ -82,20 +97,99 @@ func run() error {
 
 	// Start Database
 	logger.Println("initializing database support")
-	dbconn, err := sql.Open("sqlite3", cfg.DB.Filename)
+	dbconn, err := sql.Open(cfg.DB.Driver, dataSourceName(cfg))
 	if err != nil {
-		logger.WithError(err).Error("error opening SQLite DB")
-		return fmt.Errorf("opening SQLite: %w", err)
+		logger.WithError(err).Error("error opening the database")
+		return fmt.Errorf("opening the database: %w", err)
 	}
 	defer func() {
 		logger.Debug("database stopping")
 		_ = dbconn.Close()
 	}()
+	if cfg.Args.Num(0) == "migrate" {
+		return runMigrate([]string{cfg.Args.Num(1), cfg.Args.Num(2)}, dbconn, logger)
+	} else if len(cfg.Args) > 0 {
+		return fmt.Errorf("unknown command %q", cfg.Args.Num(0))
+	}
+
+	// Bring the schema to the latest version
+	if err := database.Migrate(dbconn); err != nil {
+		logger.WithError(err).Error("error migrating the database")
+		return fmt.Errorf("migrating the database: %w", err)
+	}
+
+	// A database created without FTS5 gets the full-text index as soon as it's opened with FTS5
+	if upgraded, err := database.UpgradeSearchIndex(dbconn); err != nil {
+		logger.WithError(err).Error("error upgrading the search index")
+		return fmt.Errorf("upgrading the search index: %w", err)
+	} else if upgraded {
+		logger.Info("search index rebuilt with FTS5")
+	}
+
 	db, err := database.New(dbconn)
 	if err != nil {
 		logger.WithError(err).Error("error creating AppDatabase")
 		return fmt.Errorf("creating AppDatabase: %w", err)
 	}
+	if !db.FullTextSearch() {
+		logger.Warning("SQLite has no FTS5: search falls back to LIKE, without ranking by relevance nor accent folding " +
+			"(build with -tags sqlite_fts5: the index is rebuilt at the next start)")
+	}
+
+	// Start the blob store, where image files are saved
+	blobs, err := blobstore.New(blobstore.Config{
+		Driver: cfg.Blob.Driver,
+		Path:   cfg.Blob.Path,
+		S3: blobstore.S3Config{
+			Endpoint:  cfg.Blob.S3.Endpoint,
+			Region:    cfg.Blob.S3.Region,
+			Bucket:    cfg.Blob.S3.Bucket,
+			AccessKey: cfg.Blob.S3.AccessKey,
+			SecretKey: cfg.Blob.S3.SecretKey,
+		},
+	})
+	if err != nil {
+		logger.WithError(err).Error("error creating the blob store")
+		return fmt.Errorf("creating the blob store: %w", err)
+	}
+
+	// Photos uploaded before the blob store existed have their image in the database: move them out (once)
+	moved, err := db.MoveImagesToBlobStore(context.Background(), func(imageData []byte) (string, error) {
+		key := blobstore.Key(imageData)
+		return key, blobs.Put(key, imageData)
+	})
+	if err != nil {
+		logger.WithError(err).Error("error moving images to the blob store")
+		return fmt.Errorf("moving images to the blob store: %w", err)
+	} else if moved > 0 {
+		logger.Infof("moved %d images from the database to the blob store", moved)
+	}
+
+	// Start session support
+	sessionKey := []byte(cfg.Session.Key)
+	if len(sessionKey) == 0 {
+		logger.Warning("no session key configured, generating a random one: tokens will not survive a restart")
+		sessionKey = make([]byte, 32)
+		if _, err := rand.Read(sessionKey); err != nil {
+			return fmt.Errorf("generating session key: %w", err)
+		}
+	}
+	sessions, err := session.New(session.Config{
+		Key:      sessionKey,
+		TTL:      cfg.Session.TTL,
+		Database: db,
+	})
+	if err != nil {
+		logger.WithError(err).Error("error creating the session manager")
+		return fmt.Errorf("creating the session manager: %w", err)
+	}
+	notifier, err := notifications.New(notifications.Config{
+		Database: db,
+	})
+	if err != nil {
+		logger.WithError(err).Error("error creating the notifier")
+		return fmt.Errorf("creating the notifier: %w", err)
+	}
 
 	// Start (main) API server
 	logger.Info("initializing API server")
@@ -109,10 +203,19 @@ func run() error {
 	// buffered channel so the goroutine can exit if we don't collect this error.
 	serverErrors := make(chan error, 1)
 
-	// Create the API router
+	// Create the API router. There is no Mailer yet (users have no e-mail address), so password resets are disabled.
+	logger.Info("password resets are disabled: no mailer is configured")
 	apirouter, err := api.New(api.Config{
-		Logger:   logger,
-		Database: db,
+		Logger:        logger,
+		Database:      db,
+		Sessions:      sessions,
+		Blobs:         blobs,
+		Notifications: notifier,
+
+		TrendingWindow: cfg.Tags.TrendingWindow,
+		DiskPaths:      diskPaths(cfg),
+		MinFreeDisk:    cfg.Health.MinFreeDisk,
+		RequestTimeout: cfg.Web.RequestTimeout,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
@@ -129,6 +232,11 @@ func run() error {
 	// Apply CORS policy
 	router = applyCORSHandler(router)
 
+	// The contexts of the requests derive from requestsCtx: cancelling it stops the database queries of the requests
+	// still running when the shutdown timeout expires
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
 	// Create the API server
 	apiserver := http.Server{
 		Addr:              cfg.Web.APIHost,
@@ -136,6 +244,7 @@ func run() error {
 		ReadTimeout:       cfg.Web.ReadTimeout,
 		ReadHeaderTimeout: cfg.Web.ReadTimeout,
 		WriteTimeout:      cfg.Web.WriteTimeout,
+		BaseContext:       func(net.Listener) context.Context { return requestsCtx },
 	}
 
 	// Start the service listening for requests in a separate goroutine
@@ -145,6 +254,24 @@ func run() error {
 		logger.Infof("stopping API server")
 	}()
 
+	// Start the debug server: it must be bound to an address reachable only by the operators, as profiles and
+	// variables reveal the internals of the process, and the command line with any secret passed as a flag
+	var debugserver *http.Server
+	if cfg.Web.DebugHost != "" {
+		debugserver = &http.Server{
+			Addr:              cfg.Web.DebugHost,
+			Handler:           debugHandler(),
+			ReadHeaderTimeout: cfg.Web.ReadTimeout,
+		}
+		go func() {
+			logger.Infof("debug server listening on %s", debugserver.Addr)
+			if err := debugserver.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				serverErrors <- fmt.Errorf("debug server: %w", err)
+			}
+			logger.Infof("stopping debug server")
+		}()
+	}
+
 	// Waiting for shutdown signal or POSIX signals
 	select {
 	case err := <-serverErrors:
@@ -168,9 +295,18 @@ func run() error {
 		err = apiserver.Shutdown(ctx)
 		if err != nil {
 			logger.WithError(err).Warning("error during graceful shutdown of HTTP server")
+			cancelRequests()
 			err = apiserver.Close()
 		}
 
+		// The debug server goes down with the API server; a profile being taken is cut short
+		if debugserver != nil {
+			if dbgErr := debugserver.Shutdown(ctx); dbgErr != nil {
+				logger.WithError(dbgErr).Warning("error during graceful shutdown of debug server")
+				_ = debugserver.Close()
+			}
+		}
+
 		// Log the status of this shutdown.
 		switch {
 		case sig == syscall.SIGSTOP:
@@ -182,3 +318,24 @@ func run() error {
 
 	return nil
 }
+
+// dataSourceName returns the DSN of the database: SQLite falls back to the file name.
+func dataSourceName(cfg WebAPIConfiguration) string {
+	if cfg.DB.DSN == "" && cfg.DB.Driver == string(database.SQLite) {
+		return cfg.DB.Filename
+	}
+	return cfg.DB.DSN
+}
+
+// diskPaths returns the directories where webapi writes data: the one of the SQLite database and, with the local
+// driver, the blob store.
+func diskPaths(cfg WebAPIConfiguration) []string {
+	var paths []string
+	if cfg.DB.Driver == string(database.SQLite) {
+		paths = append(paths, filepath.Dir(dataSourceName(cfg)))
+	}
+	if cfg.Blob.Driver == "local" {
+		paths = append(paths, cfg.Blob.Path)
+	}
+	return paths
+}
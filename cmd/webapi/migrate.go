@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/sirupsen/logrus"
+)
+
+// runMigrate implements the `migrate` subcommand. It accepts the following arguments:
+//
+//	migrate [up]        applies all pending migrations
+//	migrate down        rolls back the last applied migration
+//	migrate to <N>      applies or rolls back migrations until the schema is at version N
+//	migrate status      lists all migrations and whether they are applied
+func runMigrate(args []string, dbconn *sql.DB, logger *logrus.Logger) error {
+	switch args[0] {
+	case "", "up":
+		if err := database.Migrate(dbconn); err != nil {
+			return fmt.Errorf("migrating the database: %w", err)
+		}
+	case "down":
+		err := database.Rollback(dbconn)
+		if errors.Is(err, database.ErrNoMigrations) {
+			logger.Info("no migrations to roll back")
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("rolling back the database: %w", err)
+		}
+	case "to":
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid schema version %q", args[1])
+		}
+		if err := database.MigrateTo(dbconn, version); err != nil {
+			return fmt.Errorf("migrating the database: %w", err)
+		}
+	case "status":
+		return printMigrationStatus(dbconn)
+	default:
+		return fmt.Errorf("unknown migrate command %q (expected up, down, to or status)", args[0])
+	}
+
+	version, err := database.SchemaVersion(dbconn)
+	if err != nil {
+		return err
+	}
+	logger.Infof("database schema is at version %d", version)
+	return nil
+}
+
+// printMigrationStatus writes a table with all migrations and their state to the standard output.
+func printMigrationStatus(dbconn *sql.DB) error {
+	states, err := database.MigrationStatus(dbconn)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range states {
+		appliedAt := "pending"
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		_, _ = fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+	return tw.Flush()
+}
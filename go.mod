@@ -7,8 +7,11 @@ require (
 	github.com/gofrs/uuid v4.4.0+incompatible
 	github.com/gorilla/handlers v1.5.1
 	github.com/julienschmidt/httprouter v1.3.0
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.12.0
+	golang.org/x/image v0.10.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -1,9 +1,19 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/metrics"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/session"
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
@@ -13,25 +23,52 @@ import (
 // required by the httprouter package.
 type httpRouterHandler func(http.ResponseWriter, *http.Request, httprouter.Params, reqcontext.RequestContext)
 
-// wrap parses the request and adds a reqcontext.RequestContext instance related to the request.
-func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+// wrap parses the request and adds a reqcontext.RequestContext instance related to the request. The handler is called
+// only if all the policies (see authorization.go) allow the request. Every request is counted and timed in the
+// metrics, under the name of the handler.
+//
+// The context of the request (r.Context()) ends after the request timeout of the router, when the client goes away, or
+// when the server gives up waiting for the request during the shutdown; the database queries run with it.
+func (rt *_router) wrap(fn httpRouterHandler, policies ...policy) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return rt.wrapWithTimeout(rt.requestTimeout, fn, policies...)
+}
+
+// wrapWithTimeout is wrap with a different timeout for the route; 0 means no timeout, for requests that are meant to
+// last (e.g., GET /events).
+func (rt *_router) wrapWithTimeout(timeout time.Duration, fn httpRouterHandler,
+	policies ...policy) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	route := handlerName(fn)
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		if timeout > 0 {
+			c, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(c)
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		w = rec
+		defer func() {
+			metrics.HTTPRequests.Inc(r.Method, route, strconv.Itoa(rec.code()))
+			// Streams (routes without a timeout) last as long as the client stays, their duration means nothing
+			if timeout > 0 {
+				metrics.HTTPRequestDuration.Observe(time.Since(start).Seconds(), r.Method, route)
+			}
+		}()
+
 		reqUUID, err := uuid.NewV4()
 		if err != nil {
 			rt.baseLogger.WithError(err).Error("can't generate a request UUID")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		authHeader := r.Header.Get("Authorization")
-		user, err := rt.db.GetUser(authHeader)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
 		var ctx = reqcontext.RequestContext{
 			ReqUUID:  reqUUID,
 			Database: rt.db,
-			User:     user,
+			Sessions: rt.sessions,
+			Blobs:    rt.blobs,
+			Notifier: rt.notifier,
+			Mailer:   rt.mailer,
+			Events:   rt.events,
 		}
 
 		// Create a request-specific logger
@@ -40,7 +77,87 @@ func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Re
 			"remote-ip": r.RemoteAddr,
 		})
 
+		// Resolve the bearer token, if any. Requests without a token are anonymous; a token that is present but not
+		// valid is always rejected.
+		ctx.User, ctx.Session, err = rt.authenticate(r)
+		if errors.Is(err, session.ErrInvalidToken) {
+			writeError(w, ctx, http.StatusUnauthorized, "Invalid or expired session")
+			return
+		} else if err != nil {
+			writeErrorFor(w, ctx, err, "can't authenticate the request")
+			return
+		}
+
+		if !authorize(w, r, ps, ctx, policies) {
+			return
+		}
+
 		// Call the next handler in chain (usually, the handler function for the path)
 		fn(w, r, ps, ctx)
 	}
 }
+
+// handlerName returns the name of the handler function without the package, e.g. "handleGetPhoto". Method values
+// (e.g. rt.handleGetTag) have a "-fm" suffix, which is removed.
+func handlerName(fn httpRouterHandler) string {
+	name := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+	return strings.TrimSuffix(name[strings.LastIndex(name, ".")+1:], "-fm")
+}
+
+// statusRecorder remembers the status code sent by the handler, for the metrics.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the original ResponseWriter, so that http.ResponseController reaches its Flush and deadlines (see
+// GET /events).
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// code returns the status code of the response; handlers that write nothing send a 200.
+func (rec *statusRecorder) code() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// authenticate verifies the token in the Authorization header and returns the user and session it belongs to. Both
+// are nil when the header is missing.
+func (rt *_router) authenticate(r *http.Request) (*database.User, *database.Session, error) {
+	token := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	if token == "" {
+		return nil, nil, nil
+	}
+
+	s, err := rt.sessions.Verify(r.Context(), token)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := rt.db.GetUser(r.Context(), s.UserID)
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, nil, session.ErrInvalidToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return user, s, nil
+}
@@ -4,49 +4,99 @@ import (
 	"net/http"
 )
 
-// Handler returns an instance of httprouter.Router that handle APIs registered here
+// Handler returns an instance of httprouter.Router that handle APIs registered here. Each route lists the policies
+// (see authorization.go) that must allow a request before it reaches the handler.
 func (rt *_router) Handler() http.Handler {
 	// Register routes
 	rt.router.GET("/", rt.getHelloWorld)
 	rt.router.GET("/context", rt.wrap(rt.getContextReply))
 
+	// Session routes
 	rt.router.POST("/session", rt.wrap(doLogin))
+	rt.router.POST("/session/refresh", rt.wrap(handleRefreshSession, authenticated))
+	rt.router.DELETE("/session", rt.wrap(handleLogout, authenticated))
+	rt.router.DELETE("/sessions", rt.wrap(handleLogoutAll, authenticated))
+	if rt.mailer != nil {
+		rt.router.POST("/password-resets", rt.wrap(handleRequestPasswordReset))
+		rt.router.PUT("/password-resets", rt.wrap(handleResetPassword))
+	} else {
+		rt.router.POST("/password-resets", rt.wrap(handlePasswordResetsDisabled))
+		rt.router.PUT("/password-resets", rt.wrap(handlePasswordResetsDisabled))
+	}
+
 	// Special routes
 	rt.router.GET("/liveness", rt.liveness)
+	rt.router.GET("/readiness", rt.readiness)
 
 	// User routes
-	rt.router.GET("/users", rt.wrap(HandleGetAllUsers))
-	rt.router.GET("/users/:userId/username", rt.wrap(handleGetUsername))
-	rt.router.GET("/users/:userId", rt.wrap(HandleGetUserProfileID))
+	rt.router.GET("/users", rt.wrap(HandleGetAllUsers, authenticated))
+	rt.router.GET("/users/:userId/username", rt.wrap(handleGetUsername, authenticated, existingUser("userId")))
+	rt.router.GET("/users/:userId", rt.wrap(HandleGetUserProfileID, unblockedUser("userId")))
+	rt.router.GET("/users/:userId/followers", rt.wrap(handleGetFollowers, visibleUser("userId")))
+	rt.router.GET("/users/:userId/following", rt.wrap(handleGetFollowing, visibleUser("userId")))
+	rt.router.GET("/users/:userId/photos", rt.wrap(handleGetUserPhotos, visibleUser("userId")))
 	rt.router.POST("/users", rt.wrap(HandleAddUser))
-	rt.router.PATCH("/users/username", rt.wrap(HandleSetUsername))
+	rt.router.PATCH("/users/username", rt.wrap(HandleSetUsername, authenticated))
+	rt.router.PUT("/users/password", rt.wrap(handleChangePassword, authenticated))
+	rt.router.PUT("/users/privacy", rt.wrap(handleSetPrivacy, authenticated))
 
 	// Photo routes
-	rt.router.GET("/photos", rt.wrap(handleGetPhotos))
-	rt.router.GET("/photos/:photoId", rt.wrap(handleGetPhoto))
-	rt.router.POST("/photos", rt.wrap(handleUploadPhoto))
-	rt.router.DELETE("/photos/:photoId", rt.wrap(handleDeletePhoto))
-	rt.router.GET("/stream", rt.wrap(handleGetMyStream))
+	rt.router.GET("/photos", rt.wrap(handleGetPhotos, authenticated))
+	rt.router.GET("/photos/:photoId", rt.wrap(handleGetPhoto, visiblePhoto("photoId")))
+	rt.router.GET("/photos/:photoId/image", rt.wrap(handleGetPhotoImage, visiblePhoto("photoId")))
+	rt.router.GET("/photos/:photoId/images/:position", rt.wrap(handleGetPhotoImage, visiblePhoto("photoId")))
+	rt.router.POST("/photos", rt.wrap(handleUploadPhoto, authenticated))
+	rt.router.DELETE("/photos/:photoId", rt.wrap(handleDeletePhoto, photoOwner("photoId")))
+	rt.router.PATCH("/photos/:photoId", rt.wrap(handleUpdatePhoto, photoOwner("photoId")))
+	rt.router.GET("/stream", rt.wrap(handleGetMyStream, authenticated))
 
 	// likes routes
-	rt.router.GET("/photos/:photoId/likes", rt.wrap(HandleIsLiked))
-	rt.router.POST("/photos/:photoId/likes", rt.wrap(HandleLikePhoto))
-	rt.router.DELETE("/photos/:photoId/likes", rt.wrap(HandleUnlikePhoto))
+	rt.router.GET("/photos/:photoId/likes", rt.wrap(HandleIsLiked, visiblePhoto("photoId")))
+	rt.router.POST("/photos/:photoId/likes", rt.wrap(HandleLikePhoto, visiblePhoto("photoId")))
+	rt.router.DELETE("/photos/:photoId/likes", rt.wrap(HandleUnlikePhoto, visiblePhoto("photoId")))
 
 	// Comments routes
-	rt.router.POST("/photos/:photoId/comments", rt.wrap(handleCommentPhoto))
-	rt.router.GET("/photos/:photoId/comments", rt.wrap(handleGetComments))
-	rt.router.DELETE("/comments/:commentId", rt.wrap(handleUncommentPhoto))
+	rt.router.POST("/photos/:photoId/comments", rt.wrap(handleCommentPhoto, visiblePhoto("photoId")))
+	rt.router.GET("/photos/:photoId/comments", rt.wrap(handleGetComments, visiblePhoto("photoId")))
+	rt.router.DELETE("/comments/:commentId", rt.wrap(handleUncommentPhoto, commentModerator("commentId")))
+	rt.router.PATCH("/comments/:commentId", rt.wrap(handleEditComment, commentOwner("commentId")))
+	rt.router.GET("/comments/:commentId/edits", rt.wrap(handleGetCommentEdits, visibleComment("commentId")))
+	rt.router.PUT("/comments/:commentId/hidden", rt.wrap(handleSetCommentHidden, commentPhotoOwner("commentId")))
+	rt.router.GET("/comments/:commentId/replies", rt.wrap(handleGetReplies, visibleComment("commentId")))
+	rt.router.GET("/comments/:commentId/likes", rt.wrap(handleIsCommentLiked, visibleComment("commentId")))
+	rt.router.POST("/comments/:commentId/likes", rt.wrap(handleLikeComment, visibleComment("commentId")))
+	rt.router.DELETE("/comments/:commentId/likes", rt.wrap(handleUnlikeComment, visibleComment("commentId")))
 
 	// follow routes
-	rt.router.GET("/follows/:userId", rt.wrap(handleIsUserFollowed))
-	rt.router.DELETE("/users/:userId/followers", rt.wrap(HandleUnfollowUser))
-	rt.router.POST("/users/:userId/followers", rt.wrap(HandleFollowUser))
+	rt.router.GET("/follows/:userId", rt.wrap(handleIsUserFollowed, authenticated))
+	rt.router.DELETE("/users/:userId/followers", rt.wrap(HandleUnfollowUser, authenticated, existingUser("userId")))
+	rt.router.POST("/users/:userId/followers", rt.wrap(HandleFollowUser, unblockedUser("userId")))
+
+	// follow request routes
+	rt.router.GET("/follow-requests", rt.wrap(handleGetFollowRequests, authenticated))
+	rt.router.PUT("/follow-requests/:userId", rt.wrap(handleApproveFollowRequest, authenticated))
+	rt.router.DELETE("/follow-requests/:userId", rt.wrap(handleDenyFollowRequest, authenticated))
+
+	// notification routes
+	rt.router.GET("/notifications", rt.wrap(handleGetNotifications, authenticated))
+	rt.router.PATCH("/notifications", rt.wrap(handleSetAllNotificationsRead, authenticated))
+	rt.router.PATCH("/notifications/:notificationId", rt.wrap(handleSetNotificationRead, authenticated))
+
+	// event routes
+	rt.router.GET("/events", rt.wrapWithTimeout(0, handleGetEvents, authenticated))
+
+	// search routes
+	rt.router.GET("/search/users", rt.wrap(handleSearchUsers, authenticated))
+	rt.router.GET("/search/photos", rt.wrap(handleSearchPhotos, authenticated))
+
+	// tag routes
+	rt.router.GET("/tags/:tag/photos", rt.wrap(handleGetTagPhotos, authenticated))
+	rt.router.GET("/trending/tags", rt.wrap(rt.handleGetTrendingTags, authenticated))
 
 	// ban routes
-	rt.router.GET("/bans/:userId", rt.wrap(handleIsUserBanned))
-	rt.router.DELETE("/users/:userId/bans", rt.wrap(handleUnbanUser))
-	rt.router.POST("/users/:userId/bans", rt.wrap(handleBanUser))
+	rt.router.GET("/bans/:userId", rt.wrap(handleIsUserBanned, authenticated))
+	rt.router.DELETE("/users/:userId/bans", rt.wrap(handleUnbanUser, authenticated, existingUser("userId")))
+	rt.router.POST("/users/:userId/bans", rt.wrap(handleBanUser, authenticated, existingUser("userId")))
 
 	return rt.router
 }
@@ -9,8 +9,11 @@ Example:
 
 	// Create the API router
 	apirouter, err := api.New(api.Config{
-		Logger:   logger,
-		Database: appdb,
+		Logger:        logger,
+		Database:      appdb,
+		Sessions:      sessions,
+		Blobs:         blobs,
+		Notifications: notifier,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
@@ -38,10 +41,17 @@ package api
 
 import (
 	"errors"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/events"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/mailer"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/notifications"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/session"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"time"
 )
 
 // Config is used to provide dependencies and configuration to the New function.
@@ -51,8 +61,44 @@ type Config struct {
 
 	// Database is the instance of database.AppDatabase where data are saved
 	Database database.AppDatabase
+
+	// Sessions issues and verifies the bearer tokens of authenticated requests
+	Sessions *session.Manager
+
+	// Blobs stores the image files of the photos
+	Blobs blobstore.BlobStore
+
+	// Notifications records the events that concern users (likes, comments, follows)
+	Notifications *notifications.Notifier
+
+	// Mailer delivers the password reset tokens. Without one, the password reset routes reply 501 Not Implemented,
+	// since the tokens could not reach the users.
+	Mailer mailer.Mailer
+
+	// TrendingWindow is how far back GET /trending/tags counts the photos. Defaults to 7 days.
+	TrendingWindow time.Duration
+
+	// DiskPaths are the directories where data are written (e.g., the database and the local blob store): GET
+	// /readiness fails if any of them has less than MinFreeDisk bytes available
+	DiskPaths []string
+
+	// MinFreeDisk is the free disk space required by GET /readiness, in bytes. Defaults to 100 MiB.
+	MinFreeDisk uint64
+
+	// RequestTimeout is how long a request can take before its context ends, cancelling the database queries. Keep it
+	// below the write timeout of the server, so that the error reply can still be sent. Defaults to 4 seconds.
+	RequestTimeout time.Duration
 }
 
+// defaultTrendingWindow is the trending window used if Config.TrendingWindow is not set.
+const defaultTrendingWindow = 7 * 24 * time.Hour
+
+// defaultMinFreeDisk is the free disk space required if Config.MinFreeDisk is not set.
+const defaultMinFreeDisk = 100 << 20
+
+// defaultRequestTimeout is the request timeout used if Config.RequestTimeout is not set.
+const defaultRequestTimeout = 4 * time.Second
+
 // Router is the package API interface representing an API handler builder
 type Router interface {
 	// Handler returns an HTTP handler for APIs provided in this package
@@ -71,6 +117,24 @@ func New(cfg Config) (Router, error) {
 	if cfg.Database == nil {
 		return nil, errors.New("database is required")
 	}
+	if cfg.Sessions == nil {
+		return nil, errors.New("session manager is required")
+	}
+	if cfg.Blobs == nil {
+		return nil, errors.New("blob store is required")
+	}
+	if cfg.Notifications == nil {
+		return nil, errors.New("notifier is required")
+	}
+	if cfg.TrendingWindow <= 0 {
+		cfg.TrendingWindow = defaultTrendingWindow
+	}
+	if cfg.MinFreeDisk == 0 {
+		cfg.MinFreeDisk = defaultMinFreeDisk
+	}
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = defaultRequestTimeout
+	}
 
 	// Create a new router where we will register HTTP endpoints. The server will pass requests to this router to be
 	// handled.
@@ -78,10 +142,29 @@ func New(cfg Config) (Router, error) {
 	router.RedirectTrailingSlash = false
 	router.RedirectFixedPath = false
 
+	// The hub delivers the events streamed by GET /events; it lives as long as the router
+	hub, err := events.New(events.Config{
+		Database: cfg.Database,
+		Logger:   cfg.Logger,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating the event hub: %w", err)
+	}
+
 	return &_router{
 		router:     router,
 		baseLogger: cfg.Logger,
 		db:         cfg.Database,
+		sessions:   cfg.Sessions,
+		blobs:      cfg.Blobs,
+		notifier:   cfg.Notifications,
+		mailer:     cfg.Mailer,
+		events:     hub,
+
+		trendingWindow: cfg.TrendingWindow,
+		diskPaths:      cfg.DiskPaths,
+		minFreeDisk:    cfg.MinFreeDisk,
+		requestTimeout: cfg.RequestTimeout,
 	}, nil
 }
 
@@ -93,4 +176,24 @@ type _router struct {
 	baseLogger logrus.FieldLogger
 
 	db database.AppDatabase
+
+	sessions *session.Manager
+
+	blobs blobstore.BlobStore
+
+	notifier *notifications.Notifier
+
+	mailer mailer.Mailer
+
+	events *events.Hub
+
+	// trendingWindow is how far back GET /trending/tags counts the photos
+	trendingWindow time.Duration
+
+	// diskPaths are the directories checked by GET /readiness, which requires minFreeDisk bytes available in each
+	diskPaths   []string
+	minFreeDisk uint64
+
+	// requestTimeout is the timeout of the requests handled by rt.wrap
+	requestTimeout time.Duration
 }
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// policy is an authorization rule evaluated by rt.wrap before the handler is called. It returns nil to let the request
+// through, or one of errUnauthorized, errForbidden and errNotFound to reject it. Any other error is a server error.
+// The rejection reply is chosen by errorStatus. The queries run with the context of r, which ends with the request.
+type policy func(r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) error
+
+var (
+	errUnauthorized = errors.New("authentication required")
+	errForbidden    = database.ErrForbidden
+	errNotFound     = database.ErrNotFound
+)
+
+// authorize evaluates the policies in order and writes the rejection reply, if any. It returns false if the request
+// must not reach the handler.
+func authorize(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext,
+	policies []policy) bool {
+	for _, p := range policies {
+		if err := p(r, ps, ctx); err != nil {
+			writeErrorFor(w, ctx, err, "can't evaluate the authorization policy")
+			return false
+		}
+	}
+	return true
+}
+
+// authenticated requires a valid session. Handlers behind this policy can rely on ctx.User being set.
+func authenticated(r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) error {
+	if ctx.User == nil {
+		return errUnauthorized
+	}
+	return nil
+}
+
+// existingUser requires the user in the named path parameter to exist.
+func existingUser(param string) policy {
+	return func(r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) error {
+		exists, err := ctx.Database.UserExists(r.Context(), ps.ByName(param))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errNotFound
+		}
+		return nil
+	}
+}
+
+// The ban policies below reject with errNotFound, so that banned users can't tell the content from a missing one. See
+// database/ban-policy.go for what a ban hides.
+
+// unblockedUser requires the user in the named path parameter to exist and no ban between them and the current user,
+// whoever made it.
+func unblockedUser(param string) policy {
+	return func(r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) error {
+		if err := authenticated(r, ps, ctx); err != nil {
+			return err
+		}
+		if err := existingUser(param)(r, ps, ctx); err != nil {
+			return err
+		}
+		return unblocked(r, ctx, ps.ByName(param))
+	}
+}
+
+// unblockedPhoto requires the photo in the named path parameter to exist and no ban between its owner and the current
+// user, whoever made it.
+func unblockedPhoto(param string) policy {
+	return func(r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) error {
+		if err := authenticated(r, ps, ctx); err != nil {
+			return err
+		}
+		ownerID, err := ctx.Database.GetPhotoOwner(r.Context(), ps.ByName(param))
+		if err != nil {
+			return err
+		}
+		if ownerID == "" {
+			return errNotFound
+		}
+		return unblocked(r, ctx, ownerID)
+	}
+}
+
+func unblocked(r *http.Request, ctx reqcontext.RequestContext, userID string) error {
+	blocked, err := ctx.Database.Blocked(r.Context(), ctx.User.ID, userID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return errNotFound
+	}
+	return nil
+}
+
+// visibleUser requires the user in the named path parameter to pass unblockedUser and, if the account is private, the
+// current user to be an approved follower.
+func visibleUser(param string) policy {
+	return func(r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) error {
+		if err := unblockedUser(param)(r, ps, ctx); err != nil {
+			return err
+		}
+		return canView(r, ctx, ps.ByName(param))
+	}
+}
+
+// visiblePhoto requires the photo in the named path parameter to pass unblockedPhoto and, if its owner is a private
+// account, the current user to be an approved follower.
+func visiblePhoto(param string) policy {
+	return func(r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) error {
+		if err := unblockedPhoto(param)(r, ps, ctx); err != nil {
+			return err
+		}
+		ownerID, err := ctx.Database.GetPhotoOwner(r.Context(), ps.ByName(param))
+		if err != nil {
+			return err
+		}
+		return canView(r, ctx, ownerID)
+	}
+}
+
+// visibleComment requires the comment in the named path parameter to exist, its photo to pass visiblePhoto and, unless
+// the comment was deleted, no ban between its author and the current user. Hidden comments are visible only to their
+// author and to the owner of the photo.
+func visibleComment(param string) policy {
+	return func(r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) error {
+		if err := authenticated(r, ps, ctx); err != nil {
+			return err
+		}
+		comment, err := ctx.Database.GetComment(r.Context(), ps.ByName(param))
+		if err != nil {
+			return err
+		}
+		if comment == nil {
+			return errNotFound
+		}
+		if !comment.Deleted {
+			if err := unblocked(r, ctx, comment.UserID); err != nil {
+				return err
+			}
+		}
+		ownerID, err := ctx.Database.GetPhotoOwner(r.Context(), comment.PhotoID)
+		if err != nil {
+			return err
+		}
+		if comment.Hidden && ctx.User.ID != comment.UserID && ctx.User.ID != ownerID {
+			return errNotFound
+		}
+		if err := unblocked(r, ctx, ownerID); err != nil {
+			return err
+		}
+		return canView(r, ctx, ownerID)
+	}
+}
+
+func canView(r *http.Request, ctx reqcontext.RequestContext, ownerID string) error {
+	visible, err := ctx.Database.CanView(r.Context(), ctx.User.ID, ownerID)
+	if err != nil {
+		return err
+	}
+	if !visible {
+		return errForbidden
+	}
+	return nil
+}
+
+// photoOwner requires the photo in the named path parameter to exist and to belong to the current user.
+func photoOwner(param string) policy {
+	return func(r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) error {
+		if err := authenticated(r, ps, ctx); err != nil {
+			return err
+		}
+		ownerID, err := ctx.Database.GetPhotoOwner(r.Context(), ps.ByName(param))
+		if err != nil {
+			return err
+		}
+		if ownerID == "" {
+			return errNotFound
+		}
+		if ownerID != ctx.User.ID {
+			return errForbidden
+		}
+		return nil
+	}
+}
+
+// commentOwner requires the comment in the named path parameter to exist and to belong to the current user.
+func commentOwner(param string) policy {
+	return func(r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) error {
+		if err := authenticated(r, ps, ctx); err != nil {
+			return err
+		}
+		ownerID, err := ctx.Database.GetCommentOwner(r.Context(), ps.ByName(param))
+		if err != nil {
+			return err
+		}
+		if ownerID == "" {
+			return errNotFound
+		}
+		if ownerID != ctx.User.ID {
+			return errForbidden
+		}
+		return nil
+	}
+}
+
+// commentPhotoOwner requires the comment in the named path parameter to exist, not deleted, and to be on a photo of the
+// current user.
+func commentPhotoOwner(param string) policy {
+	return func(r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) error {
+		_, photoOwnerID, err := commentAuthors(r, ps.ByName(param), ps, ctx)
+		if err != nil {
+			return err
+		}
+		if photoOwnerID != ctx.User.ID {
+			return errForbidden
+		}
+		return nil
+	}
+}
+
+// commentModerator requires the comment in the named path parameter to exist, not deleted, and to belong to the
+// current user or to be on a photo of the current user.
+func commentModerator(param string) policy {
+	return func(r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) error {
+		authorID, photoOwnerID, err := commentAuthors(r, ps.ByName(param), ps, ctx)
+		if err != nil {
+			return err
+		}
+		if authorID != ctx.User.ID && photoOwnerID != ctx.User.ID {
+			return errForbidden
+		}
+		return nil
+	}
+}
+
+// commentAuthors returns the author of the comment and the owner of its photo. The comment must exist and not be
+// deleted.
+func commentAuthors(r *http.Request, commentID string, ps httprouter.Params,
+	ctx reqcontext.RequestContext) (string, string, error) {
+	if err := authenticated(r, ps, ctx); err != nil {
+		return "", "", err
+	}
+	comment, err := ctx.Database.GetComment(r.Context(), commentID)
+	if err != nil {
+		return "", "", err
+	}
+	if comment == nil || comment.Deleted {
+		return "", "", errNotFound
+	}
+	photoOwnerID, err := ctx.Database.GetPhotoOwner(r.Context(), comment.PhotoID)
+	if err != nil {
+		return "", "", err
+	}
+	return comment.UserID, photoOwnerID, nil
+}
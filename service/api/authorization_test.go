@@ -0,0 +1,244 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database/conformance"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/notifications"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/session"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// fixture is a database with a few users, photos and comments whose relations exercise every policy:
+//   - alice owns the photo, and banned carol;
+//   - bob commented the photo of alice;
+//   - dave is a private account, with a photo and no followers;
+//   - the deleted comment of bob is a tombstone.
+type fixture struct {
+	db database.AppDatabase
+
+	alice, bob, carol, dave database.User
+
+	photo, privatePhoto     string
+	comment, deletedComment string
+	closeDatabase           func()
+}
+
+func newFixture(t *testing.T) *fixture {
+	tmp, err := conformance.NewSQLite()
+	if err != nil {
+		t.Fatalf("creating the database: %v", err)
+	}
+	if err := database.Migrate(tmp.DB); err != nil {
+		_ = tmp.Close()
+		t.Fatalf("migrating: %v", err)
+	}
+	db, err := database.New(tmp.DB)
+	if err != nil {
+		_ = tmp.Close()
+		t.Fatalf("opening: %v", err)
+	}
+	f := &fixture{db: db, closeDatabase: func() { _ = tmp.Close() }}
+
+	ctx := context.Background()
+	must := func(err error, what string) {
+		if err != nil {
+			f.closeDatabase()
+			t.Fatalf("%s: %v", what, err)
+		}
+	}
+	f.alice.Username, f.bob.Username, f.carol.Username, f.dave.Username = "alice", "bob", "carol", "dave"
+	for _, u := range []*database.User{&f.alice, &f.bob, &f.carol, &f.dave} {
+		must(db.AddUser(ctx, u), "adding "+u.Username)
+	}
+	must(db.BanUser(ctx, f.alice.ID, f.carol.ID), "banning carol")
+	must(db.SetPrivate(ctx, f.dave.ID, true), "making dave private")
+
+	now := time.Now().UTC()
+	addPhoto := func(id string, owner database.User) string {
+		_, err := db.AddPhoto(ctx, database.Photo{ID: id, UserID: owner.ID, Timestamp: now,
+			Images: []database.Image{{ImageKey: id + "-key", ImageType: "image/png"}}})
+		must(err, "adding a photo")
+		return id
+	}
+	f.photo = addPhoto("photo-alice", f.alice)
+	f.privatePhoto = addPhoto("photo-dave", f.dave)
+
+	addComment := func(id string) string {
+		_, err := db.AddComment(ctx, database.Comment{ID: id, UserID: f.bob.ID, PhotoID: f.photo, Content: "Nice",
+			Timestamp: now})
+		must(err, "adding a comment")
+		return id
+	}
+	f.comment = addComment("comment-bob")
+	f.deletedComment = addComment("comment-deleted")
+	must(db.DeleteComment(ctx, f.deletedComment), "deleting a comment")
+	return f
+}
+
+// newRouter returns a router on the database of the fixture, and a session token for each user by username.
+func (f *fixture) newRouter(t *testing.T) (Router, map[string]string) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	sessions, err := session.New(session.Config{Key: []byte("key"), TTL: time.Hour, Database: f.db})
+	if err != nil {
+		t.Fatalf("creating the session manager: %v", err)
+	}
+	blobs, err := blobstore.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("creating the blob store: %v", err)
+	}
+	notifier, err := notifications.New(notifications.Config{Database: f.db})
+	if err != nil {
+		t.Fatalf("creating the notifier: %v", err)
+	}
+	rt, err := New(Config{Logger: logger, Database: f.db, Sessions: sessions, Blobs: blobs, Notifications: notifier})
+	if err != nil {
+		t.Fatalf("creating the router: %v", err)
+	}
+	tokens := map[string]string{}
+	for _, u := range []database.User{f.alice, f.bob, f.carol, f.dave} {
+		token, err := sessions.Issue(context.Background(), u.ID)
+		if err != nil {
+			t.Fatalf("issuing a token: %v", err)
+		}
+		tokens[u.Username] = token.Value
+	}
+	return rt, tokens
+}
+
+func TestPolicies(t *testing.T) {
+	f := newFixture(t)
+	defer f.closeDatabase()
+
+	params := func(name, value string) httprouter.Params {
+		return httprouter.Params{{Key: name, Value: value}}
+	}
+	anonymous := (*database.User)(nil)
+	cases := []struct {
+		name   string
+		policy policy
+		user   *database.User
+		ps     httprouter.Params
+		want   error
+	}{
+		{"authenticated: anonymous", authenticated, anonymous, nil, errUnauthorized},
+		{"authenticated: user", authenticated, &f.bob, nil, nil},
+
+		{"existingUser: missing", existingUser("userId"), &f.bob, params("userId", "missing"), errNotFound},
+		{"existingUser: present", existingUser("userId"), &f.bob, params("userId", f.alice.ID), nil},
+
+		{"unblockedUser: anonymous", unblockedUser("userId"), anonymous, params("userId", f.alice.ID), errUnauthorized},
+		{"unblockedUser: no ban", unblockedUser("userId"), &f.bob, params("userId", f.alice.ID), nil},
+		{"unblockedUser: banned by the target", unblockedUser("userId"), &f.carol, params("userId", f.alice.ID),
+			errNotFound},
+		{"unblockedUser: target banned", unblockedUser("userId"), &f.alice, params("userId", f.carol.ID), errNotFound},
+
+		{"unblockedPhoto: missing", unblockedPhoto("photoId"), &f.bob, params("photoId", "missing"), errNotFound},
+		{"unblockedPhoto: no ban", unblockedPhoto("photoId"), &f.bob, params("photoId", f.photo), nil},
+		{"unblockedPhoto: owner banned the user", unblockedPhoto("photoId"), &f.carol, params("photoId", f.photo),
+			errNotFound},
+
+		{"visibleUser: private, not a follower", visibleUser("userId"), &f.bob, params("userId", f.dave.ID),
+			errForbidden},
+		{"visibleUser: private, themselves", visibleUser("userId"), &f.dave, params("userId", f.dave.ID), nil},
+		{"visiblePhoto: private owner", visiblePhoto("photoId"), &f.bob, params("photoId", f.privatePhoto),
+			errForbidden},
+		{"visiblePhoto: public owner", visiblePhoto("photoId"), &f.bob, params("photoId", f.photo), nil},
+
+		{"visibleComment: missing", visibleComment("commentId"), &f.bob, params("commentId", "missing"), errNotFound},
+		{"visibleComment: visible", visibleComment("commentId"), &f.dave, params("commentId", f.comment), nil},
+		{"visibleComment: photo owner banned the user", visibleComment("commentId"), &f.carol,
+			params("commentId", f.comment), errNotFound},
+
+		{"photoOwner: anonymous", photoOwner("photoId"), anonymous, params("photoId", f.photo), errUnauthorized},
+		{"photoOwner: missing", photoOwner("photoId"), &f.alice, params("photoId", "missing"), errNotFound},
+		{"photoOwner: owner", photoOwner("photoId"), &f.alice, params("photoId", f.photo), nil},
+		{"photoOwner: someone else", photoOwner("photoId"), &f.bob, params("photoId", f.photo), errForbidden},
+
+		{"commentOwner: author", commentOwner("commentId"), &f.bob, params("commentId", f.comment), nil},
+		{"commentOwner: photo owner", commentOwner("commentId"), &f.alice, params("commentId", f.comment),
+			errForbidden},
+		{"commentOwner: missing", commentOwner("commentId"), &f.bob, params("commentId", "missing"), errNotFound},
+
+		{"commentPhotoOwner: photo owner", commentPhotoOwner("commentId"), &f.alice, params("commentId", f.comment),
+			nil},
+		{"commentPhotoOwner: author", commentPhotoOwner("commentId"), &f.bob, params("commentId", f.comment),
+			errForbidden},
+		{"commentPhotoOwner: deleted", commentPhotoOwner("commentId"), &f.alice,
+			params("commentId", f.deletedComment), errNotFound},
+
+		{"commentModerator: author", commentModerator("commentId"), &f.bob, params("commentId", f.comment), nil},
+		{"commentModerator: photo owner", commentModerator("commentId"), &f.alice, params("commentId", f.comment),
+			nil},
+		{"commentModerator: someone else", commentModerator("commentId"), &f.dave, params("commentId", f.comment),
+			errForbidden},
+		{"commentModerator: deleted", commentModerator("commentId"), &f.bob, params("commentId", f.deletedComment),
+			errNotFound},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		ctx := reqcontext.RequestContext{Database: f.db, User: c.user}
+		if err := c.policy(r, c.ps, ctx); !errors.Is(err, c.want) || (c.want == nil && err != nil) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+// TestRoutePolicies checks that the routes are registered with their policies, and that the rejections get the right
+// status.
+func TestRoutePolicies(t *testing.T) {
+	f := newFixture(t)
+	defer f.closeDatabase()
+
+	rt, tokens := f.newRouter(t)
+	handler := rt.Handler()
+
+	cases := []struct {
+		method, path string
+		user         string
+		want         int
+	}{
+		{http.MethodGet, "/photos", "", http.StatusUnauthorized},
+		{http.MethodGet, "/users/" + f.alice.ID, "bob", http.StatusOK},
+		{http.MethodGet, "/users/" + f.alice.ID, "carol", http.StatusNotFound},
+		{http.MethodGet, "/users/" + f.carol.ID, "alice", http.StatusNotFound},
+		{http.MethodGet, "/photos/" + f.photo, "bob", http.StatusOK},
+		{http.MethodGet, "/photos/" + f.photo, "carol", http.StatusNotFound},
+		{http.MethodGet, "/photos/" + f.privatePhoto, "bob", http.StatusForbidden},
+		{http.MethodDelete, "/photos/" + f.photo, "bob", http.StatusForbidden},
+		{http.MethodDelete, "/photos/missing", "alice", http.StatusNotFound},
+		{http.MethodGet, "/users/" + f.alice.ID + "/photos", "carol", http.StatusNotFound},
+		{http.MethodGet, "/users/" + f.dave.ID + "/photos", "bob", http.StatusForbidden},
+		{http.MethodGet, "/trending/tags", "", http.StatusUnauthorized},
+		{http.MethodGet, "/trending/tags?limit=1000", "bob", http.StatusOK},
+		{http.MethodGet, "/tags/trending/photos", "bob", http.StatusOK},
+		{http.MethodPut, "/comments/" + f.comment + "/hidden", "bob", http.StatusForbidden},
+		{http.MethodGet, "/comments/" + f.comment + "/replies", "carol", http.StatusNotFound},
+		{http.MethodDelete, "/comments/" + f.comment, "dave", http.StatusForbidden},
+		{http.MethodDelete, "/comments/" + f.comment, "alice", http.StatusOK},
+		// The user who made the ban can still lift it; the cases above depend on it, so it goes last
+		{http.MethodDelete, "/users/" + f.carol.ID + "/bans", "alice", http.StatusOK},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if c.user != "" {
+			r.Header.Set("Authorization", "Bearer "+tokens[c.user])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s %s as %q: got %d, want %d (%s)", c.method, c.path, c.user, w.Code, c.want, w.Body)
+		}
+	}
+}
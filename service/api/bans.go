@@ -2,9 +2,11 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -14,28 +16,16 @@ func handleBanUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params,
 
 	// Check if user is trying to ban themselves
 	if userId == bannedBy {
-		http.Error(w, "Cannot ban yourself", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Cannot ban yourself")
 		return
 	}
 
-	// Check if the banning user is banned by the user they are trying to ban
-	isBannedByUser, err := ctx.Database.IsBannedBy(userId, bannedBy)
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-	if isBannedByUser {
-		http.Error(w, "Cannot ban a user who has banned you", http.StatusForbidden)
+	err := ctx.Database.BanUser(r.Context(), bannedBy, userId)
+	if errors.Is(err, database.ErrConflict) {
+		writeError(w, ctx, http.StatusConflict, "User is already banned")
 		return
-	}
-
-	err = ctx.Database.BanUser(bannedBy, userId)
-	if err != nil {
-		if err.Error() == "user is already banned" {
-			http.Error(w, "User is already banned", http.StatusConflict)
-			return
-		}
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	} else if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to ban user")
 		return
 	}
 	ctx.Logger.Infof("User %s banned by %s", userId, ctx.User.Username)
@@ -48,21 +38,21 @@ func handleBanUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params,
 func handleUnbanUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	userId := ps.ByName("userId")
 	if userId == "" {
-		http.Error(w, "Invalid parameters", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid parameters")
 		return
 	}
 
 	// Check if user is trying to unban themselves
 	if userId == ctx.User.ID {
-		http.Error(w, "Cannot unban yourself", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Cannot unban yourself")
 		return
 	}
 
 	bannerUser := ctx.User.ID
 
-	err := ctx.Database.UnbanUser(bannerUser, userId)
+	err := ctx.Database.UnbanUser(r.Context(), bannerUser, userId)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeErrorFor(w, ctx, err, "Failed to unban user")
 		return
 	}
 	ctx.Logger.Infof("User %s unbanned by %s", userId, ctx.User.Username)
@@ -76,18 +66,23 @@ func handleIsUserBanned(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 	var banner = ctx.User.ID
 	userId := ps.ByName("userId")
 	if userId == "" {
-		http.Error(w, "Invalid userId parameter", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid userId parameter")
+		return
+	}
+
+	banned, err := ctx.Database.BanExists(r.Context(), banner, userId)
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to check if user is banned")
 		return
 	}
 
-	banned, err := ctx.Database.BanExists(banner, userId)
+	bannedBy, err := ctx.Database.IsBannedBy(r.Context(), banner, userId)
 	if err != nil {
-		ctx.Logger.Error("Failed to check if user is banned: ", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeErrorFor(w, ctx, err, "Failed to check if user is banned by")
 		return
 	}
 
-	response := map[string]bool{"banned": banned}
+	response := map[string]bool{"banned": banned, "bannedBy": bannedBy}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		ctx.Logger.Errorf("Failed to write response: %v", err)
@@ -2,48 +2,88 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"time"
+	"strings"
+	"unicode/utf8"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/events"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/metrics"
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
 )
 
-func handleCommentPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	if ctx.User == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+// maxCommentLength is the maximum number of characters in a comment.
+const maxCommentLength = 1000
+
+// parseComment trims the content of a comment. It returns false if the content is blank, too long or not valid UTF-8.
+func parseComment(content string) (string, bool) {
+	content = strings.TrimSpace(content)
+	if content == "" || !utf8.ValidString(content) || utf8.RuneCountInString(content) > maxCommentLength {
+		return "", false
 	}
+	return content, true
+}
 
+func handleCommentPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	photoId := ps.ByName("photoId")
 	if photoId == "" {
-		http.Error(w, "Invalid photo ID", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid photo ID")
 		return
 	}
 
 	var req struct {
-		Content string `json:"content"`
+		Content         string `json:"content"`
+		ParentCommentID string `json:"parentCommentId"` // Comment replied to, if any
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 	defer r.Body.Close()
+	content, ok := parseComment(req.Content)
+	if !ok {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid comment content")
+		return
+	}
 
 	comment := database.Comment{
 		ID:        uuid.Must(uuid.NewV4()).String(), // Using a UUID library to generate the comment ID
 		UserID:    ctx.User.ID,
 		PhotoID:   photoId,
-		Content:   req.Content,
-		Timestamp: time.Now(),
+		ParentID:  req.ParentCommentID,
+		Content:   content,
+		Timestamp: globaltime.Now().UTC(),
 	}
 
-	err := ctx.Database.AddComment(comment)
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	mentioned, err := ctx.Database.AddComment(r.Context(), comment)
+	if errors.Is(err, database.ErrForbidden) {
+		writeError(w, ctx, http.StatusForbidden, "Comments are turned off for this photo")
 		return
+	} else if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to add the comment")
+		return
+	}
+	if req.ParentCommentID != "" {
+		err = ctx.Notifier.Replied(r.Context(), ctx.User.ID, photoId, comment.ID, req.ParentCommentID)
+	} else {
+		err = ctx.Notifier.Commented(r.Context(), ctx.User.ID, photoId, comment.ID)
+	}
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to update the notifications")
+	}
+	if err := ctx.Notifier.Mentioned(r.Context(), ctx.User.ID, photoId, comment.ID, mentioned); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to update the notifications")
+	}
+	publishEvent(r, ctx, events.Event{Type: events.TypeComment, PhotoID: photoId, CommentID: comment.ID})
+	if req.ParentCommentID != "" {
+		metrics.Comments.Inc("reply")
+	} else {
+		metrics.Comments.Inc("comment")
 	}
 	ctx.Logger.Infof("Comment added by %s", ctx.User.Username)
 	w.Header().Set("Content-Type", "application/json")
@@ -55,13 +95,13 @@ func handleCommentPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 func handleUncommentPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	commentID := ps.ByName("commentId")
 	if commentID == "" {
-		http.Error(w, "Invalid comment ID", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid comment ID")
 		return
 	}
 
-	err := ctx.Database.DeleteComment(commentID)
+	err := ctx.Database.DeleteComment(r.Context(), commentID)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeErrorFor(w, ctx, err, "Failed to delete the comment")
 		return
 	}
 	ctx.Logger.Infof("Comment deleted by %s", ctx.User.Username)
@@ -74,18 +114,134 @@ func handleUncommentPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.
 func handleGetComments(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	photoId := ps.ByName("photoId")
 	if photoId == "" {
-		http.Error(w, "Invalid photo ID", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid photo ID")
+		return
+	}
+	page, ok := parsePage(w, r, ctx)
+	if !ok {
 		return
 	}
 
-	comments, err := ctx.Database.GetCommentsByPhotoId(photoId)
+	comments, next, err := ctx.Database.GetCommentsByPhotoId(r.Context(), photoId, ctx.User.ID, page)
+	ctx.Logger.Infof("Comments fetched")
+	writePage(w, ctx, comments, next, err)
+}
+
+// handleEditComment replaces the content of a comment of the current user. The previous content is kept in the edit
+// history, and the users newly mentioned are notified.
+func handleEditComment(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Content *string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Content == nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	defer r.Body.Close()
+	content, ok := parseComment(*req.Content)
+	if !ok {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid comment content")
+		return
+	}
+
+	commentID := ps.ByName("commentId")
+	comment, err := ctx.Database.GetComment(r.Context(), commentID)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeErrorFor(w, ctx, err, "Failed to get the comment")
 		return
 	}
-	ctx.Logger.Infof("Comments fetched")
+	mentioned, err := ctx.Database.EditComment(r.Context(), commentID, content, globaltime.Now().UTC())
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to edit the comment")
+		return
+	}
+	ctx.Logger.Infof("Comment %s edited by %s", commentID, ctx.User.Username)
+	// Users already mentioned before the edit were notified then
+	if err := ctx.Notifier.Mentioned(r.Context(), ctx.User.ID, comment.PhotoID, commentID, mentioned); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to update the notifications")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetCommentEdits lists the previous versions of a comment, newest first.
+func handleGetCommentEdits(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	edits, err := ctx.Database.GetCommentEdits(r.Context(), ps.ByName("commentId"))
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to get the comment edits")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pageResponse{Items: edits}); err != nil {
+		ctx.Logger.Errorf("Failed to write response: %v", err)
+	}
+}
+
+// handleSetCommentHidden hides a comment on a photo of the current user, or shows it again.
+func handleSetCommentHidden(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Hidden *bool `json:"hidden"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Hidden == nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	defer r.Body.Close()
+
+	commentID := ps.ByName("commentId")
+	if err := ctx.Database.SetCommentHidden(r.Context(), commentID, *req.Hidden, globaltime.Now().UTC()); err != nil {
+		writeErrorFor(w, ctx, err, "Failed to update the comment")
+		return
+	}
+	ctx.Logger.Infof("Comment %s hidden by %s: %t", commentID, ctx.User.Username, *req.Hidden)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleGetReplies(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	page, ok := parsePage(w, r, ctx)
+	if !ok {
+		return
+	}
+
+	replies, next, err := ctx.Database.GetReplies(r.Context(), ps.ByName("commentId"), ctx.User.ID, page)
+	writePage(w, ctx, replies, next, err)
+}
+
+func handleLikeComment(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	commentID := ps.ByName("commentId")
+
+	err := ctx.Database.LikeComment(r.Context(), ctx.User.ID, commentID)
+	if errors.Is(err, database.ErrConflict) {
+		writeError(w, ctx, http.StatusConflict, "Comment already liked")
+		return
+	} else if err != nil {
+		writeErrorFor(w, ctx, err, "Error liking comment")
+		return
+	}
+	metrics.Likes.Inc("comment")
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "Comment liked successfully")
+}
+
+func handleUnlikeComment(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if err := ctx.Database.UnlikeComment(r.Context(), ctx.User.ID, ps.ByName("commentId")); err != nil {
+		writeErrorFor(w, ctx, err, "Error unliking comment")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "Comment unliked successfully")
+}
+
+func handleIsCommentLiked(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	liked, err := ctx.Database.IsCommentLiked(r.Context(), ctx.User.ID, ps.ByName("commentId"))
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Error checking if comment is liked")
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(comments); err != nil {
+	if err := json.NewEncoder(w).Encode(map[string]bool{"liked": liked}); err != nil {
 		ctx.Logger.Errorf("Failed to write response: %v", err)
 	}
 }
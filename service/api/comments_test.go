@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCommentContent(t *testing.T) {
+	f := newFixture(t)
+	defer f.closeDatabase()
+	rt, tokens := f.newRouter(t)
+	handler := rt.Handler()
+
+	tooLong := `{"content": "` + strings.Repeat("é", maxCommentLength+1) + `"}`
+	cases := []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPost, "/photos/" + f.photo + "/comments", `{"content": ""}`, http.StatusBadRequest},
+		{http.MethodPost, "/photos/" + f.photo + "/comments", `{"content": " \n\t "}`, http.StatusBadRequest},
+		{http.MethodPost, "/photos/" + f.photo + "/comments", tooLong, http.StatusBadRequest},
+		{http.MethodPost, "/photos/" + f.photo + "/comments", `{"content": " Nice "}`, http.StatusOK},
+		{http.MethodPatch, "/comments/" + f.comment, `{"content": "  "}`, http.StatusBadRequest},
+		{http.MethodPatch, "/comments/" + f.comment, tooLong, http.StatusBadRequest},
+		{http.MethodPatch, "/comments/" + f.comment, `{"content": "Very nice"}`, http.StatusNoContent},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		r.Header.Set("Authorization", "Bearer "+tokens["bob"])
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s %s with %.30q: got %d, want %d (%s)", c.method, c.path, c.body, w.Code, c.want, w.Body)
+		}
+	}
+}
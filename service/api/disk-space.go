@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package api
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// freeDiskSpace returns the bytes available to unprivileged users on the filesystem of path.
+func freeDiskSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, fmt.Errorf("checking the free space of %s: %w", path, err)
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
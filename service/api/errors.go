@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+// errorResponse is the body of every error reply.
+type errorResponse struct {
+	// Code is a stable, machine-readable identifier of the status, e.g. "not_found"
+	Code string `json:"code"`
+
+	// Message is a human-readable description of the error
+	Message string `json:"message"`
+
+	// RequestID is the ID of the request in the server logs
+	RequestID string `json:"requestId"`
+}
+
+// writeError replies with the given status and an errorResponse.
+func writeError(w http.ResponseWriter, ctx reqcontext.RequestContext, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(errorResponse{
+		Code:      errorCode(status),
+		Message:   message,
+		RequestID: ctx.ReqUUID.String(),
+	})
+	if err != nil {
+		ctx.Logger.Errorf("Failed to write response: %v", err)
+	}
+}
+
+// writeErrorFor replies with the status matching err (see errorStatus), using the generic message of the status.
+// Server errors are logged, together with what, since the client only sees the request ID.
+func writeErrorFor(w http.ResponseWriter, ctx reqcontext.RequestContext, err error, what string) {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		ctx.Logger.WithError(err).Error(what)
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		ctx.Logger.WithError(err).Warning(what)
+	}
+	writeError(w, ctx, status, http.StatusText(status))
+}
+
+// errorStatus maps the errors of the database (and of the authorization policies) to an HTTP status. Requests whose
+// context ended (see wrap) get 503 Service Unavailable. Unknown errors are server errors.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, database.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, database.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, database.ErrInvalidCursor):
+		return http.StatusBadRequest
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errorCode returns the code of the status, e.g. "not_found" for 404 Not Found.
+func errorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/events"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// eventsHeartbeat is how often a comment is sent on idle event streams, so that proxies keep the connection open
+	// and closed connections are noticed
+	eventsHeartbeat = 20 * time.Second
+
+	// eventsWriteTimeout is the deadline of each write on an event stream
+	eventsWriteTimeout = 10 * time.Second
+)
+
+// handleGetEvents streams the events concerning the current user (see the events package) as Server-Sent Events,
+// until the client disconnects or the server shuts down.
+func handleGetEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	sub, err := ctx.Events.Subscribe(ctx.User.ID)
+	if errors.Is(err, events.ErrClosed) {
+		writeError(w, ctx, http.StatusServiceUnavailable, "The server is shutting down")
+		return
+	} else if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to subscribe to the events")
+		return
+	}
+	defer sub.Close()
+
+	stream, err := openEventStream(w)
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to open the event stream")
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				ctx.Logger.WithError(err).Error("Failed to encode the event")
+				return
+			}
+			if err := stream.write("event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				ctx.Logger.WithError(err).Debug("Event stream closed")
+				return
+			}
+		case <-heartbeat.C:
+			if err := stream.write(": heartbeat\n\n"); err != nil {
+				ctx.Logger.WithError(err).Debug("Event stream closed")
+				return
+			}
+		}
+	}
+}
+
+// publishEvent sends e, done by the current user, to the connected users it concerns. The change is saved anyway, so
+// errors are only logged.
+func publishEvent(r *http.Request, ctx reqcontext.RequestContext, e events.Event) {
+	e.ActorID = ctx.User.ID
+	e.ActorUsername = ctx.User.Username
+	e.Timestamp = globaltime.Now().UTC()
+	if err := ctx.Events.Publish(r.Context(), e); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to publish the event")
+	}
+}
+
+// eventStream is an open text/event-stream response.
+//
+// The stream outlives the write timeout of the HTTP server, which is meant for ordinary requests, so each write moves
+// the deadline forward.
+type eventStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// openEventStream sends the response headers of the stream, including those already set on w (e.g., by the CORS
+// middleware). It fails before writing anything if the connection can't stream.
+func openEventStream(w http.ResponseWriter) (*eventStream, error) {
+	stream := &eventStream{w: w, rc: http.NewResponseController(w)}
+	if err := stream.rc.SetWriteDeadline(time.Now().Add(eventsWriteTimeout)); err != nil {
+		return nil, fmt.Errorf("the connection doesn't support streaming: %w", err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := stream.rc.Flush(); err != nil {
+		return nil, fmt.Errorf("sending the headers: %w", err)
+	}
+	return stream, nil
+}
+
+// write sends the formatted text right away.
+func (s *eventStream) write(format string, args ...interface{}) error {
+	if err := s.rc.SetWriteDeadline(time.Now().Add(eventsWriteTimeout)); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, format, args...); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
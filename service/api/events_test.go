@@ -0,0 +1,59 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/events"
+)
+
+// TestEventStream checks that GET /events streams over HTTP/1.1 and HTTP/2, past the write timeout of the server.
+func TestEventStream(t *testing.T) {
+	for _, http2 := range []bool{false, true} {
+		f := newFixture(t)
+		rt, tokens := f.newRouter(t)
+
+		server := httptest.NewUnstartedServer(rt.Handler())
+		server.Config.WriteTimeout = 100 * time.Millisecond
+		server.EnableHTTP2 = http2
+		server.StartTLS()
+
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+		if err != nil {
+			t.Fatalf("creating the request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tokens["bob"])
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("opening the stream: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Errorf("%s: got %s %q", resp.Proto, resp.Status, resp.Header.Get("Content-Type"))
+		}
+		if got := resp.ProtoMajor == 2; got != http2 {
+			t.Errorf("got %s, want HTTP/2 %v", resp.Proto, http2)
+		}
+
+		// The response is open, so the subscription is too; wait past the write timeout before the event
+		time.Sleep(3 * server.Config.WriteTimeout)
+		err = rt.(*_router).events.Publish(context.Background(), events.Event{Type: events.TypeFollow,
+			ActorID: f.alice.ID, ActorUsername: f.alice.Username, UserID: f.bob.ID})
+		if err != nil {
+			t.Fatalf("publishing: %v", err)
+		}
+		line, err := bufio.NewReader(resp.Body).ReadString('\n')
+		if err != nil || strings.TrimSpace(line) != "event: "+events.TypeFollow {
+			t.Errorf("%s: got %q (%v), want the follow event", resp.Proto, line, err)
+		}
+
+		_ = rt.Close()
+		_ = resp.Body.Close()
+		server.Close()
+		f.closeDatabase()
+	}
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// handleSetPrivacy makes the account of the current user private or public. Follows of private accounts need to be
+// approved, see handleApproveFollowRequest.
+func handleSetPrivacy(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Private *bool `json:"private"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Private == nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := ctx.Database.SetPrivate(r.Context(), ctx.User.ID, *req.Private); err != nil {
+		writeErrorFor(w, ctx, err, "Failed to update the privacy setting")
+		return
+	}
+	ctx.Logger.Infof("User %s set private to %t", ctx.User.Username, *req.Private)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetFollowRequests lists the users waiting for the current user to approve their follow.
+func handleGetFollowRequests(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	page, ok := parsePage(w, r, ctx)
+	if !ok {
+		return
+	}
+	users, next, err := ctx.Database.GetFollowRequests(r.Context(), ctx.User.ID, page)
+	writePage(w, ctx, users, next, err)
+}
+
+// handleApproveFollowRequest lets the user in the path follow the current user.
+func handleApproveFollowRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	requesterID := ps.ByName("userId")
+	err := ctx.Database.ApproveFollowRequest(r.Context(), ctx.User.ID, requesterID)
+	if errors.Is(err, database.ErrNotFound) {
+		writeError(w, ctx, http.StatusNotFound, "Follow request not found")
+		return
+	} else if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to approve the follow request")
+		return
+	}
+	ctx.Logger.Infof("User %s approved the follow request of %s", ctx.User.Username, requesterID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDenyFollowRequest removes the follow request of the user in the path.
+func handleDenyFollowRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	requesterID := ps.ByName("userId")
+	err := ctx.Database.DeleteFollowRequest(r.Context(), ctx.User.ID, requesterID)
+	if errors.Is(err, database.ErrNotFound) {
+		writeError(w, ctx, http.StatusNotFound, "Follow request not found")
+		return
+	} else if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to deny the follow request")
+		return
+	}
+	ctx.Logger.Infof("User %s denied the follow request of %s", ctx.User.Username, requesterID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,12 +1,16 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
 	"encoding/json"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/events"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/metrics"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -18,12 +22,19 @@ func HandleLikePhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 	ctx.Logger.Info("Liking photo", "userID", userID, "photoID", photoID)
 
 	// Call LikePhoto method of the database object
-	err := ctx.Database.LikePhoto(userID, photoID)
-	if err != nil {
-		ctx.Logger.Error("Error liking photo", "error", err)
-		http.Error(w, "Failed to like photo", http.StatusInternalServerError)
+	err := ctx.Database.LikePhoto(r.Context(), userID, photoID)
+	if errors.Is(err, database.ErrConflict) {
+		writeError(w, ctx, http.StatusConflict, "Photo already liked")
+		return
+	} else if err != nil {
+		writeErrorFor(w, ctx, err, "Error liking photo")
 		return
 	}
+	if err := ctx.Notifier.Liked(r.Context(), userID, photoID); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to update the notifications")
+	}
+	publishEvent(r, ctx, events.Event{Type: events.TypeLike, PhotoID: photoID})
+	metrics.Likes.Inc("photo")
 
 	// Successfully liked the photo
 	w.WriteHeader(http.StatusOK)
@@ -38,12 +49,14 @@ func HandleUnlikePhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 	ctx.Logger.Info("Unliking photo ", " userID ", userID, " photoID ", photoID)
 
 	// Call UnlikePhoto method of the database object
-	err := ctx.Database.UnlikePhoto(userID, photoID)
+	err := ctx.Database.UnlikePhoto(r.Context(), userID, photoID)
 	if err != nil {
-		ctx.Logger.Error("Error unliking photo", "error", err)
-		http.Error(w, "Failed to unlike photo", http.StatusInternalServerError)
+		writeErrorFor(w, ctx, err, "Error unliking photo")
 		return
 	}
+	if err := ctx.Notifier.Unliked(r.Context(), userID, photoID); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to update the notifications")
+	}
 
 	// Successfully unliked the photo
 	w.WriteHeader(http.StatusOK)
@@ -56,10 +69,9 @@ func HandleIsLiked(w http.ResponseWriter, r *http.Request, ps httprouter.Params,
 
 	ctx.Logger.Info("Checking if photo is liked", "userID", userID, "photoID", photoID)
 
-	liked, err := ctx.Database.IsLiked(userID, photoID)
+	liked, err := ctx.Database.IsLiked(r.Context(), userID, photoID)
 	if err != nil {
-		ctx.Logger.Error("Error checking if photo is liked", "error", err)
-		http.Error(w, "Failed to check if photo is liked", http.StatusInternalServerError)
+		writeErrorFor(w, ctx, err, "Error checking if photo is liked")
 		return
 	}
 
@@ -1,16 +1,19 @@
 package api
 
 import (
-	"github.com/julienschmidt/httprouter"
+	"encoding/json"
 	"net/http"
+
+	"github.com/julienschmidt/httprouter"
 )
 
-// liveness is an HTTP handler that checks the API server status. If the server cannot serve requests (e.g., some
-// resources are not ready), this should reply with HTTP Status 500. Otherwise, with HTTP Status 200
+// liveness is an HTTP handler that checks that the API server is running and able to answer. It doesn't check the
+// dependencies (see readiness): a restart would not fix them, so an unavailable database must not make the process
+// look dead.
 func (rt *_router) liveness(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	/* Example of liveness check:
-	if err := rt.DB.Ping(); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}*/
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(probeResponse{Status: probeOK}); err != nil {
+		rt.baseLogger.WithError(err).Error("Failed to write response")
+	}
 }
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// handleGetNotifications lists the notifications of the current user, newest first, along with the number of unread
+// ones.
+func handleGetNotifications(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	page, ok := parsePage(w, r, ctx)
+	if !ok {
+		return
+	}
+	notifications, next, err := ctx.Database.GetNotifications(r.Context(), ctx.User.ID, page)
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to get the notifications")
+		return
+	}
+	unread, err := ctx.Database.CountUnreadNotifications(r.Context(), ctx.User.ID)
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to count the unread notifications")
+		return
+	}
+
+	response := struct {
+		pageResponse
+		UnreadCount int `json:"unreadCount"`
+	}{
+		pageResponse: pageResponse{Items: notifications, Next: next},
+		UnreadCount:  unread,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		ctx.Logger.Errorf("Failed to write response: %v", err)
+	}
+}
+
+// handleSetNotificationRead marks a notification of the current user as read or unread.
+func handleSetNotificationRead(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	read, ok := parseReadFlag(w, r, ctx)
+	if !ok {
+		return
+	}
+	err := ctx.Database.SetNotificationRead(r.Context(), ctx.User.ID, ps.ByName("notificationId"), read, globaltime.Now().UTC())
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to update the notification")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSetAllNotificationsRead marks all the notifications of the current user as read or unread.
+func handleSetAllNotificationsRead(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	read, ok := parseReadFlag(w, r, ctx)
+	if !ok {
+		return
+	}
+	if err := ctx.Database.SetAllNotificationsRead(r.Context(), ctx.User.ID, read, globaltime.Now().UTC()); err != nil {
+		writeErrorFor(w, ctx, err, "Failed to update the notifications")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseReadFlag reads the {"read": true|false} request body. It replies with 400 and returns false if it is invalid.
+func parseReadFlag(w http.ResponseWriter, r *http.Request, ctx reqcontext.RequestContext) (bool, bool) {
+	var req struct {
+		Read *bool `json:"read"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Read == nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return false, false
+	}
+	defer r.Body.Close()
+	return *req.Read, true
+}
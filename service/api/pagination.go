@@ -0,0 +1,51 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+// pageResponse is the body of the replies of paginated lists.
+type pageResponse struct {
+	Items interface{} `json:"items"`
+
+	// Next is the cursor to pass to get the next page. It is omitted in the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// parsePage reads the "limit" and "cursor" query parameters. It replies with 400 and returns false if they are invalid.
+func parsePage(w http.ResponseWriter, r *http.Request, ctx reqcontext.RequestContext) (database.Page, bool) {
+	var page database.Page
+	query := r.URL.Query()
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			writeError(w, ctx, http.StatusBadRequest, "Invalid limit")
+			return page, false
+		}
+		page.Limit = limit
+	}
+	page.Cursor = query.Get("cursor")
+	return page, true
+}
+
+// writePage replies with the result of a paginated query: the page, or the error.
+func writePage(w http.ResponseWriter, ctx reqcontext.RequestContext, items interface{}, next string, err error) {
+	if errors.Is(err, database.ErrInvalidCursor) {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid cursor")
+		return
+	} else if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to get the list")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pageResponse{Items: items, Next: next}); err != nil {
+		ctx.Logger.Errorf("Failed to write response: %v", err)
+	}
+}
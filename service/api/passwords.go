@@ -0,0 +1,189 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/password"
+	"github.com/julienschmidt/httprouter"
+)
+
+// passwordResetTTL is how long a password reset token stays valid
+const passwordResetTTL = time.Hour
+
+// hashNewPassword validates and hashes a password chosen by the user. If it returns false, the error reply has
+// already been written.
+func hashNewPassword(w http.ResponseWriter, newPassword string, ctx reqcontext.RequestContext) (string, bool) {
+	if err := password.Validate(newPassword); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	hash, err := password.Hash(newPassword)
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to hash password")
+		return "", false
+	}
+	return hash, true
+}
+
+// handleChangePassword changes the password of the current user. All sessions are revoked and a new token is returned.
+func handleChangePassword(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if ctx.User.PasswordHash != "" {
+		ok, err := password.Verify(req.CurrentPassword, ctx.User.PasswordHash)
+		if err != nil {
+			writeErrorFor(w, ctx, err, "Failed to verify password")
+			return
+		}
+		if !ok {
+			writeError(w, ctx, http.StatusForbidden, "Current password is wrong")
+			return
+		}
+	}
+
+	hash, ok := hashNewPassword(w, req.NewPassword, ctx)
+	if !ok {
+		return
+	}
+	if !updatePassword(w, r, ctx.User.ID, hash, ctx) {
+		return
+	}
+
+	token, err := ctx.Sessions.Issue(r.Context(), ctx.User.ID)
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to issue session token")
+		return
+	}
+	ctx.Logger.Infof("Password changed by %s", ctx.User.Username)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(token); err != nil {
+		ctx.Logger.Errorf("Failed to write response: %v", err)
+	}
+}
+
+// handleRequestPasswordReset creates a one-time reset token for the given username. The reply is the same whether the
+// user exists or not, so that it can't be used to enumerate accounts.
+func handleRequestPasswordReset(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	defer r.Body.Close()
+
+	user, err := ctx.Database.GetUserByUsername(r.Context(), req.Name)
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Error retrieving user")
+		return
+	}
+	if user != nil {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			writeErrorFor(w, ctx, err, "Failed to generate reset token")
+			return
+		}
+		token := hex.EncodeToString(raw)
+		err = ctx.Database.AddPasswordReset(r.Context(), database.PasswordReset{
+			TokenHash: hashResetToken(token),
+			UserID:    user.ID,
+			ExpiresAt: globaltime.Now().UTC().Add(passwordResetTTL),
+		})
+		if err != nil {
+			writeErrorFor(w, ctx, err, "Failed to store reset token")
+			return
+		}
+
+		// The token is a secret: it goes only to the mailer, never to the log or to the reply
+		if err := ctx.Mailer.SendPasswordReset(r.Context(), *user, token); err != nil {
+			writeErrorFor(w, ctx, err, "Failed to send reset token")
+			return
+		}
+		ctx.Logger.WithField("user", user.Username).Info("Password reset requested")
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlePasswordResetsDisabled replaces the password reset routes when no mailer is configured: a reset token that
+// can't be delivered is of no use.
+func handlePasswordResetsDisabled(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	writeError(w, ctx, http.StatusNotImplemented, "Password resets are not available on this server")
+}
+
+// handleResetPassword sets a new password using a reset token. All sessions of the user are revoked.
+func handleResetPassword(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := password.Validate(req.NewPassword); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, err := ctx.Database.ConsumePasswordReset(r.Context(), hashResetToken(req.Token))
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to consume reset token")
+		return
+	}
+	if userID == "" {
+		writeError(w, ctx, http.StatusForbidden, "Invalid or expired reset token")
+		return
+	}
+
+	hash, ok := hashNewPassword(w, req.NewPassword, ctx)
+	if !ok {
+		return
+	}
+	if !updatePassword(w, r, userID, hash, ctx) {
+		return
+	}
+	ctx.Logger.Infof("Password reset for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updatePassword stores the new hash and revokes all sessions of the user, in one transaction: the old sessions never
+// outlive a password change. If it returns false, the error reply has already been written.
+func updatePassword(w http.ResponseWriter, r *http.Request, userID, hash string,
+	ctx reqcontext.RequestContext) bool {
+	err := ctx.Database.WithTx(r.Context(), func(tx database.Tx) error {
+		if err := tx.SetPasswordHash(r.Context(), userID, hash); err != nil {
+			return err
+		}
+		return tx.RevokeUserSessions(r.Context(), userID)
+	})
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to update password")
+		return false
+	}
+	return true
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,190 +1,299 @@
 package api
 
 import (
+	"errors"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"encoding/json"
 
-	"encoding/base64"
-
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/events"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/imaging"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/metrics"
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
 )
 
-type Comment struct {
-	ID        string    `json:"commentId" db:"comment_id"` // Unique identifier
-	UserID    string    `json:"userId" db:"user_id"`       // ID of the user who commented
-	PhotoID   string    `json:"photoId" db:"photo_id"`     // ID of the photo being commented on
-	Content   string    `json:"content" db:"content"`      // The comment itself
-	Timestamp time.Time `json:"timestamp" db:"timestamp"`  // Timestamp of when the comment was made
-}
-type PhotoDetail struct {
-	PhotoID    string    `json:"photoId"`
-	UserID     string    `json:"userId"`
-	Username   string    `json:"username"`
-	ImageData  []byte    `json:"imageData"`
-	Timestamp  time.Time `json:"timestamp"`
-	LikesCount int       `json:"likesCount"`
-	Comments   []Comment `json:"comments"`
-}
+// maxCaptionLength is the maximum number of characters in the caption of a photo.
+const maxCaptionLength = 2200
 
 func handleUploadPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Extract username from context
-	if ctx.User == nil {
-		w.WriteHeader(http.StatusUnauthorized) // Sets the status code only
-		return
-	}
 	userId := ctx.User.ID
 	ctx.Logger.Info("Called successfully")
 	// Read image data from the request body
 	// Parse the multipart form
 	err := r.ParseMultipartForm(10 << 20) // For example, max 10 MB file size
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest) // Sets the status code only
+		writeError(w, ctx, http.StatusBadRequest, "Invalid multipart form")
 		return
 	}
 
-	// Retrieve the file from form data
-	file, _, err := r.FormFile("image") // "image" should be the name of your file input field
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest) // Sets the status code only
+	caption, ok := parseCaption(r.FormValue("caption"))
+	if !ok {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid caption")
 		return
 	}
-	defer file.Close()
 
-	// Read the file data
-	ImageData, err := ioutil.ReadAll(file)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest) // Sets the status code only
+	// Retrieve the files from form data: each "image" part is an image of the photo, in order
+	files := r.MultipartForm.File["image"]
+	if len(files) == 0 {
+		writeError(w, ctx, http.StatusBadRequest, "The image field is required")
+		return
+	}
+	if len(files) > database.MaxPhotoImages {
+		writeError(w, ctx, http.StatusBadRequest, "Too many images: at most "+strconv.Itoa(database.MaxPhotoImages)+" per photo")
 		return
 	}
 	defer r.Body.Close()
 
-	ctx.Logger.Info("Received image data length: ", len(ImageData))
+	// Validate all the images before storing any of them, so that a photo is added with all its images or not at all
+	images := make([]*imaging.Image, 0, len(files))
+	for _, header := range files {
+		img, err := readImage(header)
+		if errors.Is(err, imaging.ErrUnsupportedFormat) {
+			writeError(w, ctx, http.StatusUnsupportedMediaType, "Unsupported image format: use JPEG, PNG, GIF or WebP")
+			return
+		} else if errors.Is(err, imaging.ErrInvalidImage) {
+			ctx.Logger.WithError(err).Info("Rejected an invalid image")
+			writeError(w, ctx, http.StatusBadRequest, "Invalid image")
+			return
+		} else if err != nil {
+			writeErrorFor(w, ctx, err, "Failed to process the image")
+			return
+		}
+		images = append(images, img)
+	}
+
 	// Set current time as Timestamp
-	Timestamp := time.Now()
+	Timestamp := globaltime.Now().UTC()
 
 	// Create a Photo struct
 	photo := database.Photo{
 		ID:        uuid.Must(uuid.NewV4()).String(),
 		UserID:    userId,
-		ImageData: ImageData,
+		Caption:   caption,
 		Timestamp: Timestamp,
 		Likes:     []database.Like{},
 		Comments:  []database.Comment{},
 	}
+
+	// Store the image files in the blob store, the database only keeps the keys. No image can be released until the
+	// photo references it, see imagesLock
+	imagesLock.RLock()
+	for _, img := range images {
+		imageKey, err := storeImage(img, ctx)
+		if err != nil {
+			imagesLock.RUnlock()
+			releaseImages(r, photo.Images, ctx)
+			writeErrorFor(w, ctx, err, "Failed to store the image")
+			return
+		}
+		photo.Images = append(photo.Images, database.Image{ImageKey: imageKey, ImageType: img.ContentType})
+	}
 	ctx.Logger.Info("Photo created " + photo.Timestamp.String())
 	// Call AddPhoto method to insert the photo into the database
-	err = ctx.Database.AddPhoto(photo)
+	mentioned, err := ctx.Database.AddPhoto(r.Context(), photo)
+	imagesLock.RUnlock()
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to add photo to the database")
-		ctx.Logger.Info("Failed to add photo to the database")
-		w.WriteHeader(http.StatusInternalServerError) // Sets the status code only
+		releaseImages(r, photo.Images, ctx)
+		writeErrorFor(w, ctx, err, "Failed to add photo to the database")
 		return
 	}
 	ctx.Logger.Info("Photo added to the database")
+	if err := ctx.Notifier.Mentioned(r.Context(), userId, photo.ID, "", mentioned); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to update the notifications")
+	}
+	publishEvent(r, ctx, events.Event{Type: events.TypePhoto, PhotoID: photo.ID})
+	metrics.PhotosUploaded.Inc()
+	metrics.ImagesUploaded.Add(float64(len(photo.Images)))
 	// Respond with success message
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusCreated)
-	_, err = w.Write([]byte("Photo uploaded successfully"))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError) // Sets the status code only
-		return
+	if _, err := w.Write([]byte("Photo uploaded successfully")); err != nil {
+		ctx.Logger.Errorf("Failed to write response: %v", err)
 	}
 }
 
 func handleGetPhotos(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Retrieve all photos from the database
-	photos, err := ctx.Database.GetPhotos()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError) // Sets the status code only
-		return
-	}
-	// Respond with the list of photos
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(w).Encode(photos)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError) // Sets the status code only
+	page, ok := parsePage(w, r, ctx)
+	if !ok {
 		return
 	}
+	// Retrieve a page of photos from the database
+	photos, next, err := ctx.Database.GetPhotos(r.Context(), ctx.User.ID, page)
+	writePage(w, ctx, photos, next, err)
 }
 
 func handleGetMyStream(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	if ctx.User == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	page, ok := parsePage(w, r, ctx)
+	if !ok {
 		return
 	}
+	entries, next, err := ctx.Database.GetMyStream(r.Context(), ctx.User.ID, page)
+	ctx.Logger.Info("My stream fetched")
 
-	photos, err := ctx.Database.GetMyStream(ctx.User.ID)
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	// Add the URLs of the images, so that clients can display each entry without further requests
+	type streamEntry struct {
+		database.StreamEntry
+		ImageURL     string       `json:"imageUrl"`
+		ThumbnailURL string       `json:"thumbnailUrl"`
+		Images       []photoImage `json:"images"`
 	}
-	ctx.Logger.Info("My stream fetched")
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(photos); err != nil {
-		ctx.Logger.Errorf("Failed to write response: %v", err)
+	items := make([]streamEntry, 0, len(entries))
+	for _, entry := range entries {
+		items = append(items, streamEntry{
+			StreamEntry:  entry,
+			ImageURL:     photoImageURL(entry.PhotoID, 0),
+			ThumbnailURL: photoThumbnailURL(entry.PhotoID, 0, cardThumbnailSize),
+			Images:       photoImages(entry.PhotoID, entry.ImagesCount),
+		})
+	}
+	writePage(w, ctx, items, next, err)
+}
+
+func handleGetUserPhotos(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	page, ok := parsePage(w, r, ctx)
+	if !ok {
+		return
 	}
+	photos, next, err := ctx.Database.GetUserPhotos(r.Context(), ps.ByName("userId"), ctx.User.ID, page)
+	writePage(w, ctx, photos, next, err)
 }
 
 func handleDeletePhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	photoID := ps.ByName("photoId")
 	if photoID == "" {
-		http.Error(w, "Invalid photo ID", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid photo ID")
 		return
 	}
 
-	err := ctx.Database.DeletePhoto(photoID)
+	metadata, err := ctx.Database.GetPhotoMetadata(r.Context(), photoID)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeErrorFor(w, ctx, err, "Failed to get the photo")
+		return
+	}
+	if metadata == nil {
+		writeError(w, ctx, http.StatusNotFound, "Not found")
+		return
+	}
+
+	err = ctx.Database.DeletePhoto(r.Context(), photoID)
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to delete the photo")
 		return
 	}
 	ctx.Logger.Infof("Photo %s deleted by %s", photoID, ctx.User.Username)
+	releaseImages(r, metadata.Images, ctx)
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write([]byte("Photo deleted successfully")); err != nil {
 		ctx.Logger.Errorf("Failed to write response: %v", err)
 	}
 }
 
+// handleUpdatePhoto applies the settings in the body: the caption of the photo (and so its hashtags), and whether it
+// accepts new comments. Settings missing from the body are left as they are.
+func handleUpdatePhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Caption         *string `json:"caption"`
+		CommentsEnabled *bool   `json:"commentsEnabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Caption == nil && req.CommentsEnabled == nil) {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	defer r.Body.Close()
+	photoID := ps.ByName("photoId")
+
+	if req.Caption != nil {
+		caption, ok := parseCaption(*req.Caption)
+		if !ok {
+			writeError(w, ctx, http.StatusBadRequest, "Invalid caption")
+			return
+		}
+		mentioned, err := ctx.Database.SetCaption(r.Context(), photoID, caption)
+		if err != nil {
+			writeErrorFor(w, ctx, err, "Failed to update the caption")
+			return
+		}
+		ctx.Logger.Infof("Caption of photo %s updated by %s", photoID, ctx.User.Username)
+		// Users already mentioned before the edit were notified then
+		if err := ctx.Notifier.Mentioned(r.Context(), ctx.User.ID, photoID, "", mentioned); err != nil {
+			ctx.Logger.WithError(err).Error("Failed to update the notifications")
+		}
+	}
+	if req.CommentsEnabled != nil {
+		if err := ctx.Database.SetCommentsEnabled(r.Context(), photoID, *req.CommentsEnabled); err != nil {
+			writeErrorFor(w, ctx, err, "Failed to update the comments setting")
+			return
+		}
+		ctx.Logger.Infof("Comments of photo %s enabled: %t", photoID, *req.CommentsEnabled)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseCaption trims the caption of a photo. It returns false if the caption is too long or not valid UTF-8; an empty
+// caption is allowed.
+func parseCaption(caption string) (string, bool) {
+	caption = strings.TrimSpace(caption)
+	if !utf8.ValidString(caption) || utf8.RuneCountInString(caption) > maxCaptionLength {
+		return "", false
+	}
+	return caption, true
+}
+
 func handleGetPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	photoID := ps.ByName("photoId")
 	if photoID == "" {
-		http.Error(w, "Invalid photo ID", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid photo ID")
 		return
 	}
 	ctx.Logger.Info("Fetching photo ", photoID)
 
-	photo, err := ctx.Database.GetPhoto(photoID, ctx.User.ID) // Pass the current user ID to filter banned users
+	photo, err := ctx.Database.GetPhoto(r.Context(), photoID, ctx.User.ID) // Pass the current user ID to filter banned users
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeErrorFor(w, ctx, err, "Failed to get the photo")
 		return
 	}
 
-	// Convert image data to base64 for JSON compatibility.
-	imageData := base64.StdEncoding.EncodeToString(photo.ImageData)
-
 	// Construct the full response including comments
 	response := struct {
-		PhotoID    string             `json:"photoId"`
-		UserID     string             `json:"userId"`
-		Username   string             `json:"username"`
-		Timestamp  string             `json:"timestamp"`
-		ImageData  string             `json:"imageData"`
-		LikesCount int                `json:"likesCount"`
-		Comments   []database.Comment `json:"comments"`
+		PhotoID         string             `json:"photoId"`
+		UserID          string             `json:"userId"`
+		Username        string             `json:"username"`
+		Caption         string             `json:"caption"`
+		Mentions        []database.Mention `json:"mentions"`
+		Timestamp       string             `json:"timestamp"`
+		CommentsEnabled bool               `json:"commentsEnabled"`
+		ImageURL        string             `json:"imageUrl"`
+		ThumbnailURL    string             `json:"thumbnailUrl"`
+		Images          []photoImage       `json:"images"`
+		LikesCount      int                `json:"likesCount"`
+		Comments        []database.Comment `json:"comments"`
+		CommentsNext    string             `json:"commentsNext,omitempty"`
 	}{
-		PhotoID:    photo.PhotoID,
-		UserID:     photo.UserID,
-		Username:   photo.Username,
-		Timestamp:  photo.Timestamp.Format(time.RFC3339),
-		ImageData:  imageData,
-		LikesCount: photo.LikesCount,
-		Comments:   photo.Comments,
+		PhotoID:         photo.PhotoID,
+		UserID:          photo.UserID,
+		Username:        photo.Username,
+		Caption:         photo.Caption,
+		Mentions:        photo.Mentions,
+		Timestamp:       photo.Timestamp.Format(time.RFC3339),
+		CommentsEnabled: photo.CommentsEnabled,
+		ImageURL:        photoImageURL(photo.PhotoID, 0),
+		ThumbnailURL:    photoThumbnailURL(photo.PhotoID, 0, cardThumbnailSize),
+		Images:          photoImages(photo.PhotoID, photo.ImagesCount),
+		LikesCount:      photo.LikesCount,
+		Comments:        photo.Comments,
+		CommentsNext:    photo.CommentsNext,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -192,3 +301,184 @@ func handleGetPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 		ctx.Logger.Errorf("Failed to write response: %v", err)
 	}
 }
+
+// handleGetPhotoImage streams an image file of a photo, or one of its thumbnails if the "size" query parameter is
+// set. The image is the one at the "position" parameter, or the cover if the route has none. The content key doubles as
+// a strong ETag, and the upload time is the Last-Modified date: http.ServeContent uses them to answer conditional and
+// Range requests.
+func handleGetPhotoImage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	position := 0
+	if value := ps.ByName("position"); value != "" {
+		var err error
+		position, err = strconv.Atoi(value)
+		if err != nil || position < 0 {
+			writeError(w, ctx, http.StatusBadRequest, "Invalid image position")
+			return
+		}
+	}
+
+	size := 0
+	if value := r.URL.Query().Get("size"); value != "" {
+		size, _ = strconv.Atoi(value)
+		if !isThumbnailSize(size) {
+			writeError(w, ctx, http.StatusBadRequest, "Invalid thumbnail size")
+			return
+		}
+	}
+
+	photo, err := ctx.Database.GetPhotoMetadata(r.Context(), ps.ByName("photoId"))
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to get the photo")
+		return
+	}
+	if photo == nil || position >= len(photo.Images) {
+		writeError(w, ctx, http.StatusNotFound, "Not found")
+		return
+	}
+	stored := photo.Images[position]
+
+	key, contentType := stored.ImageKey, stored.ImageType
+	if size > 0 {
+		key, contentType = thumbnailKey(stored.ImageKey, size), "image/jpeg"
+	}
+	image, err := ctx.Blobs.Open(key)
+	if size > 0 && errors.Is(err, blobstore.ErrNotFound) {
+		// Images smaller than the requested size (or uploaded by older versions) have no thumbnail: send the original
+		key, contentType = stored.ImageKey, stored.ImageType
+		image, err = ctx.Blobs.Open(key)
+	}
+	if errors.Is(err, blobstore.ErrNotFound) {
+		ctx.Logger.Errorf("Image %s of photo %s is missing from the blob store", stored.ImageKey, photo.ID)
+		writeError(w, ctx, http.StatusNotFound, "Not found")
+		return
+	} else if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to open the photo image")
+		return
+	}
+	defer image.Close()
+
+	// Without a stored type (photos uploaded by older versions), ServeContent sniffs it from the content
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("ETag", `"`+key+`"`)
+	// The image never changes, but the access depends on bans: let the client cache it, but revalidate every time
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, "", photo.Timestamp, image)
+}
+
+// photoImageURL returns the path of the endpoint serving the image of the photo at the given position.
+func photoImageURL(photoID string, position int) string {
+	return "/photos/" + photoID + "/images/" + strconv.Itoa(position)
+}
+
+// cardThumbnailSize is the thumbnail suggested to clients for photo cards (e.g., in the stream and in profiles).
+const cardThumbnailSize = 640
+
+// photoThumbnailURL returns the path of the endpoint serving a thumbnail of the image of the photo at the given
+// position.
+func photoThumbnailURL(photoID string, position int, size int) string {
+	return photoImageURL(photoID, position) + "?size=" + strconv.Itoa(size)
+}
+
+// photoImage holds the URLs of an image of a photo.
+type photoImage struct {
+	ImageURL     string `json:"imageUrl"`
+	ThumbnailURL string `json:"thumbnailUrl"`
+}
+
+// photoImages returns the URLs of the images of the photo, in order.
+func photoImages(photoID string, count int) []photoImage {
+	images := make([]photoImage, 0, count)
+	for position := 0; position < count; position++ {
+		images = append(images, photoImage{
+			ImageURL:     photoImageURL(photoID, position),
+			ThumbnailURL: photoThumbnailURL(photoID, position, cardThumbnailSize),
+		})
+	}
+	return images
+}
+
+// readImage reads an uploaded image, validates it, removes its metadata and generates its thumbnails.
+func readImage(header *multipart.FileHeader) (*imaging.Image, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return imaging.Process(data)
+}
+
+// imagesLock orders the uploads and the releases of the images in this process. Identical uploads share the same
+// content key, so a release must not delete an image between the moment an upload stores it and the moment its photo
+// references it: uploads hold the lock for reading until the photo is added, releases hold it for writing.
+var imagesLock sync.RWMutex
+
+// storeImage saves the image and its thumbnails in the blob store, and returns the key of the image.
+func storeImage(img *imaging.Image, ctx reqcontext.RequestContext) (string, error) {
+	imageKey := blobstore.Key(img.Data)
+	if err := ctx.Blobs.Put(imageKey, img.Data); err != nil {
+		return "", err
+	}
+	for size, data := range img.Thumbnails {
+		if err := ctx.Blobs.Put(thumbnailKey(imageKey, size), data); err != nil {
+			return "", err
+		}
+	}
+	return imageKey, nil
+}
+
+// releaseImages releases each of the images, see releaseImage.
+func releaseImages(r *http.Request, images []database.Image, ctx reqcontext.RequestContext) {
+	for _, image := range images {
+		releaseImage(r, image.ImageKey, ctx)
+	}
+}
+
+// releaseImage deletes the image and its thumbnails from the blob store if no photo references them anymore. Failures
+// only leave orphaned blobs behind, so they are logged and not reported to the client.
+func releaseImage(r *http.Request, imageKey string, ctx reqcontext.RequestContext) {
+	if imageKey == "" {
+		return
+	}
+	imagesLock.Lock()
+	defer imagesLock.Unlock()
+	used, err := ctx.Database.IsImageKeyUsed(r.Context(), imageKey)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to check the image usage")
+		return
+	}
+	if used {
+		return
+	}
+	for _, size := range imaging.ThumbnailSizes {
+		if err := ctx.Blobs.Delete(thumbnailKey(imageKey, size)); err != nil {
+			ctx.Logger.WithError(err).Error("Failed to delete the thumbnail")
+		}
+	}
+	if err := ctx.Blobs.Delete(imageKey); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to delete the image")
+	}
+}
+
+// thumbnailKey returns the blob store key of the thumbnail of the given size. Size 0 is the original image.
+func thumbnailKey(imageKey string, size int) string {
+	if size == 0 {
+		return imageKey
+	}
+	return imageKey + "-" + strconv.Itoa(size)
+}
+
+func isThumbnailSize(size int) bool {
+	for _, s := range imaging.ThumbnailSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Status of a probe or of one of its checks.
+const (
+	probeOK   = "ok"
+	probeFail = "fail"
+)
+
+// probeResponse is the body of the liveness and readiness replies. Probes may be reachable from outside, so the reply
+// only tells which checks failed: the reasons are logged.
+type probeResponse struct {
+	// Status is "ok" if all the checks passed, "fail" otherwise
+	Status string `json:"status"`
+
+	// Checks holds the status of each check, by name (readiness only)
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// readiness is an HTTP handler that checks whether the server can handle requests: the database answers and is at the
+// latest schema version, the blob store is reachable, and there is enough free disk space. It replies with HTTP
+// Status 200 if all the checks pass, with HTTP Status 503 otherwise; the body has the status of each check.
+func (rt *_router) readiness(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	checks := map[string]error{
+		"database":   rt.db.Ping(r.Context()),
+		"migrations": rt.checkMigrations(r.Context()),
+		"blobs":      rt.blobs.Ping(),
+		"disk":       rt.checkDisk(),
+	}
+	response := probeResponse{Status: probeOK, Checks: make(map[string]string, len(checks))}
+	status := http.StatusOK
+	for name, err := range checks {
+		response.Checks[name] = probeOK
+		if err != nil {
+			rt.baseLogger.WithError(err).Warnf("readiness check %s failed", name)
+			response.Checks[name] = probeFail
+			response.Status = probeFail
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		rt.baseLogger.WithError(err).Error("Failed to write response")
+	}
+}
+
+// checkMigrations checks that the database schema is at the version expected by this executable.
+func (rt *_router) checkMigrations(ctx context.Context) error {
+	current, latest, err := rt.db.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if current != latest {
+		return fmt.Errorf("the schema is at version %d, expected %d", current, latest)
+	}
+	return nil
+}
+
+// checkDisk checks that each of the data directories has at least rt.minFreeDisk bytes available.
+func (rt *_router) checkDisk() error {
+	var failures []string
+	for _, path := range rt.diskPaths {
+		free, err := freeDiskSpace(path)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		if free < rt.minFreeDisk {
+			failures = append(failures, fmt.Sprintf("%s has %d MiB free, less than %d MiB", path, free>>20,
+				rt.minFreeDisk>>20))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestReadinessReply checks that a failed check is reported by name only: the reason, here the data directory, is not
+// sent to the client.
+func TestReadinessReply(t *testing.T) {
+	f := newFixture(t)
+	defer f.closeDatabase()
+	rt, _ := f.newRouter(t)
+	dir := t.TempDir()
+	rt.(*_router).diskPaths = []string{dir}
+	rt.(*_router).minFreeDisk = math.MaxUint64
+
+	w := httptest.NewRecorder()
+	rt.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readiness", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if strings.Contains(w.Body.String(), dir) {
+		t.Errorf("the reply reveals the data directory: %s", w.Body)
+	}
+	var reply probeResponse
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatalf("decoding the reply: %v", err)
+	}
+	want := probeResponse{Status: probeFail, Checks: map[string]string{
+		"database": probeOK, "migrations": probeOK, "blobs": probeOK, "disk": probeFail,
+	}}
+	if !reflect.DeepEqual(reply, want) {
+		t.Errorf("got %+v, want %+v", reply, want)
+	}
+}
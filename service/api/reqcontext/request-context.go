@@ -7,7 +7,12 @@ Each value here should be assumed valid only per request only, with some excepti
 package reqcontext
 
 import (
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/events"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/mailer"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/notifications"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/session"
 	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
 )
@@ -20,6 +25,19 @@ type RequestContext struct {
 	Database database.AppDatabase
 	// Logger is a custom field logger for the request
 	Logger logrus.FieldLogger
+	// Sessions is the session manager used to issue and revoke tokens
+	Sessions *session.Manager
+	// Blobs is the store where image files are saved
+	Blobs blobstore.BlobStore
+	// Notifier records the events that concern other users
+	Notifier *notifications.Notifier
+	// Mailer delivers the password reset tokens. It is nil if password resets are disabled
+	Mailer mailer.Mailer
+	// Events delivers the changes to the connected users
+	Events *events.Hub
 
+	// User is the authenticated user, or nil for anonymous requests
 	User *database.User
+	// Session is the session the request was authenticated with, or nil for anonymous requests
+	Session *database.Session
 }
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxSearchQueryLength is the maximum number of characters in a search query.
+const maxSearchQueryLength = 100
+
+// handleSearchUsers lists the users whose username matches the "q" query parameter, best matches first.
+func handleSearchUsers(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	query, ok := parseSearchQuery(w, r, ctx)
+	if !ok {
+		return
+	}
+	page, ok := parsePage(w, r, ctx)
+	if !ok {
+		return
+	}
+	users, next, err := ctx.Database.SearchUsers(r.Context(), query, ctx.User.ID, page)
+	writePage(w, ctx, users, next, err)
+}
+
+// handleSearchPhotos lists the photos whose caption matches the "q" query parameter, best matches first.
+func handleSearchPhotos(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	query, ok := parseSearchQuery(w, r, ctx)
+	if !ok {
+		return
+	}
+	page, ok := parsePage(w, r, ctx)
+	if !ok {
+		return
+	}
+	photos, next, err := ctx.Database.SearchPhotos(r.Context(), query, ctx.User.ID, page)
+	writePage(w, ctx, photos, next, err)
+}
+
+// parseSearchQuery reads the "q" query parameter. It replies with 400 and returns false if it is empty or too long.
+func parseSearchQuery(w http.ResponseWriter, r *http.Request, ctx reqcontext.RequestContext) (string, bool) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" || utf8.RuneCountInString(query) > maxSearchQueryLength {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid search query")
+		return "", false
+	}
+	return query, true
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"github.com/julienschmidt/httprouter"
+)
+
+// handleRefreshSession exchanges the current token for a new one with a fresh expiry.
+func handleRefreshSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	token, err := ctx.Sessions.Refresh(r.Context(), ctx.Session)
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to refresh session")
+		return
+	}
+
+	ctx.Logger.Infof("Session refreshed for %s", ctx.User.Username)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(token); err != nil {
+		ctx.Logger.Errorf("Failed to write response: %v", err)
+	}
+}
+
+// handleLogout revokes the session used by the current request.
+func handleLogout(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if err := ctx.Sessions.Revoke(r.Context(), ctx.Session.ID); err != nil {
+		writeErrorFor(w, ctx, err, "Failed to revoke session")
+		return
+	}
+	ctx.Logger.Infof("User %s logged out", ctx.User.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleLogoutAll revokes every session of the current user ("log out all devices").
+func handleLogoutAll(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if err := ctx.Sessions.RevokeAll(r.Context(), ctx.User.ID); err != nil {
+		writeErrorFor(w, ctx, err, "Failed to revoke sessions")
+		return
+	}
+	ctx.Logger.Infof("User %s logged out from all devices", ctx.User.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,5 +2,6 @@ package api
 
 // Close should close everything opened in the lifecycle of the `_router`; for example, background goroutines.
 func (rt *_router) Close() error {
-	return nil
+	// Disconnect the event streams, so that the HTTP server doesn't wait for them to finish
+	return rt.events.Close()
 }
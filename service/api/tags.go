@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// defaultTrendingTags is the number of trending tags returned when the request has no limit.
+const defaultTrendingTags = 10
+
+// handleGetTagPhotos lists the photos tagged with the tag in the path, newest first.
+func handleGetTagPhotos(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	tag, ok := database.NormalizeTag(ps.ByName("tag"))
+	if !ok {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid tag")
+		return
+	}
+	page, ok := parsePage(w, r, ctx)
+	if !ok {
+		return
+	}
+	photos, next, err := ctx.Database.GetTagPhotos(r.Context(), tag, ctx.User.ID, page)
+	writePage(w, ctx, photos, next, err)
+}
+
+// handleGetTrendingTags lists the tags used by the most photos uploaded in the trending window (see
+// Config.TrendingWindow). Limits above database.MaxPageSize are lowered to it, as for pages.
+func (rt *_router) handleGetTrendingTags(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	limit := defaultTrendingTags
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			writeError(w, ctx, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		if limit > database.MaxPageSize {
+			limit = database.MaxPageSize
+		}
+	}
+
+	tags, err := ctx.Database.GetTrendingTags(r.Context(), globaltime.Now().UTC().Add(-rt.trendingWindow), ctx.User.ID, limit)
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to get the trending tags")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pageResponse{Items: tags}); err != nil {
+		ctx.Logger.Errorf("Failed to write response: %v", err)
+	}
+}
@@ -2,33 +2,47 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
-	"strings"
-
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/events"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/password"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/session"
 	"github.com/julienschmidt/httprouter"
 )
 
 func HandleAddUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	var user database.User
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
 	db := ctx.Database
 
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 	defer r.Body.Close()
+	if req.Username == "" {
+		writeError(w, ctx, http.StatusBadRequest, "Username must be provided")
+		return
+	}
+
+	hash, ok := hashNewPassword(w, req.Password, ctx)
+	if !ok {
+		return
+	}
+	user := database.User{Username: req.Username, PasswordHash: hash}
 
 	ctx.Logger.Info("Adding user to the database")
-	err := db.AddUser(&user)
-	if err != nil {
-		if strings.Contains(err.Error(), "username already exists") {
-			http.Error(w, "Username already exists", http.StatusConflict) // Use HTTP 409 Conflict for username conflicts
-			return
-		}
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	err := db.AddUser(r.Context(), &user)
+	if errors.Is(err, database.ErrConflict) {
+		writeError(w, ctx, http.StatusConflict, "Username already exists")
+		return
+	} else if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to add the user")
 		return
 	}
 
@@ -47,11 +61,11 @@ func HandleSetUsername(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 	}
 	err := json.NewDecoder(r.Body).Decode(&reqBody)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 	if reqBody.NewUsername == "" {
-		http.Error(w, "New username must be provided", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "New username must be provided")
 		return
 	}
 
@@ -60,14 +74,12 @@ func HandleSetUsername(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 	currentUserID := ctx.User.ID // Ensure that ctx.User is populated correctly in the middleware
 
 	ctx.Logger.Info("Setting new username for user ID: ", currentUserID)
-	err = ctx.Database.SetUsername(currentUserID, reqBody.NewUsername)
-	if err != nil {
-		if err.Error() == "username already taken" {
-			http.Error(w, "Username already taken", http.StatusConflict)
-		} else {
-			ctx.Logger.Error("Failed to update username: ", err)
-			http.Error(w, "Failed to update username", http.StatusInternalServerError)
-		}
+	err = ctx.Database.SetUsername(r.Context(), currentUserID, reqBody.NewUsername)
+	if errors.Is(err, database.ErrConflict) {
+		writeError(w, ctx, http.StatusConflict, "Username already taken")
+		return
+	} else if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to update username")
 		return
 	}
 
@@ -82,10 +94,12 @@ func HandleGetUserProfile(w http.ResponseWriter, r *http.Request, ps httprouter.
 	username := ps.ByName("username")
 
 	ctx.Logger.Info("Retrieving user profile for username: ", username)
-	user, err := ctx.Database.GetUserProfile(username)
-	if err != nil {
-		ctx.Logger.Error("User not found: ", err)
-		http.Error(w, "User not found", http.StatusNotFound)
+	user, err := ctx.Database.GetUserProfile(r.Context(), username)
+	if errors.Is(err, database.ErrNotFound) {
+		writeError(w, ctx, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to get the user profile")
 		return
 	}
 
@@ -100,10 +114,12 @@ func HandleGetUserProfileID(w http.ResponseWriter, r *http.Request, ps httproute
 	userID := ps.ByName("userId")
 
 	ctx.Logger.Info("Retrieving user profile for userID: ", userID)
-	user, err := ctx.Database.GetUserProfileByID(userID)
-	if err != nil {
-		ctx.Logger.Error("User not found: ", err)
-		http.Error(w, "User not found", http.StatusNotFound)
+	user, err := ctx.Database.GetUserProfileByID(r.Context(), userID, ctx.User.ID)
+	if errors.Is(err, database.ErrNotFound) {
+		writeError(w, ctx, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to get the user profile")
 		return
 	}
 
@@ -116,51 +132,90 @@ func HandleGetUserProfileID(w http.ResponseWriter, r *http.Request, ps httproute
 
 func doLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	var req struct {
-		Name string `json:"name"`
+		Name     string `json:"name"`
+		Password string `json:"password"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 	defer r.Body.Close()
+	if req.Name == "" || req.Password == "" {
+		writeError(w, ctx, http.StatusBadRequest, "Name and password must be provided")
+		return
+	}
 
 	// Check if user exists
-	user, err := ctx.Database.GetUserByUsername(req.Name)
+	user, err := ctx.Database.GetUserByUsername(r.Context(), req.Name)
 	if err != nil {
-		ctx.Logger.Error("Error retrieving user: ", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeErrorFor(w, ctx, err, "Error retrieving user")
 		return
 	}
 
-	if user == nil {
+	status := http.StatusOK
+	switch {
+	case user == nil:
 		// User does not exist, create new one
-		user = &database.User{Username: req.Name}
-		err = ctx.Database.AddUser(user) // Directly call AddUser now
+		hash, ok := hashNewPassword(w, req.Password, ctx)
+		if !ok {
+			return
+		}
+		user = &database.User{Username: req.Name, PasswordHash: hash}
+		err = ctx.Database.AddUser(r.Context(), user) // Directly call AddUser now
+		if errors.Is(err, database.ErrConflict) {
+			writeError(w, ctx, http.StatusConflict, "Username already exists")
+			return
+		} else if err != nil {
+			writeErrorFor(w, ctx, err, "Failed to create user")
+			return
+		}
+		status = http.StatusCreated
+	case user.PasswordHash == "":
+		// Accounts created before passwords existed have no credential: the first login sets it
+		hash, ok := hashNewPassword(w, req.Password, ctx)
+		if !ok {
+			return
+		}
+		err := ctx.Database.SetFirstPasswordHash(r.Context(), user.ID, hash)
+		if errors.Is(err, database.ErrConflict) {
+			// A concurrent first login set another password
+			writeError(w, ctx, http.StatusUnauthorized, "Invalid username or password")
+			return
+		} else if err != nil {
+			writeErrorFor(w, ctx, err, "Failed to set password")
+			return
+		}
+		ctx.Logger.Infof("Password set on first login for %s", user.Username)
+	default:
+		ok, err := password.Verify(req.Password, user.PasswordHash)
 		if err != nil {
-			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-				http.Error(w, "Username already exists", http.StatusConflict)
-				return
-			}
-			ctx.Logger.Error("Failed to create user: ", err)
-			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			writeErrorFor(w, ctx, err, "Failed to verify password")
+			return
+		}
+		if !ok {
+			writeError(w, ctx, http.StatusUnauthorized, "Invalid username or password")
 			return
 		}
-		w.WriteHeader(http.StatusCreated)
-	} else {
-		w.WriteHeader(http.StatusOK)
 	}
 
-	// Return the userId as a token
+	// Start a new session for the user
+	token, err := ctx.Sessions.Issue(r.Context(), user.ID)
+	if err != nil {
+		writeErrorFor(w, ctx, err, "Failed to issue session token")
+		return
+	}
 	response := struct {
-		Token string `json:"token"`
+		session.Token
+		UserID string `json:"userId"`
 	}{
-		Token: user.ID, // Use userId as the token directly
+		Token:  token,
+		UserID: user.ID,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		ctx.Logger.Error("Error encoding response: ", err)
-		http.Error(w, "Error encoding response", http.StatusInternalServerError)
 	}
 }
 
@@ -170,16 +225,32 @@ func HandleFollowUser(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 
 	// Check if user is trying to follow themselves
 	if userId == followerID {
-		http.Error(w, "Cannot follow yourself", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Cannot follow yourself")
 		return
 	}
 
-	err := ctx.Database.FollowUser(followerID, userId)
-	if err != nil {
-		ctx.Logger.Errorf("Error following user: %v", err)
-		http.Error(w, "Failed to follow user", http.StatusInternalServerError)
+	requested, err := ctx.Database.FollowUser(r.Context(), followerID, userId)
+	if errors.Is(err, database.ErrConflict) {
+		writeError(w, ctx, http.StatusConflict, "User already followed")
 		return
+	} else if err != nil {
+		writeErrorFor(w, ctx, err, "Error following user")
+		return
+	}
+	if requested {
+		// Private account: the follow starts when the user approves it
+		ctx.Logger.Infof("User %s asked to follow %s", ctx.User.Username, userId)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(map[string]string{"message": "Follow request sent"}); err != nil {
+			ctx.Logger.Errorf("Failed to write response: %v", err)
+		}
+		return
+	}
+	if err := ctx.Notifier.Followed(r.Context(), followerID, userId); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to update the notifications")
 	}
+	publishEvent(r, ctx, events.Event{Type: events.TypeFollow, UserID: userId})
 	ctx.Logger.Infof("User %s followed %s", ctx.User.Username, userId)
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
@@ -194,16 +265,18 @@ func HandleUnfollowUser(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 
 	// Check if user is trying to unfollow themselves
 	if userId == followerID {
-		http.Error(w, "Cannot unfollow yourself", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Cannot unfollow yourself")
 		return
 	}
 
-	err := ctx.Database.UnfollowUser(followerID, userId)
+	err := ctx.Database.UnfollowUser(r.Context(), followerID, userId)
 	if err != nil {
-		ctx.Logger.Errorf("Error unfollowing user: %v", err)
-		http.Error(w, "Failed to unfollow user", http.StatusInternalServerError)
+		writeErrorFor(w, ctx, err, "Error unfollowing user")
 		return
 	}
+	if err := ctx.Notifier.Unfollowed(r.Context(), followerID, userId); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to update the notifications")
+	}
 	ctx.Logger.Infof("User %s unfollowed %s", ctx.User.Username, userId)
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
@@ -215,32 +288,46 @@ func HandleUnfollowUser(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 // get all users
 func HandleGetAllUsers(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	currentUserID := ctx.User.ID // Ensure that ctx.User is populated correctly in the middleware
-
-	users, err := ctx.Database.GetAllUsers(currentUserID)
-	if err != nil {
-		ctx.Logger.Errorf("Failed to get all users: %v", err)
-		http.Error(w, "Failed to get all users", http.StatusInternalServerError)
+	page, ok := parsePage(w, r, ctx)
+	if !ok {
 		return
 	}
+
+	users, next, err := ctx.Database.GetAllUsers(r.Context(), currentUserID, page)
 	ctx.Logger.Infof("Fetched all users")
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(users); err != nil {
-		ctx.Logger.Errorf("Failed to write response: %v", err)
+	writePage(w, ctx, users, next, err)
+}
+
+// handleGetFollowers lists the users following the user in the path.
+func handleGetFollowers(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	page, ok := parsePage(w, r, ctx)
+	if !ok {
+		return
+	}
+	users, next, err := ctx.Database.GetFollowers(r.Context(), ps.ByName("userId"), ctx.User.ID, page)
+	writePage(w, ctx, users, next, err)
+}
+
+// handleGetFollowing lists the users followed by the user in the path.
+func handleGetFollowing(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	page, ok := parsePage(w, r, ctx)
+	if !ok {
+		return
 	}
+	users, next, err := ctx.Database.GetFollowing(r.Context(), ps.ByName("userId"), ctx.User.ID, page)
+	writePage(w, ctx, users, next, err)
 }
 
 func handleGetUsername(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	ctx.Logger.Infof("Fetching username for userId")
 	userId := ps.ByName("userId")
 	if userId == "" {
-		http.Error(w, "Invalid userId parameter", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid userId parameter")
 		return
 	}
-	username, err := ctx.Database.GetUsername(userId)
+	username, err := ctx.Database.GetUsername(r.Context(), userId)
 	if err != nil {
-		ctx.Logger.Error("Failed to retrieve username: ", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeErrorFor(w, ctx, err, "Failed to retrieve username")
 		return
 	}
 	ctx.Logger.Infof("Username fetched for userID: %s", userId)
@@ -255,10 +342,9 @@ func handleIsUserFollowed(w http.ResponseWriter, r *http.Request, ps httprouter.
 	userId := ps.ByName("userId")
 	followerId := ctx.User.ID
 
-	isFollowed, err := ctx.Database.IsUserFollowed(userId, followerId)
+	isFollowed, err := ctx.Database.IsUserFollowed(r.Context(), userId, followerId)
 	if err != nil {
-		ctx.Logger.Error("Failed to check if user is followed: ", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeErrorFor(w, ctx, err, "Failed to check if user is followed")
 		return
 	}
 	ctx.Logger.Infof("User follow status checked")
@@ -0,0 +1,94 @@
+/*
+Package blobstore stores binary objects (e.g., image files) outside the database. Objects are addressed by a key; the
+database only keeps the key.
+
+Two implementations are available: a local filesystem directory and an S3-compatible object storage (AWS S3, MinIO,
+etc.). Use New to create the one selected in the configuration:
+
+	store, err := blobstore.New(blobstore.Config{
+		Driver: cfg.Blob.Driver,
+		Path:   cfg.Blob.Path,
+	})
+	if err != nil {
+		return fmt.Errorf("creating the blob store: %w", err)
+	}
+*/
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotFound is returned when the requested object does not exist.
+var ErrNotFound = errors.New("blob not found")
+
+// Object is an object opened for reading. Seek allows reading only a part of the object (e.g., HTTP Range requests).
+type Object interface {
+	io.ReadSeekCloser
+
+	// Size returns the size of the object in bytes
+	Size() int64
+}
+
+// BlobStore is the interface implemented by all object storages.
+type BlobStore interface {
+	// Put stores data under key, replacing any existing object with the same key
+	Put(key string, data []byte) error
+
+	// Open opens the object for reading. It returns ErrNotFound if the object does not exist
+	Open(key string) (Object, error)
+
+	// Delete removes the object. Deleting a missing object is not an error
+	Delete(key string) error
+
+	// Ping checks that the storage is reachable and writable (local) or that the bucket exists (S3)
+	Ping() error
+}
+
+// Config is used to provide the configuration to the New function.
+type Config struct {
+	// Driver selects the implementation: "local" or "s3"
+	Driver string
+
+	// Path is the root directory of the "local" driver
+	Path string
+
+	// S3 is the configuration of the "s3" driver
+	S3 S3Config
+}
+
+// New returns the BlobStore selected by cfg.Driver.
+func New(cfg Config) (BlobStore, error) {
+	switch cfg.Driver {
+	case "local":
+		return NewLocal(cfg.Path)
+	case "s3":
+		return NewS3(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown blob store driver %q", cfg.Driver)
+	}
+}
+
+// Key returns the content key for data: the hex encoded SHA-256 of the bytes. Identical content always has the same
+// key, so the key can also be used as an HTTP entity tag.
+func Key(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validKey checks that a key can be safely used as a path or URL component.
+func validKey(key string) error {
+	if key == "" {
+		return errors.New("empty blob key")
+	}
+	for _, c := range key {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' && c != '.' {
+			return fmt.Errorf("invalid blob key %q", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// localStore keeps objects as files in a directory. Files are spread in sub-directories named after the first
+// characters of the key, to avoid huge directories.
+type localStore struct {
+	root string
+}
+
+type localObject struct {
+	*os.File
+	size int64
+}
+
+func (o *localObject) Size() int64 {
+	return o.size
+}
+
+// NewLocal returns a BlobStore that saves objects in the root directory. The directory is created if missing.
+func NewLocal(root string) (BlobStore, error) {
+	if root == "" {
+		return nil, errors.New("blob store path is required")
+	}
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, fmt.Errorf("creating blob store directory: %w", err)
+	}
+	return &localStore{root: root}, nil
+}
+
+func (s *localStore) path(key string) string {
+	if len(key) < 4 {
+		return filepath.Join(s.root, key)
+	}
+	return filepath.Join(s.root, key[:2], key[2:4], key)
+}
+
+func (s *localStore) Put(key string, data []byte) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	dst := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o750); err != nil {
+		return fmt.Errorf("creating blob directory: %w", err)
+	}
+
+	// Write to a temporary file first, so that readers never see a partial object
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary blob file: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("writing blob: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing blob: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return fmt.Errorf("storing blob: %w", err)
+	}
+	return nil
+}
+
+func (s *localStore) Open(key string) (Object, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("opening blob: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("reading blob size: %w", err)
+	}
+	return &localObject{File: f, size: info.Size()}, nil
+}
+
+func (s *localStore) Delete(key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	err := os.Remove(s.path(key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("deleting blob: %w", err)
+	}
+	return nil
+}
+
+// Ping checks that the root directory exists and that files can be created in it.
+func (s *localStore) Ping() error {
+	tmp, err := ioutil.TempFile(s.root, ".ping-*")
+	if err != nil {
+		return fmt.Errorf("writing to the blob store directory: %w", err)
+	}
+	_ = tmp.Close()
+	if err := os.Remove(tmp.Name()); err != nil {
+		return fmt.Errorf("cleaning up the blob store directory: %w", err)
+	}
+	return nil
+}
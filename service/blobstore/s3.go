@@ -0,0 +1,291 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// S3Config is the configuration of the S3-compatible driver.
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. "https://s3.eu-south-1.amazonaws.com" or "http://localhost:9000"
+	// for a local MinIO server
+	Endpoint string
+
+	// Region is the region used to sign the requests. MinIO accepts "us-east-1" by default
+	Region string
+
+	// Bucket is the name of an existing bucket. Objects are addressed in path style (<endpoint>/<bucket>/<key>)
+	Bucket string
+
+	AccessKey string
+	SecretKey string
+}
+
+// emptyPayloadHash is the SHA-256 of an empty body, used to sign requests without a payload.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Store talks to the S3 REST API directly, signing requests with AWS Signature Version 4.
+type s3Store struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3 returns a BlobStore that saves objects in an S3-compatible bucket.
+func NewS3(cfg S3Config) (BlobStore, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("s3 endpoint is required")
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 bucket is required")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("s3 access key and secret key are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	return &s3Store{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (s *s3Store) Put(key string, data []byte) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	req, err := s.newRequest(http.MethodPut, key, bytes.NewReader(data), hex.EncodeToString(sum[:]))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(data))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("uploading blob: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("uploading blob: %w", s3Error(resp))
+	}
+	return nil
+}
+
+func (s *s3Store) Open(key string) (Object, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	req, err := s.newRequest(http.MethodHead, key, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("opening blob: %w", err)
+	}
+	_ = resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return &s3Object{store: s, key: key, size: resp.ContentLength}, nil
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	default:
+		return nil, fmt.Errorf("opening blob: %w", s3Error(resp))
+	}
+}
+
+func (s *s3Store) Delete(key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	req, err := s.newRequest(http.MethodDelete, key, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("deleting blob: %w", err)
+	}
+	defer resp.Body.Close()
+	// S3 replies 204 even if the object does not exist
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("deleting blob: %w", s3Error(resp))
+	}
+	return nil
+}
+
+// pingTimeout bounds Ping, which is used by the readiness probe and must not hang on an unreachable endpoint.
+const pingTimeout = 5 * time.Second
+
+// Ping sends a HEAD request for the bucket.
+func (s *s3Store) Ping() error {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("creating s3 request: %w", err)
+	}
+	s.sign(req, emptyPayloadHash, globaltime.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("checking the bucket: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("checking the bucket: %w", s3Error(resp))
+	}
+	return nil
+}
+
+// newRequest builds a signed request for the object key.
+func (s *s3Store) newRequest(method string, key string, body io.Reader, payloadHash string) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket + "/" + key
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("creating s3 request: %w", err)
+	}
+	s.sign(req, payloadHash, globaltime.Now().UTC())
+	return req, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to req. Only the host and the x-amz-* headers are signed, so callers
+// may add other headers (e.g., Range) after signing.
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.cfg.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), day)
+	signingKey = hmacSHA256(signingKey, s.cfg.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Error builds an error from a failed S3 response, including the error document sent by the server.
+func s3Error(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 replied %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// s3Object reads an object lazily: the GET request is sent on the first Read, starting from the current offset, and
+// Seek drops the open response so that the next Read starts from the new position.
+type s3Object struct {
+	store  *s3Store
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Size() int64 {
+	return o.size
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		req, err := o.store.newRequest(http.MethodGet, o.key, nil, emptyPayloadHash)
+		if err != nil {
+			return 0, err
+		}
+		if o.offset > 0 {
+			req.Header.Set("Range", "bytes="+strconv.FormatInt(o.offset, 10)+"-")
+		}
+		resp, err := o.store.client.Do(req)
+		if err != nil {
+			return 0, fmt.Errorf("reading blob: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			defer resp.Body.Close()
+			return 0, fmt.Errorf("reading blob: %w", s3Error(resp))
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = o.offset + offset
+	case io.SeekEnd:
+		abs = o.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+	if abs != o.offset && o.body != nil {
+		_ = o.body.Close()
+		o.body = nil
+	}
+	o.offset = abs
+	return abs, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
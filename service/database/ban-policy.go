@@ -0,0 +1,27 @@
+package database
+
+// The ban policy is defined here. A ban separates both users, whoever banned whom: neither of them sees the photos,
+// comments, likes, follows and profile of the other, nor can interact with them. Every query and mutation involving
+// two users applies the policy through notBlocked (in SQL) or Blocked; content hidden by a ban is reported as
+// ErrNotFound, so that users can't tell whether someone banned them.
+
+import (
+	"context"
+	"fmt"
+)
+
+// Blocked reports whether userID or otherID banned the other.
+func (db *appdbimpl) Blocked(ctx context.Context, userID string, otherID string) (bool, error) {
+	var blocked bool
+	err := db.c.QueryRowContext(ctx, `SELECT NOT `+notBlocked("?", "?"), userID, otherID).Scan(&blocked)
+	if err != nil {
+		return false, fmt.Errorf("error checking ban: %w", err)
+	}
+	return blocked, nil
+}
+
+// notBlocked returns the SQL condition that is true unless either of the users a and b banned the other. a and b are
+// SQL expressions, e.g. qualified columns or ? placeholders; each appears once in the condition, a before b.
+func notBlocked(a string, b string) string {
+	return fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM blocks WHERE blocks.user_id = %s AND blocks.other_id = %s)`, a, b)
+}
@@ -1,54 +1,60 @@
 package database
 
 import (
+	"context"
 	"fmt"
-	"time"
-)
 
-func (db *appdbimpl) BanUser(bannedBy, bannedUser string) error {
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
 
-	exists, err := db.BanExists(bannedBy, bannedUser)
-	if err != nil {
-		return fmt.Errorf("error checking if ban exists: %w", err)
-	}
-	if exists {
-		return fmt.Errorf("user is already banned")
-	}
-	stmt, err := db.c.Prepare("INSERT INTO new_bans (ban_id,banned_by, banned_user, timestamp) VALUES (?,?, ?, ?)")
-	if err != nil {
-		return fmt.Errorf("failed to prepare ban statement: %w", err)
-	}
-	defer stmt.Close()
+// BanUser stores the ban of bannedUser by bannedBy, and removes the follows and the follow requests between them in
+// both directions (see ban-policy.go). It returns ErrConflict if the ban already exists. A user who was banned can ban
+// back: each ban is lifted only by its author.
+func (db *appdbimpl) BanUser(ctx context.Context, bannedBy, bannedUser string) error {
 	// generate a unique ban id
 	banId, err := generateRandomString(10)
 	if err != nil {
 		return fmt.Errorf("failed to generate ban id: %w", err)
 	}
-	_, err = stmt.Exec(banId, bannedBy, bannedUser, time.Now())
-	if err != nil {
-		return fmt.Errorf("failed to execute ban statement: %w", err)
-	}
 
-	return nil
+	// The check and the changes run in one transaction, so that concurrent bans of the same user can't both pass
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		exists, err := tx.BanExists(ctx, bannedBy, bannedUser)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("user %s is already banned: %w", bannedUser, ErrConflict)
+		}
+
+		if _, err := tx.c.ExecContext(ctx, "INSERT INTO new_bans (ban_id, banned_by, banned_user, timestamp) VALUES (?, ?, ?, ?)",
+			banId, bannedBy, bannedUser, globaltime.Now().UTC()); err != nil {
+			return fmt.Errorf("failed to execute ban statement: %w", err)
+		}
+		if err := tx.UnfollowUser(ctx, bannedBy, bannedUser); err != nil {
+			return err
+		}
+		return tx.UnfollowUser(ctx, bannedUser, bannedBy)
+	})
 }
 
-func (db *appdbimpl) IsBannedBy(bannedUser, banningUser string) (bool, error) {
+func (db *appdbimpl) IsBannedBy(ctx context.Context, bannedUser, banningUser string) (bool, error) {
 	var exists bool
-	err := db.c.QueryRow("SELECT EXISTS(SELECT 1 FROM new_bans WHERE banned_user = ? AND banned_by = ?)", bannedUser, banningUser).Scan(&exists)
+	err := db.c.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM new_bans WHERE banned_user = ? AND banned_by = ?)", bannedUser, banningUser).Scan(&exists)
 	if err != nil {
 		return false, fmt.Errorf("error checking if user is banned by: %w", err)
 	}
 	return exists, nil
 }
 
-func (db *appdbimpl) UnbanUser(bannerID, bannedUserID string) error {
-	stmt, err := db.c.Prepare("DELETE FROM new_bans WHERE banned_by = ? AND banned_user = ?")
+func (db *appdbimpl) UnbanUser(ctx context.Context, bannerID, bannedUserID string) error {
+	stmt, err := db.c.PrepareContext(ctx, "DELETE FROM new_bans WHERE banned_by = ? AND banned_user = ?")
 	if err != nil {
 		return fmt.Errorf("failed to prepare unban statement: %w", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(bannerID, bannedUserID)
+	_, err = stmt.ExecContext(ctx, bannerID, bannedUserID)
 	if err != nil {
 		return fmt.Errorf("failed to execute unban statement: %w", err)
 	}
@@ -56,15 +62,15 @@ func (db *appdbimpl) UnbanUser(bannerID, bannedUserID string) error {
 	return nil
 }
 
-func (db *appdbimpl) BanExists(bannedBy, bannedUser string) (bool, error) {
+func (db *appdbimpl) BanExists(ctx context.Context, bannedBy, bannedUser string) (bool, error) {
 	var exists bool
-	stmt, err := db.c.Prepare("SELECT EXISTS(SELECT 1 FROM new_bans WHERE banned_by = ? AND banned_user = ?)")
+	stmt, err := db.c.PrepareContext(ctx, "SELECT EXISTS(SELECT 1 FROM new_bans WHERE banned_by = ? AND banned_user = ?)")
 	if err != nil {
 		return false, fmt.Errorf("failed to prepare check ban existence statement: %w", err)
 	}
 	defer stmt.Close()
 
-	err = stmt.QueryRow(bannedBy, bannedUser).Scan(&exists)
+	err = stmt.QueryRowContext(ctx, bannedBy, bannedUser).Scan(&exists)
 	if err != nil {
 		return false, fmt.Errorf("failed to execute check ban existence statement: %w", err)
 	}
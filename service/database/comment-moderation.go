@@ -0,0 +1,45 @@
+package database
+
+// The owner of a photo moderates the comments on it: they can hide single comments, and turn off new comments. Hidden
+// comments are not deleted, and can be shown again.
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// SetCommentHidden hides the comment (or shows it again) to everyone but its author and the owner of the photo. It
+// returns ErrNotFound if the comment doesn't exist or was deleted.
+func (db *appdbimpl) SetCommentHidden(ctx context.Context, commentID string, hidden bool, now time.Time) error {
+	res, err := db.c.ExecContext(ctx, `UPDATE comments SET hidden_at = CASE WHEN ? THEN COALESCE(hidden_at, ?) END
+		WHERE comment_id = ? AND deleted_at IS NULL`, hidden, now, commentID)
+	if err != nil {
+		return fmt.Errorf("failed to update comment: %w", err)
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update comment: %w", err)
+	}
+	if updated == 0 {
+		return fmt.Errorf("comment %s: %w", commentID, ErrNotFound)
+	}
+	return nil
+}
+
+// SetCommentsEnabled allows or refuses new comments on the photo (see AddComment). The comments already there are
+// kept. It returns ErrNotFound if the photo doesn't exist.
+func (db *appdbimpl) SetCommentsEnabled(ctx context.Context, photoID string, enabled bool) error {
+	res, err := db.c.ExecContext(ctx, "UPDATE new_photos SET comments_enabled = ? WHERE photo_id = ?", enabled, photoID)
+	if err != nil {
+		return fmt.Errorf("failed to update photo: %w", err)
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update photo: %w", err)
+	}
+	if updated == 0 {
+		return fmt.Errorf("photo %s: %w", photoID, ErrNotFound)
+	}
+	return nil
+}
@@ -1,50 +1,353 @@
 package database
 
-import "fmt"
+// Comments form threads of one level: a comment on the photo, and the replies to it. A reply to a reply joins the same
+// thread. A comment deleted while it has replies is kept as a tombstone, without author nor content, until the last
+// of its replies is deleted too. The owner of the photo can hide comments: hidden comments are shown only to their
+// author and to the owner (see shownTo).
 
-func (db *appdbimpl) AddComment(comment Comment) error {
-	stmt, err := db.c.Prepare("INSERT INTO comments (comment_id, user_id, photo_id, content, timestamp) VALUES (?, ?, ?, ?, ?)")
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// commentColumns are the columns read by getCommentPage, for the comments c written by the users u. The ID of the
+// viewer must be bound three times, before the arguments of the rest of the query.
+var commentColumns = `c.comment_id, c.user_id, u.username, c.photo_id, COALESCE(c.parent_comment_id, ''), c.content,
+	c.edited_at, c.deleted_at IS NOT NULL, c.hidden_at IS NOT NULL, c.timestamp, CAST(c.timestamp AS TEXT),
+	(SELECT COUNT(*) FROM comment_likes cl WHERE cl.comment_id = c.comment_id),
+	EXISTS(SELECT 1 FROM comment_likes cl WHERE cl.comment_id = c.comment_id AND cl.user_id = ?),
+	(SELECT COUNT(*) FROM comments r WHERE r.parent_comment_id = c.comment_id AND ` + notBlocked("r.user_id", "?") + `
+		AND ` + shownTo("r") + `)`
+
+// shownTo returns the SQL condition selecting the comments (with the given alias) not hidden from the viewer, who must
+// be bound once: a hidden comment is shown only to its author and to the owner of the photo.
+func shownTo(alias string) string {
+	return fmt.Sprintf(`(%[1]s.hidden_at IS NULL
+		OR ? IN (%[1]s.user_id, (SELECT hp.user_id FROM new_photos hp WHERE hp.photo_id = %[1]s.photo_id)))`, alias)
+}
+
+// AddComment stores the comment along with its mentions, and returns the IDs of the users it mentions. If the comment
+// replies to a reply, it is stored as a reply to the same comment. It returns ErrNotFound if the photo or the comment
+// replied to don't exist, or a ban separates the author of the comment from the owner of the photo or from the author
+// of the comment replied to, and ErrForbidden if the owner of the photo turned off comments.
+func (db *appdbimpl) AddComment(ctx context.Context, comment Comment) ([]string, error) {
+	tx, err := db.c.BeginTx(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("tx.Rollback failed: %v", rbErr)
+			}
+		}
+	}()
+
+	var parentID sql.NullString
+	if comment.ParentID != "" {
+		err = tx.QueryRowContext(ctx, `SELECT COALESCE(c.parent_comment_id, c.comment_id) FROM comments c
+			WHERE c.comment_id = ? AND c.photo_id = ? AND (c.deleted_at IS NOT NULL OR `+notBlocked("c.user_id", "?")+`)
+				AND `+shownTo("c"),
+			comment.ParentID, comment.PhotoID, comment.UserID, comment.UserID).Scan(&parentID)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = fmt.Errorf("comment %s: %w", comment.ParentID, ErrNotFound)
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to query the comment replied to: %w", err)
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `INSERT INTO comments (comment_id, user_id, photo_id, parent_comment_id, content, timestamp)
+		SELECT ?, ?, p.photo_id, ?, ?, ? FROM new_photos p
+		WHERE p.photo_id = ? AND p.comments_enabled AND `+notBlocked("p.user_id", "?"),
+		comment.ID, comment.UserID, parentID, comment.Content, comment.Timestamp, comment.PhotoID, comment.UserID)
+	if err != nil {
+		return nil, err
+	}
+	added, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if added == 0 {
+		var exists bool
+		err = tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM new_photos p WHERE p.photo_id = ? AND `+notBlocked("p.user_id", "?")+`)`,
+			comment.PhotoID, comment.UserID).Scan(&exists)
+		if err == nil && exists {
+			err = fmt.Errorf("comments on photo %s are turned off: %w", comment.PhotoID, ErrForbidden)
+		} else if err == nil {
+			err = fmt.Errorf("photo %s: %w", comment.PhotoID, ErrNotFound)
+		}
+		return nil, err
+	}
+	mentioned, err := setMentions(ctx, tx, mentionInComment, comment.ID, comment.UserID, comment.Content)
+	if err != nil {
+		return nil, err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(comment.ID, comment.UserID, comment.PhotoID, comment.Content, comment.Timestamp)
-	return err
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return mentioned, nil
+}
+
+// EditComment replaces the content of the comment, keeping the previous one in its edit history, and updates its
+// mentions. It returns the IDs of the users mentioned by the new content but not by the previous one, or ErrNotFound
+// if the comment doesn't exist or was deleted.
+func (db *appdbimpl) EditComment(ctx context.Context, commentID string, content string,
+	editedAt time.Time) ([]string, error) {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("tx.Rollback failed: %v", rbErr)
+			}
+		}
+	}()
+
+	var authorID, previous string
+	var writtenAt time.Time
+	var lastEdit sql.NullTime
+	err = tx.QueryRowContext(ctx, `SELECT user_id, content, timestamp, edited_at FROM comments
+		WHERE comment_id = ? AND deleted_at IS NULL`, commentID).Scan(&authorID, &previous, &writtenAt, &lastEdit)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("comment %s: %w", commentID, ErrNotFound)
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to query comment: %w", err)
+	}
+	if lastEdit.Valid {
+		writtenAt = lastEdit.Time
+	}
+
+	if _, err = tx.ExecContext(ctx, "INSERT INTO comment_edits (comment_id, content, written_at) VALUES (?, ?, ?)",
+		commentID, previous, writtenAt); err != nil {
+		return nil, fmt.Errorf("failed to save the previous version: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, "UPDATE comments SET content = ?, edited_at = ? WHERE comment_id = ?",
+		content, editedAt, commentID); err != nil {
+		return nil, fmt.Errorf("failed to update comment: %w", err)
+	}
+	mentioned, err := setMentions(ctx, tx, mentionInComment, commentID, authorID, content)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return mentioned, nil
+}
+
+// GetCommentEdits returns the previous versions of the comment, the newest first.
+func (db *appdbimpl) GetCommentEdits(ctx context.Context, commentID string) ([]CommentEdit, error) {
+	rows, err := db.c.QueryContext(ctx, `SELECT content, written_at FROM comment_edits WHERE comment_id = ?
+		ORDER BY written_at DESC, edit_id DESC`, commentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query comment edits: %w", err)
+	}
+	defer rows.Close()
+
+	edits := []CommentEdit{}
+	for rows.Next() {
+		var edit CommentEdit
+		if err := rows.Scan(&edit.Content, &edit.WrittenAt); err != nil {
+			return nil, fmt.Errorf("failed to scan comment edit: %w", err)
+		}
+		edits = append(edits, edit)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+	return edits, nil
 }
 
-func (db *appdbimpl) DeleteComment(commentID string) error {
-	stmt, err := db.c.Prepare("DELETE FROM comments WHERE comment_id = ?")
+// DeleteComment deletes the comment, with its mentions, likes, edit history and notifications. A comment with replies is replaced
+// by its tombstone; deleting the last reply of a tombstone deletes the tombstone too.
+func (db *appdbimpl) DeleteComment(ctx context.Context, commentID string) error {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("tx.Rollback failed: %v", rbErr)
+			}
+		}
+	}()
+
+	var parentID sql.NullString
+	var hasReplies bool
+	err = tx.QueryRowContext(ctx, `SELECT parent_comment_id, EXISTS(SELECT 1 FROM comments r WHERE r.parent_comment_id = c.comment_id)
+		FROM comments c WHERE comment_id = ? AND deleted_at IS NULL`, commentID).Scan(&parentID, &hasReplies)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("comment %s: %w", commentID, ErrNotFound)
+		return err
+	} else if err != nil {
+		return fmt.Errorf("failed to query comment: %w", err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM mentions WHERE source = ? AND source_id = ?", mentionInComment, commentID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM comment_likes WHERE comment_id = ?", commentID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM comment_edits WHERE comment_id = ?", commentID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM notifications WHERE comment_id = ?", commentID); err != nil {
+		return err
+	}
+	if hasReplies {
+		_, err = tx.ExecContext(ctx, "UPDATE comments SET content = '', deleted_at = CURRENT_TIMESTAMP WHERE comment_id = ?", commentID)
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM comments WHERE comment_id = ?", commentID)
+	}
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	if parentID.Valid {
+		// The thread may be left with nothing but the tombstone
+		if _, err = tx.ExecContext(ctx, `DELETE FROM comments WHERE comment_id = ? AND deleted_at IS NOT NULL
+			AND NOT EXISTS(SELECT 1 FROM comments r WHERE r.parent_comment_id = ?)`, parentID, parentID); err != nil {
+			return err
+		}
+	}
 
-	_, err = stmt.Exec(commentID)
-	return err
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetCommentOwner returns the ID of the user who wrote the comment, or an empty string if the comment does not exist
+// or was deleted.
+func (db *appdbimpl) GetCommentOwner(ctx context.Context, commentID string) (string, error) {
+	var userID string
+	err := db.c.QueryRowContext(ctx, "SELECT user_id FROM comments WHERE comment_id = ? AND deleted_at IS NULL", commentID).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to query comment owner: %w", err)
+	}
+	return userID, nil
 }
-func (db *appdbimpl) GetCommentsByPhotoId(photoId string) ([]Comment, error) {
-	// SQL query to fetch all comments for a given photo ID
-	query := `SELECT comment_id, user_id, photo_id, content, timestamp FROM comments WHERE photo_id = ? ORDER BY timestamp DESC`
-	rows, err := db.c.Query(query, photoId)
+
+// GetComment returns the comment without mentions, likes and replies, or nil if the comment does not exist. The
+// tombstone of a deleted comment is returned with Deleted set, and still holds the ID of its author.
+func (db *appdbimpl) GetComment(ctx context.Context, commentID string) (*Comment, error) {
+	var c Comment
+	var editedAt sql.NullTime
+	err := db.c.QueryRowContext(ctx, `SELECT comment_id, user_id, photo_id, COALESCE(parent_comment_id, ''), content, edited_at,
+			deleted_at IS NOT NULL, hidden_at IS NOT NULL, timestamp
+		FROM comments WHERE comment_id = ?`, commentID).Scan(
+		&c.ID, &c.UserID, &c.PhotoID, &c.ParentID, &c.Content, &editedAt, &c.Deleted, &c.Hidden, &c.Timestamp,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to query comment: %w", err)
+	}
+	if editedAt.Valid {
+		c.EditedAt = &editedAt.Time
+	}
+	return &c, nil
+}
+
+// GetCommentsByPhotoId returns a page of the threads of the photo visible to viewerID, newest first, and the cursor of
+// the next page. Each thread is the comment that started it, with the number of its replies (see GetReplies).
+// Comments and replies of users separated from viewerID by a ban or hidden from viewerID are left out, and so are the
+// tombstones left with no reply visible to viewerID.
+func (db *appdbimpl) GetCommentsByPhotoId(ctx context.Context, photoId string, viewerID string,
+	page Page) ([]Comment, string, error) {
+	cond, args, err := page.keysetCondition("c.timestamp", "c.comment_id", "DESC")
 	if err != nil {
-		return nil, fmt.Errorf("failed to query comments: %w", err)
+		return nil, "", err
+	}
+	// SQL query to fetch a page of threads for a given photo ID
+	query := `SELECT ` + commentColumns + `
+		FROM comments c
+		JOIN users u ON u.user_id = c.user_id
+		WHERE c.photo_id = ? AND c.parent_comment_id IS NULL
+			AND (c.deleted_at IS NULL AND ` + notBlocked("c.user_id", "?") + ` AND ` + shownTo("c") + `
+				OR c.deleted_at IS NOT NULL AND EXISTS(SELECT 1 FROM comments r
+					WHERE r.parent_comment_id = c.comment_id AND ` + notBlocked("r.user_id", "?") + `
+						AND ` + shownTo("r") + `))
+			AND ` + cond + `
+		ORDER BY c.timestamp DESC, c.comment_id DESC
+		LIMIT ?`
+	return db.getCommentPage(ctx, page, viewerID, query,
+		append(append([]interface{}{viewerID, viewerID, viewerID, photoId, viewerID, viewerID, viewerID, viewerID}, args...),
+			page.limit()+1)...)
+}
+
+// GetReplies returns a page of the replies to the comment visible to viewerID, oldest first, and the cursor of the
+// next page. Replies of users separated from viewerID by a ban or hidden from viewerID are left out.
+func (db *appdbimpl) GetReplies(ctx context.Context, commentID string, viewerID string, page Page) ([]Comment,
+	string, error) {
+	cond, args, err := page.keysetCondition("c.timestamp", "c.comment_id", "ASC")
+	if err != nil {
+		return nil, "", err
+	}
+	query := `SELECT ` + commentColumns + `
+		FROM comments c
+		JOIN users u ON u.user_id = c.user_id
+		WHERE c.parent_comment_id = ? AND ` + notBlocked("c.user_id", "?") + ` AND ` + shownTo("c") + ` AND ` + cond + `
+		ORDER BY c.timestamp, c.comment_id
+		LIMIT ?`
+	return db.getCommentPage(ctx, page, viewerID, query,
+		append(append([]interface{}{viewerID, viewerID, viewerID, commentID, viewerID, viewerID}, args...), page.limit()+1)...)
+}
+
+// getCommentPage runs query, which must select the commentColumns of a page of comments sorted by timestamp, and
+// returns the comments with their mentions, and the cursor of the next page.
+func (db *appdbimpl) getCommentPage(ctx context.Context, page Page, viewerID string, query string,
+	args ...interface{}) ([]Comment, string, error) {
+	rows, err := db.c.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query comments: %w", err)
 	}
 	defer rows.Close()
 
-	var comments []Comment
+	comments := []Comment{}
+	pager := page.pager()
 	for rows.Next() {
 		var c Comment
-		if err := rows.Scan(&c.ID, &c.UserID, &c.PhotoID, &c.Content, &c.Timestamp); err != nil {
-			return nil, fmt.Errorf("failed to scan comment: %w", err)
+		var key string
+		var editedAt sql.NullTime
+		if err := rows.Scan(&c.ID, &c.UserID, &c.Username, &c.PhotoID, &c.ParentID, &c.Content, &editedAt, &c.Deleted,
+			&c.Hidden, &c.Timestamp, &key, &c.LikesCount, &c.LikedByMe, &c.RepliesCount); err != nil {
+			return nil, "", fmt.Errorf("failed to scan comment: %w", err)
+		}
+		if editedAt.Valid {
+			c.EditedAt = &editedAt.Time
+		}
+		if !pager.add(key, c.ID) {
+			break
+		}
+		if c.Deleted {
+			// Nothing is left of a deleted comment but its place in the thread
+			c.UserID, c.Username, c.EditedAt = "", "", nil
 		}
 		comments = append(comments, c)
 	}
 
 	// Check for errors that may have occurred during iteration
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("iteration error: %w", err)
+		return nil, "", fmt.Errorf("iteration error: %w", err)
+	}
+	rows.Close()
+	if err = db.addCommentMentions(ctx, comments, viewerID); err != nil {
+		return nil, "", err
 	}
 
-	return comments, nil
+	return comments, pager.next, nil
 }
@@ -0,0 +1,574 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+// checks is the suite, in the order it runs.
+var checks = []check{
+	{"users", checkUsers},
+	{"follows", checkFollows},
+	{"bans", checkBans},
+	{"photos", checkPhotos},
+	{"likes and comments", checkComments},
+	{"tags and search", checkTagsAndSearch},
+	{"notifications", checkNotifications},
+	{"sessions and password resets", checkSessions},
+	{"transactions", checkTransactions},
+}
+
+// addUser creates a user named prefix followed by a random suffix.
+func addUser(ctx context.Context, t *T, db database.Tx, prefix string) database.User {
+	user := database.User{Username: prefix + suffix()}
+	t.must(db.AddUser(ctx, &user), "adding user "+user.Username)
+	return user
+}
+
+// addPhoto creates a photo of owner with the given caption and number of images.
+func addPhoto(ctx context.Context, t *T, db database.Tx, owner database.User, caption string, images int,
+	timestamp time.Time) database.Photo {
+	photo := database.Photo{ID: "p" + suffix(), UserID: owner.ID, Caption: caption, Timestamp: timestamp}
+	for i := 0; i < images; i++ {
+		photo.Images = append(photo.Images, database.Image{ImageKey: "k" + suffix(), ImageType: "image/png"})
+	}
+	_, err := db.AddPhoto(ctx, photo)
+	t.must(err, "adding photo")
+	return photo
+}
+
+func checkUsers(ctx context.Context, t *T, db database.AppDatabase) {
+	alice := addUser(ctx, t, db, "Alice")
+	bob := addUser(ctx, t, db, "bob")
+
+	if err := db.AddUser(ctx, &database.User{Username: alice.Username}); !errors.Is(err, database.ErrConflict) {
+		t.Errorf("adding a taken username: got %v, want ErrConflict", err)
+	}
+
+	found, err := db.GetUserByUsername(ctx, strings.ToUpper(alice.Username))
+	t.must(err, "getting user by username")
+	if found == nil || found.ID != alice.ID {
+		t.Errorf("usernames must match ignoring case: got %+v, want %s", found, alice.ID)
+	}
+	found, err = db.GetUserByUsername(ctx, "nobody_"+suffix())
+	t.must(err, "getting a missing user")
+	if found != nil {
+		t.Errorf("missing user: got %+v, want nil", found)
+	}
+
+	if err := db.SetUsername(ctx, bob.ID, strings.ToLower(alice.Username)); !errors.Is(err, database.ErrConflict) {
+		t.Errorf("renaming to a username taken with another case: got %v, want ErrConflict", err)
+	}
+	renamed := "Bobby" + suffix()
+	t.must(db.SetUsername(ctx, bob.ID, renamed), "renaming user")
+	name, err := db.GetUsername(ctx, bob.ID)
+	t.must(err, "getting username")
+	if name != renamed {
+		t.Errorf("username after rename: got %q, want %q", name, renamed)
+	}
+	id, err := db.GetUserIDByUsername(ctx, renamed)
+	t.must(err, "getting user ID")
+	if id != bob.ID {
+		t.Errorf("user ID after rename: got %q, want %q", id, bob.ID)
+	}
+}
+
+func checkFollows(ctx context.Context, t *T, db database.AppDatabase) {
+	owner := addUser(ctx, t, db, "owner")
+	// Different cases, to check that lists are sorted ignoring case
+	followers := []database.User{addUser(ctx, t, db, "a"), addUser(ctx, t, db, "B"), addUser(ctx, t, db, "c")}
+
+	for _, f := range followers {
+		requested, err := db.FollowUser(ctx, f.ID, owner.ID)
+		t.must(err, "following a public account")
+		if requested {
+			t.Errorf("following a public account must not make a request")
+		}
+	}
+	if _, err := db.FollowUser(ctx, followers[0].ID, owner.ID); !errors.Is(err, database.ErrConflict) {
+		t.Errorf("following twice: got %v, want ErrConflict", err)
+	}
+
+	// Two pages of two and one users
+	var names []string
+	page := database.Page{Limit: 2}
+	for i := 0; i < 3; i++ {
+		users, next, err := db.GetFollowers(ctx, owner.ID, owner.ID, page)
+		t.must(err, "getting followers")
+		for _, u := range users {
+			names = append(names, u.Username)
+		}
+		if next == "" {
+			break
+		}
+		page.Cursor = next
+	}
+	want := []string{followers[0].Username, followers[1].Username, followers[2].Username}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("followers: got %v, want %v", names, want)
+	}
+
+	// Private account: the follow is a request until approved
+	private := addUser(ctx, t, db, "private")
+	t.must(db.SetPrivate(ctx, private.ID, true), "making the account private")
+	requested, err := db.FollowUser(ctx, owner.ID, private.ID)
+	t.must(err, "following a private account")
+	if !requested {
+		t.Errorf("following a private account must make a request")
+	}
+	visible, err := db.CanView(ctx, owner.ID, private.ID)
+	t.must(err, "checking visibility")
+	if visible {
+		t.Errorf("a private account must not be visible before the approval")
+	}
+	requests, _, err := db.GetFollowRequests(ctx, private.ID, database.Page{})
+	t.must(err, "getting follow requests")
+	if len(requests) != 1 || requests[0].ID != owner.ID {
+		t.Errorf("follow requests: got %+v, want %s", requests, owner.ID)
+	}
+	t.must(db.ApproveFollowRequest(ctx, private.ID, owner.ID), "approving the request")
+	following, err := db.IsUserFollowed(ctx, private.ID, owner.ID)
+	t.must(err, "checking the follow")
+	if !following {
+		t.Errorf("an approved request must become a follow")
+	}
+	if err := db.ApproveFollowRequest(ctx, private.ID, owner.ID); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("approving a missing request: got %v, want ErrNotFound", err)
+	}
+}
+
+func checkBans(ctx context.Context, t *T, db database.AppDatabase) {
+	banner := addUser(ctx, t, db, "banner")
+	banned := addUser(ctx, t, db, "banned")
+	_, err := db.FollowUser(ctx, banner.ID, banned.ID)
+	t.must(err, "following")
+	_, err = db.FollowUser(ctx, banned.ID, banner.ID)
+	t.must(err, "following back")
+
+	t.must(db.BanUser(ctx, banner.ID, banned.ID), "banning")
+	if err := db.BanUser(ctx, banner.ID, banned.ID); !errors.Is(err, database.ErrConflict) {
+		t.Errorf("banning twice: got %v, want ErrConflict", err)
+	}
+	for _, pair := range [][2]database.User{{banner, banned}, {banned, banner}} {
+		blocked, err := db.Blocked(ctx, pair[0].ID, pair[1].ID)
+		t.must(err, "checking the block")
+		if !blocked {
+			t.Errorf("a ban must block %s and %s both ways", pair[0].Username, pair[1].Username)
+		}
+		following, err := db.IsUserFollowed(ctx, pair[0].ID, pair[1].ID)
+		t.must(err, "checking the follow")
+		if following {
+			t.Errorf("a ban must remove the follows both ways")
+		}
+	}
+	if _, err := db.FollowUser(ctx, banned.ID, banner.ID); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("following across a ban: got %v, want ErrNotFound", err)
+	}
+
+	t.must(db.UnbanUser(ctx, banner.ID, banned.ID), "unbanning")
+	blocked, err := db.Blocked(ctx, banned.ID, banner.ID)
+	t.must(err, "checking the block")
+	if blocked {
+		t.Errorf("the block must be lifted with the ban")
+	}
+}
+
+func checkPhotos(ctx context.Context, t *T, db database.AppDatabase) {
+	owner := addUser(ctx, t, db, "photographer")
+	viewer := addUser(ctx, t, db, "viewer")
+	start := now().Add(-time.Hour)
+
+	var photos []database.Photo
+	for i := 0; i < 3; i++ {
+		photos = append(photos, addPhoto(ctx, t, db, owner, "", i+1, start.Add(time.Duration(i)*time.Minute)))
+	}
+
+	stored, err := db.GetPhotoMetadata(ctx, photos[2].ID)
+	t.must(err, "getting photo metadata")
+	if stored == nil || len(stored.Images) != 3 {
+		t.Fatalf("photo metadata: got %+v, want 3 images", stored)
+	}
+	for i, image := range stored.Images {
+		if image.Position != i || image.ImageKey != photos[2].Images[i].ImageKey || image.ImageType != "image/png" {
+			t.Errorf("image %d: got %+v, want %+v at position %d", i, image, photos[2].Images[i], i)
+		}
+	}
+	if !stored.Timestamp.Equal(photos[2].Timestamp) {
+		t.Errorf("timestamp: got %v, want %v", stored.Timestamp, photos[2].Timestamp)
+	}
+
+	// Newest first, in pages of two
+	var ids []string
+	page := database.Page{Limit: 2}
+	for i := 0; i < 3; i++ {
+		list, next, err := db.GetUserPhotos(ctx, owner.ID, viewer.ID, page)
+		t.must(err, "getting user photos")
+		for _, p := range list {
+			ids = append(ids, p.ID)
+			if p.ImagesCount == 0 {
+				t.Errorf("photo %s has no images count", p.ID)
+			}
+		}
+		if next == "" {
+			break
+		}
+		page.Cursor = next
+	}
+	want := []string{photos[2].ID, photos[1].ID, photos[0].ID}
+	if strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Errorf("user photos: got %v, want %v", ids, want)
+	}
+	if _, _, err := db.GetUserPhotos(ctx, owner.ID, viewer.ID, database.Page{Cursor: "not a cursor"}); !errors.Is(err,
+		database.ErrInvalidCursor) {
+		t.Errorf("invalid cursor: got %v, want ErrInvalidCursor", err)
+	}
+
+	key := photos[0].Images[0].ImageKey
+	used, err := db.IsImageKeyUsed(ctx, key)
+	t.must(err, "checking the image key")
+	if !used {
+		t.Errorf("the image key of a photo must be in use")
+	}
+	t.must(db.DeletePhoto(ctx, photos[0].ID), "deleting the photo")
+	used, err = db.IsImageKeyUsed(ctx, key)
+	t.must(err, "checking the image key")
+	if used {
+		t.Errorf("the image key of a deleted photo must not be in use")
+	}
+}
+
+func checkComments(ctx context.Context, t *T, db database.AppDatabase) {
+	owner := addUser(ctx, t, db, "owner")
+	commenter := addUser(ctx, t, db, "commenter")
+	photo := addPhoto(ctx, t, db, owner, "", 1, now())
+
+	t.must(db.LikePhoto(ctx, commenter.ID, photo.ID), "liking the photo")
+	if err := db.LikePhoto(ctx, commenter.ID, photo.ID); !errors.Is(err, database.ErrConflict) {
+		t.Errorf("liking twice: got %v, want ErrConflict", err)
+	}
+	if err := db.LikePhoto(ctx, commenter.ID, "missing"+suffix()); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("liking a missing photo: got %v, want ErrNotFound", err)
+	}
+
+	comment := database.Comment{ID: "c" + suffix(), UserID: commenter.ID, PhotoID: photo.ID,
+		Content: "Nice one @" + strings.ToUpper(owner.Username), Timestamp: now()}
+	mentioned, err := db.AddComment(ctx, comment)
+	t.must(err, "adding a comment")
+	if len(mentioned) != 1 || mentioned[0] != owner.ID {
+		t.Errorf("mentions must match usernames ignoring case: got %v, want [%s]", mentioned, owner.ID)
+	}
+	reply := database.Comment{ID: "c" + suffix(), UserID: owner.ID, PhotoID: photo.ID, ParentID: comment.ID,
+		Content: "Thanks", Timestamp: now()}
+	_, err = db.AddComment(ctx, reply)
+	t.must(err, "adding a reply")
+	nested := database.Comment{ID: "c" + suffix(), UserID: commenter.ID, PhotoID: photo.ID, ParentID: reply.ID,
+		Content: "You're welcome", Timestamp: now()}
+	_, err = db.AddComment(ctx, nested)
+	t.must(err, "replying to a reply")
+	stored, err := db.GetComment(ctx, nested.ID)
+	t.must(err, "getting the reply")
+	if stored == nil || stored.ParentID != comment.ID {
+		t.Errorf("a reply to a reply must belong to the thread: got %+v, want parent %s", stored, comment.ID)
+	}
+
+	t.must(db.LikeComment(ctx, owner.ID, comment.ID), "liking the comment")
+	threads, _, err := db.GetCommentsByPhotoId(ctx, photo.ID, commenter.ID, database.Page{})
+	t.must(err, "getting the comments")
+	if len(threads) != 1 || threads[0].RepliesCount != 2 || threads[0].LikesCount != 1 {
+		t.Errorf("threads: got %+v, want one with 2 replies and 1 like", threads)
+	}
+
+	_, err = db.EditComment(ctx, comment.ID, "Very nice", now())
+	t.must(err, "editing the comment")
+	edits, err := db.GetCommentEdits(ctx, comment.ID)
+	t.must(err, "getting the edits")
+	if len(edits) != 1 || edits[0].Content != comment.Content {
+		t.Errorf("edits: got %+v, want the original content", edits)
+	}
+
+	t.must(db.SetCommentHidden(ctx, reply.ID, true, now()), "hiding the reply")
+	stranger := addUser(ctx, t, db, "stranger")
+	replies, _, err := db.GetReplies(ctx, comment.ID, stranger.ID, database.Page{})
+	t.must(err, "getting the replies")
+	if len(replies) != 1 || replies[0].ID != nested.ID {
+		t.Errorf("hidden replies must be left out: got %+v", replies)
+	}
+
+	t.must(db.SetCommentsEnabled(ctx, photo.ID, false), "turning off comments")
+	late := database.Comment{ID: "c" + suffix(), UserID: commenter.ID, PhotoID: photo.ID, Content: "Late",
+		Timestamp: now()}
+	if _, err := db.AddComment(ctx, late); !errors.Is(err, database.ErrForbidden) {
+		t.Errorf("commenting with comments turned off: got %v, want ErrForbidden", err)
+	}
+}
+
+func checkTagsAndSearch(ctx context.Context, t *T, db database.AppDatabase) {
+	owner := addUser(ctx, t, db, "Searchable")
+	viewer := addUser(ctx, t, db, "searcher")
+	tag := "tag" + suffix()
+	photo := addPhoto(ctx, t, db, owner, "Crème brûlée #"+strings.ToUpper(tag), 1, now())
+
+	tagged, _, err := db.GetTagPhotos(ctx, tag, viewer.ID, database.Page{})
+	t.must(err, "getting the tagged photos")
+	if len(tagged) != 1 || tagged[0].ID != photo.ID {
+		t.Errorf("tagged photos: got %+v, want %s", tagged, photo.ID)
+	}
+	trending, err := db.GetTrendingTags(ctx, now().Add(-time.Hour), viewer.ID, database.MaxPageSize)
+	t.must(err, "getting the trending tags")
+	found := false
+	for _, tt := range trending {
+		found = found || (tt.Name == tag && tt.PhotosCount == 1)
+	}
+	if !found {
+		t.Errorf("trending tags: %s with one photo is missing from %+v", tag, trending)
+	}
+
+	// Prefix of the username, in another case
+	users, _, err := db.SearchUsers(ctx, strings.ToLower(owner.Username[:len(owner.Username)-2]), viewer.ID, database.Page{})
+	t.must(err, "searching users")
+	if len(users) != 1 || users[0].ID != owner.ID {
+		t.Errorf("user search: got %+v, want %s", users, owner.ID)
+	}
+	// Words without accents, the second one a prefix. The LIKE fallback of SQLite doesn't ignore accents.
+	first := "creme "
+	if !db.FullTextSearch() {
+		first = "crème "
+	}
+	photos, _, err := db.SearchPhotos(ctx, first+tag[:len(tag)-2], viewer.ID, database.Page{})
+	t.must(err, "searching photos")
+	if len(photos) != 1 || photos[0].ID != photo.ID {
+		t.Errorf("photo search: got %+v, want %s", photos, photo.ID)
+	}
+
+	_, err = db.SetCaption(ctx, photo.ID, "Nothing to see")
+	t.must(err, "changing the caption")
+	photos, _, err = db.SearchPhotos(ctx, tag, viewer.ID, database.Page{})
+	t.must(err, "searching photos")
+	if len(photos) != 0 {
+		t.Errorf("the search index must follow the caption: got %+v", photos)
+	}
+}
+
+func checkNotifications(ctx context.Context, t *T, db database.AppDatabase) {
+	recipient := addUser(ctx, t, db, "recipient")
+	actor := addUser(ctx, t, db, "actor")
+	start := now().Add(-time.Minute)
+
+	for i := 0; i < 3; i++ {
+		added, err := db.AddNotification(ctx, database.Notification{ID: "n" + suffix(), RecipientID: recipient.ID,
+			ActorID: actor.ID, Type: database.NotificationFollow, CreatedAt: start.Add(time.Duration(i) * time.Second)})
+		t.must(err, "adding a notification")
+		if !added {
+			t.Errorf("notification not added")
+		}
+	}
+	list, _, err := db.GetNotifications(ctx, recipient.ID, database.Page{Limit: 2})
+	t.must(err, "getting the notifications")
+	if len(list) != 2 || !list[0].CreatedAt.After(list[1].CreatedAt) {
+		t.Fatalf("notifications: got %+v, want the 2 newest, newest first", list)
+	}
+
+	t.must(db.SetNotificationRead(ctx, recipient.ID, list[0].ID, true, now()), "marking as read")
+	unread, err := db.CountUnreadNotifications(ctx, recipient.ID)
+	t.must(err, "counting the unread notifications")
+	if unread != 2 {
+		t.Errorf("unread notifications: got %d, want 2", unread)
+	}
+	t.must(db.SetAllNotificationsRead(ctx, recipient.ID, true, now()), "marking all as read")
+	unread, err = db.CountUnreadNotifications(ctx, recipient.ID)
+	t.must(err, "counting the unread notifications")
+	if unread != 0 {
+		t.Errorf("unread notifications: got %d, want 0", unread)
+	}
+
+	t.must(db.BanUser(ctx, recipient.ID, actor.ID), "banning")
+	added, err := db.AddNotification(ctx, database.Notification{ID: "n" + suffix(), RecipientID: recipient.ID,
+		ActorID: actor.ID, Type: database.NotificationFollow, CreatedAt: now()})
+	t.must(err, "adding a notification across a ban")
+	if added {
+		t.Errorf("notifications across a ban must not be added")
+	}
+}
+
+func checkSessions(ctx context.Context, t *T, db database.AppDatabase) {
+	user := addUser(ctx, t, db, "session")
+	session := database.Session{ID: "s" + suffix(), UserID: user.ID, CreatedAt: now(), ExpiresAt: now().Add(time.Hour)}
+	t.must(db.AddSession(ctx, session), "adding a session")
+	stored, err := db.GetSession(ctx, session.ID)
+	t.must(err, "getting the session")
+	if stored == nil || stored.Revoked || !stored.ExpiresAt.Equal(session.ExpiresAt) {
+		t.Errorf("session: got %+v, want %+v", stored, session)
+	}
+	t.must(db.RevokeUserSessions(ctx, user.ID), "revoking the sessions")
+	stored, err = db.GetSession(ctx, session.ID)
+	t.must(err, "getting the session")
+	if stored == nil || !stored.Revoked {
+		t.Errorf("session after revoking: got %+v, want revoked", stored)
+	}
+
+	reset := database.PasswordReset{TokenHash: "h" + suffix(), UserID: user.ID, ExpiresAt: now().Add(time.Hour)}
+	t.must(db.AddPasswordReset(ctx, reset), "adding a password reset")
+	userID, err := db.ConsumePasswordReset(ctx, reset.TokenHash)
+	t.must(err, "consuming the reset")
+	if userID != user.ID {
+		t.Errorf("password reset: got user %q, want %q", userID, user.ID)
+	}
+	userID, err = db.ConsumePasswordReset(ctx, reset.TokenHash)
+	t.must(err, "consuming the reset again")
+	if userID != "" {
+		t.Errorf("a password reset must be used once: got user %q", userID)
+	}
+
+	expired := database.PasswordReset{TokenHash: "h" + suffix(), UserID: user.ID, ExpiresAt: now().Add(-time.Hour)}
+	t.must(db.AddPasswordReset(ctx, expired), "adding an expired password reset")
+	userID, err = db.ConsumePasswordReset(ctx, expired.TokenHash)
+	t.must(err, "consuming the expired reset")
+	if userID != "" {
+		t.Errorf("an expired password reset must not be used: got user %q", userID)
+	}
+
+	// Concurrent uses of the same token: exactly one of them gets the user
+	const concurrency = 4
+	contested := database.PasswordReset{TokenHash: "h" + suffix(), UserID: user.ID, ExpiresAt: now().Add(time.Hour)}
+	t.must(db.AddPasswordReset(ctx, contested), "adding a contested password reset")
+	userIDs := make([]string, concurrency)
+	errs := make([]error, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			userIDs[i], errs[i] = db.ConsumePasswordReset(ctx, contested.TokenHash)
+		}(i)
+	}
+	wg.Wait()
+	consumed := 0
+	for i := range userIDs {
+		t.must(errs[i], "consuming the contested reset")
+		if userIDs[i] != "" {
+			consumed++
+		}
+	}
+	if consumed != 1 {
+		t.Errorf("concurrent password resets: %d got the user, want 1", consumed)
+	}
+
+	// Concurrent first logins of a legacy account without password: exactly one of them sets it
+	legacy := addUser(ctx, t, db, "legacy")
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.SetFirstPasswordHash(ctx, legacy.ID, "hash"+suffix())
+		}(i)
+	}
+	wg.Wait()
+	set := 0
+	for _, err := range errs {
+		if err == nil {
+			set++
+		} else if !errors.Is(err, database.ErrConflict) {
+			t.Errorf("concurrent first passwords: got %v, want nil or ErrConflict", err)
+		}
+	}
+	if set != 1 {
+		t.Errorf("concurrent first passwords: %d succeeded, want 1", set)
+	}
+}
+
+func checkTransactions(ctx context.Context, t *T, db database.AppDatabase) {
+	owner := addUser(ctx, t, db, "txowner")
+	other := addUser(ctx, t, db, "txother")
+
+	// Everything is undone when fn fails, including the operations that use a transaction of their own
+	errRollback := errors.New("rollback")
+	var ghost database.User
+	var photo database.Photo
+	err := db.WithTx(ctx, func(tx database.Tx) error {
+		ghost = addUser(ctx, t, tx, "txghost")
+		photo = addPhoto(ctx, t, tx, owner, "rolled back", 2, now())
+		t.must(tx.BanUser(ctx, owner.ID, other.ID), "banning in the transaction")
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Errorf("rolled back transaction: got %v, want the error of fn", err)
+	}
+	found, err := db.GetUserByUsername(ctx, ghost.Username)
+	t.must(err, "getting the rolled back user")
+	if found != nil {
+		t.Errorf("the user added in a rolled back transaction must not exist")
+	}
+	ownerID, err := db.GetPhotoOwner(ctx, photo.ID)
+	t.must(err, "getting the rolled back photo")
+	if ownerID != "" {
+		t.Errorf("the photo added in a rolled back transaction must not exist")
+	}
+	banned, err := db.BanExists(ctx, owner.ID, other.ID)
+	t.must(err, "checking the rolled back ban")
+	if banned {
+		t.Errorf("the ban made in a rolled back transaction must not exist")
+	}
+
+	// An operation that fails undoes only its own changes; the transaction goes on
+	err = db.WithTx(ctx, func(tx database.Tx) error {
+		if _, err := tx.FollowUser(ctx, owner.ID, other.ID); err != nil {
+			return err
+		}
+		if err := tx.BanUser(ctx, owner.ID, other.ID); err != nil {
+			return err
+		}
+		if _, err := tx.FollowUser(ctx, other.ID, owner.ID); !errors.Is(err, database.ErrNotFound) {
+			t.Errorf("following across a ban in a transaction: got %v, want ErrNotFound", err)
+		}
+		return tx.SetUsername(ctx, owner.ID, owner.Username+"_renamed")
+	})
+	t.must(err, "committing the transaction")
+	banned, err = db.BanExists(ctx, owner.ID, other.ID)
+	t.must(err, "checking the committed ban")
+	username, err := db.GetUsername(ctx, owner.ID)
+	t.must(err, "getting the committed username")
+	following, err := db.IsUserFollowed(ctx, other.ID, owner.ID)
+	t.must(err, "checking the follow")
+	if !banned || username != owner.Username+"_renamed" || following {
+		t.Errorf("committed transaction: got ban %v, username %q, follow %v", banned, username, following)
+	}
+
+	// Concurrent check-then-write operations: exactly one of them wins
+	const concurrency = 4
+	target := addUser(ctx, t, db, "txtarget")
+	users := make([]database.User, concurrency)
+	for i := range users {
+		users[i] = addUser(ctx, t, db, "txrival")
+	}
+	name := "taken_" + suffix()
+	banErrs := make([]error, concurrency)
+	renameErrs := make([]error, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			banErrs[i] = db.BanUser(ctx, target.ID, users[0].ID)
+			renameErrs[i] = db.SetUsername(ctx, users[i].ID, name)
+		}(i)
+	}
+	wg.Wait()
+	for what, errs := range map[string][]error{"banning": banErrs, "renaming": renameErrs} {
+		succeeded := 0
+		for _, err := range errs {
+			if err == nil {
+				succeeded++
+			} else if !errors.Is(err, database.ErrConflict) {
+				t.Errorf("concurrent %s: got %v, want nil or ErrConflict", what, err)
+			}
+		}
+		if succeeded != 1 {
+			t.Errorf("concurrent %s: %d succeeded, want 1", what, succeeded)
+		}
+	}
+}
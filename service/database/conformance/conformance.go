@@ -0,0 +1,115 @@
+/*
+Package conformance is a suite of checks that every backend of database.AppDatabase must pass. The checks go through
+the AppDatabase interface only, so that the same suite runs against SQLite and PostgreSQL: they cover the behaviour
+the rest of the app relies on, and that depends on the SQL dialect (case-insensitive usernames, conflicts, keyset
+pagination, full-text search, timestamps, transactions).
+
+Each check creates its own users, with random names, so the suite can run on a database that already has data, and
+more than once. Nothing is deleted at the end: run it on a throwaway database.
+
+Example:
+
+	db, err := database.New(dbconn)
+	// ...
+	for _, r := range conformance.Run(context.Background(), db) {
+		fmt.Println(r.Name, r.Passed())
+	}
+
+The cmd/dbconformance executable and `go test` run the suite on a temporary SQLite database (see NewSQLite) and,
+optionally, on PostgreSQL (see NewPostgres).
+*/
+package conformance
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+// Result is the outcome of a check.
+type Result struct {
+	Name     string
+	Failures []string
+	Elapsed  time.Duration
+}
+
+// Passed reports whether the check found no failures.
+func (r Result) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// check is a named part of the suite.
+type check struct {
+	name string
+	run  func(ctx context.Context, t *T, db database.AppDatabase)
+}
+
+// Run executes all the checks on db, in order, and returns their results. The statements of the checks run with ctx.
+func Run(ctx context.Context, db database.AppDatabase) []Result {
+	results := make([]Result, 0, len(checks))
+	for _, c := range checks {
+		t := &T{}
+		start := time.Now()
+		t.run(func() { c.run(ctx, t, db) })
+		results = append(results, Result{Name: c.name, Failures: t.failures, Elapsed: time.Since(start)})
+	}
+	return results
+}
+
+// T records the failures of a check, like testing.T.
+type T struct {
+	failures []string
+}
+
+// fatal is the panic value used by Fatalf to stop the check.
+type fatal struct{}
+
+func (t *T) run(fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(fatal); !ok {
+				t.failures = append(t.failures, fmt.Sprintf("panic: %v", r))
+			}
+		}
+	}()
+	fn()
+}
+
+// Errorf records a failure and lets the check go on.
+func (t *T) Errorf(format string, args ...interface{}) {
+	t.failures = append(t.failures, fmt.Sprintf(format, args...))
+}
+
+// Fatalf records a failure and stops the check, for when the following steps would be meaningless.
+func (t *T) Fatalf(format string, args ...interface{}) {
+	t.Errorf(format, args...)
+	panic(fatal{})
+}
+
+// must stops the check if err is not nil.
+func (t *T) must(err error, what string) {
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+}
+
+// suffix returns a random string to make the names of a check unique.
+func suffix() string {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = letters[int(b[i])%len(letters)]
+	}
+	return string(b)
+}
+
+// now returns the current time, rounded to what every backend stores (microseconds).
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
@@ -0,0 +1,111 @@
+package conformance
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+// TempDatabase is an empty database created to run the suite on, with no migration applied.
+type TempDatabase struct {
+	DB *sql.DB
+
+	// Location tells where the data are: the SQLite file, or the PostgreSQL schema
+	Location string
+
+	// drop deletes the database if keep is false, and releases what was used to create it
+	drop func(keep bool) error
+}
+
+// Close closes the connection and deletes the database.
+func (d *TempDatabase) Close() error {
+	_ = d.DB.Close()
+	return d.drop(false)
+}
+
+// Keep closes the connection and leaves the database at its Location, to look at the data.
+func (d *TempDatabase) Keep() {
+	_ = d.DB.Close()
+	_ = d.drop(true)
+}
+
+// NewSQLite creates an empty SQLite database in a temporary directory.
+func NewSQLite() (*TempDatabase, error) {
+	dir, err := ioutil.TempDir("", "dbconformance")
+	if err != nil {
+		return nil, err
+	}
+	fileName := filepath.Join(dir, "decaf.db")
+	dbconn, err := sql.Open(string(database.SQLite), fileName)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	return &TempDatabase{
+		DB:       dbconn,
+		Location: fileName,
+		drop: func(keep bool) error {
+			if keep {
+				return nil
+			}
+			return os.RemoveAll(dir)
+		},
+	}, nil
+}
+
+// NewPostgres creates a new schema in the PostgreSQL database of dsn, and returns a connection that works in it.
+func NewPostgres(dsn string) (*TempDatabase, error) {
+	admin, err := sql.Open(string(database.Postgres), dsn)
+	if err != nil {
+		return nil, err
+	}
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		_ = admin.Close()
+		return nil, err
+	}
+	schema := "conformance_" + hex.EncodeToString(random)
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		_ = admin.Close()
+		return nil, fmt.Errorf("creating schema %s: %w", schema, err)
+	}
+	dropSchema := func(keep bool) error {
+		defer admin.Close()
+		if keep {
+			return nil
+		}
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			return fmt.Errorf("dropping schema %s: %w", schema, err)
+		}
+		return nil
+	}
+
+	// public stays in the path for the extensions already installed there
+	dbconn, err := sql.Open(string(database.Postgres), withSearchPath(dsn, schema+",public"))
+	if err != nil {
+		_ = dropSchema(false)
+		return nil, err
+	}
+	return &TempDatabase{DB: dbconn, Location: "schema " + schema, drop: dropSchema}, nil
+}
+
+// withSearchPath adds the search_path run-time parameter to dsn, either a URL or a list of key=value pairs.
+func withSearchPath(dsn string, searchPath string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		if u, err := url.Parse(dsn); err == nil {
+			q := u.Query()
+			q.Set("search_path", searchPath)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	return dsn + " search_path=" + searchPath
+}
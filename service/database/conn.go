@@ -0,0 +1,163 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"runtime"
+	"strings"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/metrics"
+)
+
+// dbConn is the connection used by appdbimpl. It rewrites the queries for the dialect of the database (see
+// Dialect.rebind), and times the statements in the metrics, under the name of the function that runs them (usually an
+// AppDatabase method); the statements of the transactions begun with BeginTx are not timed. For Query, the time is until
+// the first row is available; reading the rows is not included.
+//
+// Inside AppDatabase.WithTx, tx is set and every statement runs in that transaction.
+//
+// Only the methods taking a context are offered, so that every statement is cancelled with the request it serves.
+type dbConn struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	dialect Dialect
+
+	// likeSearch is set when the SQLite search index is a plain table, searched with LIKE (see search.go)
+	likeSearch bool
+}
+
+// runner is what runs the statements: *sql.DB or *sql.Tx.
+type runner interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+func (c *dbConn) runner() runner {
+	if c.tx != nil {
+		return c.tx
+	}
+	return c.db
+}
+
+func (c *dbConn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	defer observeQuery(time.Now())
+	return c.runner().ExecContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c *dbConn) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	defer observeQuery(time.Now())
+	return c.runner().QueryContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c *dbConn) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	defer observeQuery(time.Now())
+	return c.runner().QueryRowContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c *dbConn) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return c.runner().PrepareContext(ctx, c.dialect.rebind(query))
+}
+
+func (c *dbConn) PingContext(ctx context.Context) error {
+	return c.db.PingContext(ctx)
+}
+
+// savepoint is the name of the savepoints set by BeginTx. Savepoints with the same name nest: RELEASE and ROLLBACK TO
+// refer to the most recent one.
+const savepoint = "operation"
+
+// BeginTx starts a transaction whose statements are rewritten like the ones of the connection. If ctx is cancelled
+// before the commit, the transaction is rolled back.
+//
+// Inside AppDatabase.WithTx, the transaction is a savepoint of the one of WithTx: Commit releases it, and Rollback
+// undoes only what was done after it. The changes are saved when WithTx commits.
+func (c *dbConn) BeginTx(ctx context.Context) (*dbTx, error) {
+	if c.tx != nil {
+		if _, err := c.tx.ExecContext(ctx, "SAVEPOINT "+savepoint); err != nil {
+			return nil, err
+		}
+		return &dbTx{tx: c.tx, dialect: c.dialect, nested: true}, nil
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &dbTx{tx: tx, dialect: c.dialect}, nil
+}
+
+// dbTx is a transaction of dbConn. Its statements are not timed one by one.
+type dbTx struct {
+	tx      *sql.Tx
+	dialect Dialect
+	nested  bool // whether the transaction is a savepoint, see dbConn.BeginTx
+	done    bool // whether a savepoint was released or rolled back
+}
+
+func (t *dbTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return t.tx.ExecContext(ctx, t.dialect.rebind(query), args...)
+}
+
+func (t *dbTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return t.tx.QueryContext(ctx, t.dialect.rebind(query), args...)
+}
+
+func (t *dbTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return t.tx.QueryRowContext(ctx, t.dialect.rebind(query), args...)
+}
+
+func (t *dbTx) Commit() error {
+	if t.nested {
+		if t.done {
+			return sql.ErrTxDone
+		}
+		_, err := t.tx.Exec("RELEASE SAVEPOINT " + savepoint)
+		t.done = err == nil
+		return err
+	}
+	return t.tx.Commit()
+}
+
+func (t *dbTx) Rollback() error {
+	if t.nested {
+		if t.done {
+			return sql.ErrTxDone
+		}
+		t.done = true
+		// ROLLBACK TO keeps the savepoint: release it too, so that the outer one is the most recent again
+		if _, err := t.tx.Exec("ROLLBACK TO SAVEPOINT " + savepoint); err != nil {
+			return err
+		}
+		_, err := t.tx.Exec("RELEASE SAVEPOINT " + savepoint)
+		return err
+	}
+	return t.tx.Rollback()
+}
+
+// observeQuery records the time since start for the caller of the dbConn method.
+func observeQuery(start time.Time) {
+	elapsed := time.Since(start).Seconds()
+	operation := "unknown"
+	// 0 is observeQuery, 1 is the dbConn method, 2 is its caller
+	if pc, _, _, ok := runtime.Caller(2); ok {
+		operation = operationName(runtime.FuncForPC(pc).Name())
+	}
+	metrics.DBQueryDuration.Observe(elapsed, operation)
+}
+
+// operationName returns the method from a function name: for example, both
+// "database.(*appdbimpl).GetPhoto" and "database.(*appdbimpl).GetPhoto.func1" become "GetPhoto".
+func operationName(function string) string {
+	if i := strings.Index(function, ")."); i >= 0 {
+		function = function[i+2:]
+	} else if i := strings.LastIndex(function, "/"); i >= 0 {
+		function = function[i+1:]
+		function = function[strings.Index(function, ".")+1:]
+	}
+	if i := strings.Index(function, "."); i >= 0 {
+		function = function[:i]
+	}
+	return function
+}
@@ -2,14 +2,17 @@
 Package database is the middleware between the app database and the code. All data (de)serialization (save/load) from a
 persistent database are handled here. Database specific logic should never escape this package.
 
-To use this package you need to apply migrations to the database if needed/wanted, connect to it (using the database
-data source name from config), and then initialize an instance of AppDatabase from the DB connection.
+To use this package you need to connect to the database (using the database data source name from config), apply the
+migrations embedded in this package with Migrate, and then initialize an instance of AppDatabase from the DB connection.
+New refuses to work on a database whose schema is not at the latest version.
 
-For example, this code adds a parameter in `webapi` executable for the database data source name (add it to the
+The connection can use SQLite ("sqlite3" driver) or PostgreSQL ("postgres" driver): see dialect.go. For example,
+this code adds parameters in `webapi` executable for the driver and the database data source name (add them to the
 main.WebAPIConfiguration structure):
 
 	DB struct {
-		Filename string `conf:""`
+		Driver string `conf:"default:sqlite3"`
+		DSN    string `conf:"mask"`
 	}
 
 This is an example on how to migrate the DB and connect to it:
@@ -25,27 +28,57 @@ This is an example on how to migrate the DB and connect to it:
 		logger.Debug("database stopping")
 		_ = db.Close()
 	}()
+	if err := database.Migrate(db); err != nil {
+		logger.WithError(err).Error("error migrating the database")
+		return fmt.Errorf("migrating the database: %w", err)
+	}
 
 Then you can initialize the AppDatabase and pass it to the api package.
+
+Each method of AppDatabase runs on its own. Changes made of several steps, or that depend on what was just read, run
+in one transaction with WithTx, which retries it if a concurrent transaction gets in the way:
+
+	err := db.WithTx(ctx, func(tx database.Tx) error {
+		if err := tx.SetPasswordHash(ctx, userID, hash); err != nil {
+			return err
+		}
+		return tx.RevokeUserSessions(ctx, userID)
+	})
+
+Schema changes are done by adding a new pair of numbered files in the migrations/ directory, and another pair in
+migrations/postgres/; never edit a migration that has already been released. The conformance subpackage checks that
+both backends behave the same.
 */
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 )
 
-type Error struct {
-	Error string `json:"error" db:"error"`
+type User struct {
+	ID           string   `json:"userId" db:"user_id"` // Unique identifier
+	Username     string   `json:"username" db:"username"`
+	PasswordHash string   `json:"-" db:"password_hash"` // Encoded password hash, empty for legacy name-only accounts
+	Private      bool     `json:"-" db:"private"`       // Whether photos and relationship lists need an approved follow
+	Followers    []string `json:"followers"`            // IDs of followers (handled separately in relational mapping)
+	Following    []string `json:"following"`            // IDs of users being followed (handled separately in relational mapping)
+	Photos       []string `json:"photos"`               // IDs of photos uploaded by the user (handled separately in relational mapping)
 }
 
-type User struct {
-	ID        string   `json:"userId" db:"user_id"` // Unique identifier
-	Username  string   `json:"username" db:"username"`
-	Followers []string `json:"followers"` // IDs of followers (handled separately in relational mapping)
-	Following []string `json:"following"` // IDs of users being followed (handled separately in relational mapping)
-	Photos    []string `json:"photos"`    // IDs of photos uploaded by the user (handled separately in relational mapping)
+// UserProfile is a user along with the size of the lists shown in the profile page.
+type UserProfile struct {
+	ID             string `json:"userId"`
+	Username       string `json:"username"`
+	FollowersCount int    `json:"followersCount"` // Number of users following this user
+	FollowingCount int    `json:"followingCount"` // Number of users followed by this user
+	PhotosCount    int    `json:"photosCount"`    // Number of photos uploaded by this user
+	Private        bool   `json:"private"`        // Whether the account is private
+	Visible        bool   `json:"visible"`        // Whether the viewer can see the photos and the relationship lists
+	Requested      bool   `json:"requested"`      // Whether the viewer has a pending follow request for this user
 }
 
 // New Struct for handling followers relationship
@@ -61,11 +94,26 @@ type UserPhoto struct {
 }
 
 type Comment struct {
-	ID        string    `json:"commentId" db:"comment_id"` // Unique identifier
-	UserID    string    `json:"userId" db:"user_id"`       // ID of the user who commented
-	PhotoID   string    `json:"photoId" db:"photo_id"`     // ID of the photo being commented on
-	Content   string    `json:"content" db:"content"`      // The comment itself
-	Timestamp time.Time `json:"timestamp" db:"timestamp"`  // Timestamp of when the comment was made
+	ID           string     `json:"commentId" db:"comment_id"`                        // Unique identifier
+	UserID       string     `json:"userId" db:"user_id"`                              // ID of the user who commented; empty once deleted
+	Username     string     `json:"username"`                                         // Username of the author; empty once deleted
+	PhotoID      string     `json:"photoId" db:"photo_id"`                            // ID of the photo being commented on
+	ParentID     string     `json:"parentCommentId,omitempty" db:"parent_comment_id"` // Comment this one replies to, if any
+	Content      string     `json:"content" db:"content"`                             // The comment itself; empty once deleted
+	Timestamp    time.Time  `json:"timestamp" db:"timestamp"`                         // Timestamp of when the comment was made
+	EditedAt     *time.Time `json:"editedAt,omitempty"`                               // Timestamp of the last edit, if edited
+	Deleted      bool       `json:"deleted"`                                          // Whether this is the tombstone of a deleted comment
+	Hidden       bool       `json:"hidden"`                                           // Whether the owner of the photo hid the comment
+	Mentions     []Mention  `json:"mentions"`                                         // Users mentioned in the content
+	LikesCount   int        `json:"likesCount"`                                       // Number of likes of the comment
+	LikedByMe    bool       `json:"likedByMe"`                                        // Whether the viewer liked the comment
+	RepliesCount int        `json:"repliesCount"`                                     // Number of replies visible to the viewer
+}
+
+// CommentEdit is a previous version of an edited comment.
+type CommentEdit struct {
+	Content   string    `json:"content" db:"content"`      // The comment as it was
+	WrittenAt time.Time `json:"writtenAt" db:"written_at"` // Timestamp of when this version was written
 }
 
 type Like struct {
@@ -75,23 +123,55 @@ type Like struct {
 }
 
 type Photo struct {
-	ID        string    `json:"photoId" db:"photo_id"`     // Unique identifier
-	UserID    string    `json:"userId" db:"user_id"`       // ID of the user who uploaded the photo
-	ImageData []byte    `json:"imageData" db:"image_data"` // The photo data itself
-	Timestamp time.Time `json:"timestamp" db:"timestamp"`  // Timestamp of when the photo was uploaded
-	Likes     []Like    `json:"likes"`                     // Note: This requires a relational mapping and isn't directly mapped to a single column
-	Comments  []Comment `json:"comments"`                  // Note: This requires a relational mapping and isn't directly mapped to a single column
+	ID              string    `json:"photoId" db:"photo_id"`                 // Unique identifier
+	UserID          string    `json:"userId" db:"user_id"`                   // ID of the user who uploaded the photo
+	Images          []Image   `json:"-"`                                     // The images of the photo, in order; see GetPhotoMetadata
+	ImagesCount     int       `json:"imagesCount"`                           // Number of images of the photo
+	Caption         string    `json:"caption" db:"caption"`                  // Text shown with the photo, possibly with hashtags; may be empty
+	CommentsEnabled bool      `json:"commentsEnabled" db:"comments_enabled"` // Whether new comments are allowed
+	Mentions        []Mention `json:"mentions"`                              // Users mentioned in the caption
+	Timestamp       time.Time `json:"timestamp" db:"timestamp"`              // Timestamp of when the photo was uploaded
+	Likes           []Like    `json:"likes"`                                 // Note: This requires a relational mapping and isn't directly mapped to a single column
+	Comments        []Comment `json:"comments"`                              // Note: This requires a relational mapping and isn't directly mapped to a single column
+}
+
+// Image is one of the images of a photo. A photo is a post of up to MaxPhotoImages images, sharing the caption, the
+// likes and the comments.
+type Image struct {
+	Position  int    `json:"position" db:"position"` // Position in the photo, from 0; the first image is the cover
+	ImageKey  string `json:"-" db:"image_key"`       // Key of the image bytes in the blob store
+	ImageType string `json:"-" db:"image_type"`      // Media type of the image, e.g. image/jpeg
 }
 
 type PhotoDetail struct {
-	PhotoID    string    `json:"photoId"`
-	UserID     string    `json:"userId"`
-	Username   string    `json:"username"`
-	ImageData  []byte    `json:"imageData"`
-	Timestamp  time.Time `json:"timestamp"`
-	LikesCount int       `json:"likesCount"`
-	Comments   []Comment `json:"comments"`
+	PhotoID         string    `json:"photoId"`
+	UserID          string    `json:"userId"`
+	Username        string    `json:"username"`
+	Caption         string    `json:"caption"`
+	Mentions        []Mention `json:"mentions"` // Users mentioned in the caption
+	Timestamp       time.Time `json:"timestamp"`
+	CommentsEnabled bool      `json:"commentsEnabled"` // Whether new comments are allowed
+	ImagesCount     int       `json:"imagesCount"`     // Number of images of the photo
+	LikesCount      int       `json:"likesCount"`
+	Comments        []Comment `json:"comments"`               // First page of the threads, see GetCommentsByPhotoId
+	CommentsNext    string    `json:"commentsNext,omitempty"` // Cursor of the next page of threads, or empty
+}
+
+// StreamEntry is a photo of the stream, with everything needed to display it.
+type StreamEntry struct {
+	PhotoID         string    `json:"photoId"`
+	UserID          string    `json:"userId"`
+	Username        string    `json:"username"`        // Username of the author
+	Caption         string    `json:"caption"`         // Caption of the photo, possibly empty
+	Mentions        []Mention `json:"mentions"`        // Users mentioned in the caption
+	Timestamp       time.Time `json:"timestamp"`       // Timestamp of when the photo was uploaded
+	LikesCount      int       `json:"likesCount"`      // Number of likes of the photo
+	LikedByMe       bool      `json:"likedByMe"`       // Whether the viewer liked the photo
+	CommentsCount   int       `json:"commentsCount"`   // Number of comments visible to the viewer
+	CommentsEnabled bool      `json:"commentsEnabled"` // Whether new comments are allowed
+	ImagesCount     int       `json:"imagesCount"`     // Number of images of the photo
 }
+
 type Ban struct {
 	ID         string    `json:"banId" db:"ban_id"`           // Unique identifier
 	BannedBy   string    `json:"bannedBy" db:"banned_by"`     // ID of the user who banned the other user
@@ -99,149 +179,175 @@ type Ban struct {
 	Timestamp  time.Time `json:"timestamp" db:"timestamp"`    // Timestamp of when the ban was made
 }
 
-// AppDatabase is the high level interface for the DB
+type Session struct {
+	ID        string    `json:"sessionId" db:"session_id"` // Unique identifier, embedded in the signed token
+	UserID    string    `json:"userId" db:"user_id"`       // ID of the user who owns the session
+	CreatedAt time.Time `json:"createdAt" db:"created_at"` // Timestamp of when the session was issued
+	ExpiresAt time.Time `json:"expiresAt" db:"expires_at"` // Timestamp after which the session is no longer valid
+	Revoked   bool      `json:"revoked" db:"revoked"`      // Whether the session was revoked (logout)
+}
+
+type PasswordReset struct {
+	TokenHash string    `json:"-" db:"token_hash"`         // SHA-256 of the one-time reset token
+	UserID    string    `json:"userId" db:"user_id"`       // ID of the user the reset was requested for
+	ExpiresAt time.Time `json:"expiresAt" db:"expires_at"` // Timestamp after which the token can't be used
+}
+
+// Notification types
+const (
+	NotificationLike    = "like"
+	NotificationComment = "comment"
+	NotificationFollow  = "follow"
+	NotificationMention = "mention"
+	NotificationReply   = "reply"
+)
+
+type Notification struct {
+	ID            string    `json:"notificationId" db:"notification_id"` // Unique identifier
+	RecipientID   string    `json:"-" db:"recipient_id"`                 // ID of the user the notification is for
+	ActorID       string    `json:"actorId" db:"actor_id"`               // ID of the user who caused the event
+	ActorUsername string    `json:"actorUsername"`                       // Username of the actor
+	Type          string    `json:"type" db:"type"`                      // One of the Notification* constants
+	PhotoID       string    `json:"photoId,omitempty" db:"photo_id"`     // Photo liked, commented or mentioned in, if any
+	CommentID     string    `json:"commentId,omitempty" db:"comment_id"` // Comment added or mentioned in, if any
+	CreatedAt     time.Time `json:"createdAt" db:"created_at"`           // Timestamp of the event
+	Read          bool      `json:"read"`                                // Whether the recipient marked it as read
+}
+
+// AppDatabase is the high level interface for the DB. Every method takes the context of the work it is done for (usually
+// an HTTP request): the queries are cancelled when it ends.
+//
+// Each operation of Tx runs on its own; use WithTx to run several of them in one transaction.
 type AppDatabase interface {
-	GetName() (string, error)
-	SetName(name string) error
-	AddUser(user *User) error
-	Ping() error
-	SetUsername(userId, newUsername string) error
-	GetUserProfile(username string) (*User, error)
-	LikePhoto(userID string, photoID string) error
-	UnlikePhoto(userID string, photoID string) error
-	FollowUser(followerID string, followedID string) error
-	UnfollowUser(followerID string, followedID string) error
-	GetUserIDByUsername(username string) (string, error)
-	GetUserByUsername(username string) (*User, error)
-	GetUser(userID string) (*User, error)
-	AddPhoto(photo Photo) error
-	GetPhotos() ([]Photo, error)
-	BanUser(bannedBy string, bannedUser string) error
-	UnbanUser(bannerID, bannedUserID string) error
-	GetAllUsers(currentUserID string) ([]User, error)
-	GetMyStream(userID string) ([]string, error)
-	DeleteComment(commentID string) error
-	AddComment(comment Comment) error
-	DeletePhoto(photoID string) error
-	GetCommentsByPhotoId(photoId string) ([]Comment, error)
-	GetFollowersByUsername(username string) ([]string, error)
-	GetUserProfileByID(userID string) (*User, error)
-	GetPhoto(photoId, userId string) (*PhotoDetail, error)
-	GetUsername(userID string) (string, error)
-	IsLiked(photoID string, userID string) (bool, error)
-	IsUserFollowed(followerID, followedID string) (bool, error)
-	BanExists(bannedBy, bannedUser string) (bool, error)
-	IsBannedBy(bannedUser, banningUser string) (bool, error)
+	Tx
+	Ping(ctx context.Context) error
+	SchemaVersion(ctx context.Context) (current int, latest int, err error)
+	WithTx(ctx context.Context, fn func(tx Tx) error) error
+	FullTextSearch() bool
+}
+
+// Tx is the set of operations on the data of the app. In the function passed to AppDatabase.WithTx, they all run in
+// the same transaction.
+type Tx interface {
+	GetName(ctx context.Context) (string, error)
+	SetName(ctx context.Context, name string) error
+	AddUser(ctx context.Context, user *User) error
+	SetUsername(ctx context.Context, userId, newUsername string) error
+	GetUserProfile(ctx context.Context, username string) (*User, error)
+	LikePhoto(ctx context.Context, userID string, photoID string) error
+	UnlikePhoto(ctx context.Context, userID string, photoID string) error
+	FollowUser(ctx context.Context, followerID string, followedID string) (bool, error)
+	UnfollowUser(ctx context.Context, followerID string, followedID string) error
+	GetUserIDByUsername(ctx context.Context, username string) (string, error)
+	GetUserByUsername(ctx context.Context, username string) (*User, error)
+	GetUser(ctx context.Context, userID string) (*User, error)
+	AddPhoto(ctx context.Context, photo Photo) ([]string, error)
+	GetPhotos(ctx context.Context, viewerID string, page Page) ([]Photo, string, error)
+	GetUserPhotos(ctx context.Context, userID string, viewerID string, page Page) ([]Photo, string, error)
+	BanUser(ctx context.Context, bannedBy string, bannedUser string) error
+	UnbanUser(ctx context.Context, bannerID, bannedUserID string) error
+	GetAllUsers(ctx context.Context, currentUserID string, page Page) ([]User, string, error)
+	GetMyStream(ctx context.Context, userID string, page Page) ([]StreamEntry, string, error)
+	DeleteComment(ctx context.Context, commentID string) error
+	AddComment(ctx context.Context, comment Comment) ([]string, error)
+	DeletePhoto(ctx context.Context, photoID string) error
+	GetCommentsByPhotoId(ctx context.Context, photoId string, viewerID string, page Page) ([]Comment, string, error)
+	GetFollowersByUsername(ctx context.Context, username string) ([]string, error)
+	GetUserProfileByID(ctx context.Context, userID string, viewerID string) (*UserProfile, error)
+	GetFollowers(ctx context.Context, userID string, viewerID string, page Page) ([]User, string, error)
+	GetFollowing(ctx context.Context, userID string, viewerID string, page Page) ([]User, string, error)
+	GetPhoto(ctx context.Context, photoId, userId string) (*PhotoDetail, error)
+	GetUsername(ctx context.Context, userID string) (string, error)
+	IsLiked(ctx context.Context, photoID string, userID string) (bool, error)
+	IsUserFollowed(ctx context.Context, followerID, followedID string) (bool, error)
+	BanExists(ctx context.Context, bannedBy, bannedUser string) (bool, error)
+	IsBannedBy(ctx context.Context, bannedUser, banningUser string) (bool, error)
+	Blocked(ctx context.Context, userID string, otherID string) (bool, error)
+	UserExists(ctx context.Context, userID string) (bool, error)
+	GetPhotoOwner(ctx context.Context, photoID string) (string, error)
+	GetPhotoMetadata(ctx context.Context, photoID string) (*Photo, error)
+	IsImageKeyUsed(ctx context.Context, imageKey string) (bool, error)
+	MoveImagesToBlobStore(ctx context.Context, put func(imageData []byte) (string, error)) (int, error)
+	GetCommentOwner(ctx context.Context, commentID string) (string, error)
+	GetComment(ctx context.Context, commentID string) (*Comment, error)
+	GetReplies(ctx context.Context, commentID string, viewerID string, page Page) ([]Comment, string, error)
+	LikeComment(ctx context.Context, userID string, commentID string) error
+	UnlikeComment(ctx context.Context, userID string, commentID string) error
+	IsCommentLiked(ctx context.Context, userID string, commentID string) (bool, error)
+	EditComment(ctx context.Context, commentID string, content string, editedAt time.Time) ([]string, error)
+	GetCommentEdits(ctx context.Context, commentID string) ([]CommentEdit, error)
+	SetCommentHidden(ctx context.Context, commentID string, hidden bool, now time.Time) error
+	SetCommentsEnabled(ctx context.Context, photoID string, enabled bool) error
+	AddSession(ctx context.Context, session Session) error
+	GetSession(ctx context.Context, sessionID string) (*Session, error)
+	RevokeSession(ctx context.Context, sessionID string) error
+	RevokeUserSessions(ctx context.Context, userID string) error
+	SetPasswordHash(ctx context.Context, userID, passwordHash string) error
+	SetFirstPasswordHash(ctx context.Context, userID, passwordHash string) error
+	AddPasswordReset(ctx context.Context, reset PasswordReset) error
+	ConsumePasswordReset(ctx context.Context, tokenHash string) (string, error)
+	AddNotification(ctx context.Context, n Notification) (bool, error)
+	DeleteNotifications(ctx context.Context, filter Notification) error
+	GetNotifications(ctx context.Context, recipientID string, page Page) ([]Notification, string, error)
+	CountUnreadNotifications(ctx context.Context, recipientID string) (int, error)
+	SetNotificationRead(ctx context.Context, recipientID string, notificationID string, read bool, now time.Time) error
+	SetAllNotificationsRead(ctx context.Context, recipientID string, read bool, now time.Time) error
+	SetPrivate(ctx context.Context, userID string, private bool) error
+	CanView(ctx context.Context, viewerID string, ownerID string) (bool, error)
+	GetFollowRequests(ctx context.Context, userID string, page Page) ([]User, string, error)
+	ApproveFollowRequest(ctx context.Context, userID string, requesterID string) error
+	DeleteFollowRequest(ctx context.Context, userID string, requesterID string) error
+	SearchUsers(ctx context.Context, query string, viewerID string, page Page) ([]User, string, error)
+	SearchPhotos(ctx context.Context, query string, viewerID string, page Page) ([]Photo, string, error)
+	SetCaption(ctx context.Context, photoID string, caption string) ([]string, error)
+	GetTagPhotos(ctx context.Context, tag string, viewerID string, page Page) ([]Photo, string, error)
+	GetTrendingTags(ctx context.Context, since time.Time, viewerID string, limit int) ([]TrendingTag, error)
 }
 type appdbimpl struct {
-	c *sql.DB
+	c *dbConn
 }
 
-// New returns a new instance of AppDatabase based on the SQLite connection `db`.
-// `db` is required - an error will be returned if `db` is `nil`.
+// New returns a new instance of AppDatabase based on the connection `db`, opened with one of the drivers listed in
+// dialect.go. `db` is required - an error will be returned if `db` is `nil`.
 func New(db *sql.DB) (AppDatabase, error) {
 	if db == nil {
 		return nil, errors.New("database is required when building a AppDatabase")
 	}
-
-	// Error table
-	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS errors (
-        error TEXT
-    );`)
-	if err != nil {
-		return nil, err
-	}
-
-	// Users table
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
-        user_id TEXT PRIMARY KEY,
-        username TEXT UNIQUE NOT NULL
-    );`)
+	dialect, err := DialectOf(db)
 	if err != nil {
 		return nil, err
 	}
 
-	// Followers table
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS followers (
-        user_id TEXT NOT NULL,
-        follower_id TEXT NOT NULL,
-        PRIMARY KEY (user_id, follower_id),
-        FOREIGN KEY (user_id) REFERENCES users(user_id),
-        FOREIGN KEY (follower_id) REFERENCES users(user_id)
-    );`)
-	if err != nil {
+	// The schema is managed by the migrations (see migrations.go), which must be applied before this point
+	if err := checkSchemaVersion(db); err != nil {
 		return nil, err
 	}
-
-	// User Photos table
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS user_photos (
-        user_id TEXT NOT NULL,
-        photo_id TEXT NOT NULL,
-        PRIMARY KEY (user_id, photo_id),
-        FOREIGN KEY (user_id) REFERENCES users(user_id),
-        FOREIGN KEY (photo_id) REFERENCES new_photos(photo_id)
-    );`)
-	if err != nil {
-		return nil, err
+	c := &dbConn{db: db, dialect: dialect}
+	if dialect == SQLite {
+		if c.likeSearch, err = likeSearch(db); err != nil {
+			return nil, err
+		}
 	}
 
-	// Comment table
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS comments (
-        comment_id TEXT PRIMARY KEY,
-        user_id TEXT NOT NULL,
-        photo_id TEXT NOT NULL,
-        content TEXT NOT NULL,
-        timestamp DATETIME NOT NULL,
-        FOREIGN KEY (user_id) REFERENCES users(user_id),
-        FOREIGN KEY (photo_id) REFERENCES new_photos(photo_id)
-    );`)
-	if err != nil {
-		return nil, err
-	}
+	return &appdbimpl{c: c}, nil
+}
 
-	// Like table
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS likes (
-        user_id TEXT NOT NULL,
-        photo_id TEXT NOT NULL,
-        timestamp DATETIME NOT NULL,
-        PRIMARY KEY (user_id, photo_id),
-        FOREIGN KEY (user_id) REFERENCES users(user_id),
-        FOREIGN KEY (photo_id) REFERENCES new_photos(photo_id)
-    );`)
-	if err != nil {
-		return nil, err
-	}
+func (db *appdbimpl) Ping(ctx context.Context) error {
+	return db.c.PingContext(ctx)
+}
 
-	// Photo table
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS new_photos (
-        photo_id TEXT PRIMARY KEY,
-        user_id TEXT NOT NULL,
-		image_data BLOB,
-        timestamp DATETIME NOT NULL,
-        FOREIGN KEY (user_id) REFERENCES users(user_id)
-    );`)
+// SchemaVersion returns the version of the last migration applied to the database, and the latest version known by
+// this executable.
+func (db *appdbimpl) SchemaVersion(ctx context.Context) (int, int, error) {
+	latest, err := LatestVersion(db.c.dialect)
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
-
-	// Ban table
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS new_bans (
-        ban_id TEXT PRIMARY KEY,
-        banned_by TEXT NOT NULL,
-        banned_user TEXT NOT NULL,
-        timestamp DATETIME NOT NULL,
-        FOREIGN KEY (banned_by) REFERENCES users(user_id),
-        FOREIGN KEY (banned_user) REFERENCES users(user_id)
-    );`)
+	// The schema_version table exists: New checked the version
+	var current int
+	err = db.c.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current)
 	if err != nil {
-		return nil, err
+		return 0, 0, fmt.Errorf("reading schema version: %w", err)
 	}
-
-	return &appdbimpl{
-		c: db,
-	}, nil
-}
-
-func (db *appdbimpl) Ping() error {
-	return db.c.Ping()
+	return current, latest, nil
 }
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Queries are written once, in the SQL understood by both SQLite and PostgreSQL, with "?" placeholders. The few
+// differences left (placeholders, case-insensitive comparisons, full-text search, schema) are handled by the Dialect of
+// the connection.
+
+// Dialect is the SQL flavour of a database. Its value is the name of the database/sql driver.
+type Dialect string
+
+const (
+	// SQLite is the dialect of the "sqlite3" driver (github.com/mattn/go-sqlite3)
+	SQLite Dialect = "sqlite3"
+
+	// Postgres is the dialect of the "postgres" driver (github.com/lib/pq)
+	Postgres Dialect = "postgres"
+)
+
+// DialectOf returns the dialect of the database behind db, from its driver.
+func DialectOf(db *sql.DB) (Dialect, error) {
+	switch db.Driver().(type) {
+	case *sqlite3.SQLiteDriver:
+		return SQLite, nil
+	case *pq.Driver:
+		return Postgres, nil
+	default:
+		return "", fmt.Errorf("unsupported database driver %T", db.Driver())
+	}
+}
+
+// rebind rewrites the "?" placeholders of query in the syntax of the dialect: PostgreSQL numbers them ($1, $2, ...).
+// Question marks inside string literals are left alone.
+func (d Dialect) rebind(query string) string {
+	if d != Postgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n := 0
+	quoted := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// caseless returns expr in a form that sorts and compares ignoring the case of ASCII letters.
+func (d Dialect) caseless(expr string) string {
+	if d == Postgres {
+		return "LOWER(" + expr + ")"
+	}
+	return expr + " COLLATE NOCASE"
+}
+
+// equalsCaseless returns the condition comparing column with a "?" parameter, ignoring case.
+func (d Dialect) equalsCaseless(column string) string {
+	if d == Postgres {
+		return "LOWER(" + column + ") = LOWER(?)"
+	}
+	return column + " = ? COLLATE NOCASE"
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Methods wrap these errors (e.g., fmt.Errorf("username %q: %w", name, ErrConflict)) when the operation fails for a
+// reason the caller can act upon. Callers check them with errors.Is; any other error is a failure of the database.
+var (
+	// ErrNotFound is returned when the requested item does not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is returned when the change clashes with the existing data, e.g. a username that is already taken
+	ErrConflict = errors.New("conflict")
+
+	// ErrForbidden is returned when the operation is not allowed, e.g. viewing a photo of a private account
+	ErrForbidden = errors.New("forbidden")
+)
+
+// isUniqueViolation reports whether err is caused by a UNIQUE or PRIMARY KEY constraint.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" // unique_violation
+	}
+	return false
+}
+
+// isRetryable reports whether err is caused by a concurrent transaction, so that running the transaction again may
+// succeed: the database is locked (SQLite), or a serialization failure or a deadlock (PostgreSQL).
+func isRetryable(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "40001" || pqErr.Code == "40P01" // serialization_failure, deadlock_detected
+	}
+	return false
+}
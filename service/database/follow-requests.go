@@ -0,0 +1,169 @@
+package database
+
+// Private accounts and follow requests are handled here
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// SetPrivate changes the privacy setting of userID. Making the account public approves all the pending follow
+// requests, since anyone can follow it from then on.
+func (db *appdbimpl) SetPrivate(ctx context.Context, userID string, private bool) error {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("tx.Rollback failed: %v", rbErr)
+			}
+		}
+	}()
+
+	res, err := tx.ExecContext(ctx, "UPDATE users SET private = ? WHERE user_id = ?", private, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update privacy: %w", err)
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update privacy: %w", err)
+	}
+	if updated == 0 {
+		err = fmt.Errorf("user %s: %w", userID, ErrNotFound)
+		return err
+	}
+
+	if !private {
+		if _, err = tx.ExecContext(ctx, `INSERT INTO followers (user_id, follower_id)
+			SELECT user_id, requester_id FROM follow_requests WHERE user_id = ?
+			ON CONFLICT DO NOTHING`, userID); err != nil {
+			return fmt.Errorf("failed to approve follow requests: %w", err)
+		}
+		if _, err = tx.ExecContext(ctx, "DELETE FROM follow_requests WHERE user_id = ?", userID); err != nil {
+			return fmt.Errorf("failed to delete follow requests: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CanView reports whether viewerID can see the photos and the relationship lists of ownerID: the account is public,
+// viewerID follows it, or it is their own. It returns ErrNotFound if ownerID doesn't exist. Bans are not considered.
+func (db *appdbimpl) CanView(ctx context.Context, viewerID string, ownerID string) (bool, error) {
+	var visible bool
+	err := db.c.QueryRowContext(ctx, `SELECT `+visibleTo("u.user_id")+` FROM users u WHERE u.user_id = ?`,
+		viewerID, viewerID, ownerID).Scan(&visible)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, fmt.Errorf("user %s: %w", ownerID, ErrNotFound)
+	} else if err != nil {
+		return false, fmt.Errorf("failed to check visibility: %w", err)
+	}
+	return visible, nil
+}
+
+// GetFollowRequests returns a page of the users waiting for userID to approve their follow, sorted by username, and
+// the cursor of the next page.
+func (db *appdbimpl) GetFollowRequests(ctx context.Context, userID string, page Page) ([]User, string, error) {
+	return db.getUserPage(ctx, `
+		SELECT u.user_id, u.username
+		FROM follow_requests r
+		JOIN users u ON u.user_id = r.requester_id
+		WHERE r.user_id = ?`, []interface{}{userID}, page)
+}
+
+// ApproveFollowRequest turns the pending request of requesterID into a follow of userID. It returns ErrNotFound if
+// there is no such request.
+func (db *appdbimpl) ApproveFollowRequest(ctx context.Context, userID string, requesterID string) error {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("tx.Rollback failed: %v", rbErr)
+			}
+		}
+	}()
+
+	if err = deleteFollowRequest(ctx, tx, userID, requesterID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `INSERT INTO followers (user_id, follower_id) VALUES (?, ?) ON CONFLICT DO NOTHING`,
+		userID, requesterID); err != nil {
+		return fmt.Errorf("failed to add follower: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteFollowRequest removes the pending request of requesterID to follow userID, either denied by userID or
+// withdrawn by requesterID. It returns ErrNotFound if there is no such request.
+func (db *appdbimpl) DeleteFollowRequest(ctx context.Context, userID string, requesterID string) error {
+	return deleteFollowRequest(ctx, db.c, userID, requesterID)
+}
+
+// addFollowRequest stores the request of requesterID to follow userID. It returns ErrConflict if requesterID already
+// follows userID, or already asked to.
+func addFollowRequest(ctx context.Context, tx *dbTx, userID string, requesterID string) error {
+	var following bool
+	err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM followers WHERE user_id = ? AND follower_id = ?)`,
+		userID, requesterID).Scan(&following)
+	if err != nil {
+		return fmt.Errorf("error checking follow: %w", err)
+	}
+	if following {
+		return fmt.Errorf("user %s already follows %s: %w", requesterID, userID, ErrConflict)
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO follow_requests (user_id, requester_id, created_at) VALUES (?, ?, ?)`,
+		userID, requesterID, globaltime.Now().UTC())
+	if isUniqueViolation(err) {
+		return fmt.Errorf("user %s already asked to follow %s: %w", requesterID, userID, ErrConflict)
+	} else if err != nil {
+		return fmt.Errorf("error adding follow request: %w", err)
+	}
+	return nil
+}
+
+// execer is implemented by both *dbConn and *dbTx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func deleteFollowRequest(ctx context.Context, e execer, userID string, requesterID string) error {
+	res, err := e.ExecContext(ctx, "DELETE FROM follow_requests WHERE user_id = ? AND requester_id = ?", userID, requesterID)
+	if err != nil {
+		return fmt.Errorf("failed to delete follow request: %w", err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete follow request: %w", err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("follow request of %s to %s: %w", requesterID, userID, ErrNotFound)
+	}
+	return nil
+}
+
+// visibleTo returns the SQL condition that is true when the viewer can see the photos and the relationship lists of
+// the user in ownerColumn (see CanView). ownerColumn must be qualified with its table. The condition takes the ID of
+// the viewer twice as arguments.
+func visibleTo(ownerColumn string) string {
+	return fmt.Sprintf(`(%[1]s = ?
+		OR NOT (SELECT vu.private FROM users vu WHERE vu.user_id = %[1]s)
+		OR EXISTS (SELECT 1 FROM followers vf WHERE vf.user_id = %[1]s AND vf.follower_id = ?))`, ownerColumn)
+}
@@ -1,40 +1,86 @@
 package database
 
 import (
+	"context"
 	"fmt"
 )
 
-func (db *appdbimpl) LikePhoto(userID string, photoID string) error {
-	// Check if the like already exists to avoid duplicates
-	var exists bool
-	err := db.c.QueryRow("SELECT EXISTS(SELECT 1 FROM likes WHERE user_id = ? AND photo_id = ?)", userID, photoID).Scan(&exists)
+// LikePhoto adds the like of userID to the photo. It returns ErrNotFound if the photo doesn't exist or a ban separates
+// userID from its owner, and ErrConflict if the photo is already liked.
+func (db *appdbimpl) LikePhoto(ctx context.Context, userID string, photoID string) error {
+	// The ban check is part of the INSERT, so that a ban made at the same time can't be missed
+	res, err := db.c.ExecContext(ctx, `INSERT INTO likes (user_id, photo_id, timestamp)
+		SELECT ?, p.photo_id, CURRENT_TIMESTAMP FROM new_photos p
+		WHERE p.photo_id = ? AND `+notBlocked("p.user_id", "?"), userID, photoID, userID)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("photo %s already liked: %w", photoID, ErrConflict)
+	} else if err != nil {
+		return fmt.Errorf("failed to execute insert statement: %w", err)
+	}
+	added, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to execute insert statement: %w", err)
+	}
+	if added == 0 {
+		return fmt.Errorf("photo %s: %w", photoID, ErrNotFound)
+	}
+	return nil
+}
+
+func (db *appdbimpl) UnlikePhoto(ctx context.Context, userID string, photoID string) error {
+	// Delete the like from the database
+	_, err := db.c.ExecContext(ctx, "DELETE FROM likes WHERE user_id = ? AND photo_id = ?", userID, photoID)
 	if err != nil {
-		return fmt.Errorf("query error: %w", err)
+		return fmt.Errorf("failed to execute delete statement: %w", err)
 	}
-	if exists {
-		return fmt.Errorf("like already exists")
+	return nil
+}
+
+func (db *appdbimpl) IsLiked(ctx context.Context, userID string, photoID string) (bool, error) {
+	var exists bool
+	err := db.c.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM likes WHERE user_id = ? AND photo_id = ?)", userID, photoID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("query error: %w", err)
 	}
+	return exists, nil
+}
 
-	// Insert the like into the database
-	_, err = db.c.Exec("INSERT INTO likes (user_id, photo_id, timestamp) VALUES (?, ?, CURRENT_TIMESTAMP)", userID, photoID)
+// LikeComment adds the like of userID to the comment. It returns ErrNotFound if the comment doesn't exist or was
+// deleted, or a ban separates userID from its author or from the owner of the photo, and ErrConflict if the comment is
+// already liked.
+func (db *appdbimpl) LikeComment(ctx context.Context, userID string, commentID string) error {
+	res, err := db.c.ExecContext(ctx, `INSERT INTO comment_likes (user_id, comment_id, timestamp)
+		SELECT ?, c.comment_id, CURRENT_TIMESTAMP FROM comments c
+		JOIN new_photos p ON p.photo_id = c.photo_id
+		WHERE c.comment_id = ? AND c.deleted_at IS NULL
+			AND `+notBlocked("c.user_id", "?")+` AND `+notBlocked("p.user_id", "?"), userID, commentID, userID, userID)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("comment %s already liked: %w", commentID, ErrConflict)
+	} else if err != nil {
+		return fmt.Errorf("failed to execute insert statement: %w", err)
+	}
+	added, err := res.RowsAffected()
 	if err != nil {
 		return fmt.Errorf("failed to execute insert statement: %w", err)
 	}
+	if added == 0 {
+		return fmt.Errorf("comment %s: %w", commentID, ErrNotFound)
+	}
 	return nil
 }
 
-func (db *appdbimpl) UnlikePhoto(userID string, photoID string) error {
-	// Delete the like from the database
-	_, err := db.c.Exec("DELETE FROM likes WHERE user_id = ? AND photo_id = ?", userID, photoID)
+func (db *appdbimpl) UnlikeComment(ctx context.Context, userID string, commentID string) error {
+	_, err := db.c.ExecContext(ctx, "DELETE FROM comment_likes WHERE user_id = ? AND comment_id = ?", userID, commentID)
 	if err != nil {
 		return fmt.Errorf("failed to execute delete statement: %w", err)
 	}
 	return nil
 }
 
-func (db *appdbimpl) IsLiked(userID string, photoID string) (bool, error) {
+func (db *appdbimpl) IsCommentLiked(ctx context.Context, userID string, commentID string) (bool, error) {
 	var exists bool
-	err := db.c.QueryRow("SELECT EXISTS(SELECT 1 FROM likes WHERE user_id = ? AND photo_id = ?)", userID, photoID).Scan(&exists)
+	err := db.c.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM comment_likes WHERE user_id = ? AND comment_id = ?)",
+		userID, commentID).Scan(&exists)
 	if err != nil {
 		return false, fmt.Errorf("query error: %w", err)
 	}
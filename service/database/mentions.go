@@ -0,0 +1,183 @@
+package database
+
+// Mentions are handled here. Like tags, the mentions of a text are derived from it in the same transaction that saves
+// it. The username is read along with the mention, so links keep working after a rename even though the text still
+// holds the old name.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Texts that can contain mentions, stored in mentions.source
+const (
+	mentionInComment = "comment"
+	mentionInCaption = "caption"
+)
+
+// maxMentions is the maximum number of mentions stored for a text; further ones are plain text.
+const maxMentions = 20
+
+// mentionPattern matches a mention in a text: an "@" not glued to a preceding word, followed by letters, digits and
+// underscores. The "@username" text is the first group. Usernames with other characters can't be mentioned.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@])(@[\p{L}\p{N}_]+)`)
+
+// Mention is a user mentioned with "@username" in a text. Start and Length locate the "@username" text, in characters
+// (Unicode code points). Username is the current name of the user, which is not the one in the text if they changed it
+// since.
+type Mention struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+	Start    int    `json:"start"`
+	Length   int    `json:"length"`
+}
+
+// setMentions replaces the mentions of the text with the "@username" in it, resolved against the users (ignoring
+// case). Names of no user, and users separated from authorID by a ban, are left as plain text. It returns the IDs of
+// the users that the text didn't mention before.
+func setMentions(ctx context.Context, tx *dbTx, source string, sourceID string, authorID string,
+	text string) ([]string, error) {
+	previous, err := mentionedUsers(ctx, tx, source, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM mentions WHERE source = ? AND source_id = ?", source, sourceID); err != nil {
+		return nil, fmt.Errorf("failed to delete mentions: %w", err)
+	}
+
+	added := []string{}
+	count := 0
+	for _, match := range mentionPattern.FindAllStringSubmatchIndex(text, -1) {
+		if count == maxMentions {
+			break
+		}
+		start, end := match[2], match[3]
+		var userID string
+		err := tx.QueryRowContext(ctx, `SELECT user_id FROM users WHERE `+tx.dialect.equalsCaseless("username")+` AND `+
+			notBlocked("users.user_id", "?"),
+			text[start+1:end], authorID).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to resolve mention: %w", err)
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT INTO mentions (source, source_id, user_id, start, length) VALUES (?, ?, ?, ?, ?)`,
+			source, sourceID, userID, utf8.RuneCountInString(text[:start]), utf8.RuneCountInString(text[start:end]),
+		); err != nil {
+			return nil, fmt.Errorf("failed to add mention: %w", err)
+		}
+		count++
+		if !previous[userID] {
+			previous[userID] = true
+			added = append(added, userID)
+		}
+	}
+	return added, nil
+}
+
+// mentionedUsers returns the set of the users mentioned by the text.
+func mentionedUsers(ctx context.Context, tx *dbTx, source string, sourceID string) (map[string]bool, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT user_id FROM mentions WHERE source = ? AND source_id = ?", source, sourceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query mentions: %w", err)
+	}
+	defer rows.Close()
+
+	users := map[string]bool{}
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("failed to scan mention: %w", err)
+		}
+		users[userID] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+	return users, nil
+}
+
+// getMentions returns the mentions of the given texts, by text ID, in order of appearance. Mentions of users separated
+// from viewerID by a ban are left out: the client shows them as plain text.
+func (db *appdbimpl) getMentions(ctx context.Context, source string, sourceIDs []string,
+	viewerID string) (map[string][]Mention, error) {
+	mentions := map[string][]Mention{}
+	if len(sourceIDs) == 0 {
+		return mentions, nil
+	}
+	args := []interface{}{source}
+	for _, id := range sourceIDs {
+		args = append(args, id)
+	}
+	args = append(args, viewerID)
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT m.source_id, m.user_id, u.username, m.start, m.length
+		FROM mentions m
+		JOIN users u ON u.user_id = m.user_id
+		WHERE m.source = ? AND m.source_id IN (?`+strings.Repeat(", ?", len(sourceIDs)-1)+`)
+			AND `+notBlocked("m.user_id", "?")+`
+		ORDER BY m.source_id, m.start`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query mentions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sourceID string
+		var m Mention
+		if err := rows.Scan(&sourceID, &m.UserID, &m.Username, &m.Start, &m.Length); err != nil {
+			return nil, fmt.Errorf("failed to scan mention: %w", err)
+		}
+		mentions[sourceID] = append(mentions[sourceID], m)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+	return mentions, nil
+}
+
+// addCaptionMentions sets the Mentions of the photos.
+func (db *appdbimpl) addCaptionMentions(ctx context.Context, photos []Photo, viewerID string) error {
+	ids := make([]string, len(photos))
+	for i, photo := range photos {
+		ids[i] = photo.ID
+	}
+	mentions, err := db.getMentions(ctx, mentionInCaption, ids, viewerID)
+	if err != nil {
+		return err
+	}
+	for i := range photos {
+		photos[i].Mentions = orEmpty(mentions[photos[i].ID])
+	}
+	return nil
+}
+
+// addCommentMentions sets the Mentions of the comments.
+func (db *appdbimpl) addCommentMentions(ctx context.Context, comments []Comment, viewerID string) error {
+	ids := make([]string, len(comments))
+	for i, comment := range comments {
+		ids[i] = comment.ID
+	}
+	mentions, err := db.getMentions(ctx, mentionInComment, ids, viewerID)
+	if err != nil {
+		return err
+	}
+	for i := range comments {
+		comments[i].Mentions = orEmpty(mentions[comments[i].ID])
+	}
+	return nil
+}
+
+// orEmpty returns an empty slice in place of nil, so that it is encoded as [] in JSON.
+func orEmpty(mentions []Mention) []Mention {
+	if mentions == nil {
+		return []Mention{}
+	}
+	return mentions
+}
@@ -0,0 +1,395 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// migrationFiles contains the schema migrations. Each migration is a pair of files named
+// "<version>_<name>.up.sql" and "<version>_<name>.down.sql", where version is a positive number. The migrations of
+// SQLite are in migrations/, the ones of PostgreSQL in migrations/postgres/: each dialect has its own history, which
+// starts over from version 1.
+//
+// A SQLite migration can also have a "<version>_<name>.nofts5.up.sql" file, applied instead of the up file when the
+// SQLite library has no FTS5 (see search.go).
+//
+//go:embed migrations/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+// migrationsDir returns the directory of migrationFiles with the migrations of the dialect.
+func migrationsDir(dialect Dialect) string {
+	if dialect == Postgres {
+		return "migrations/postgres"
+	}
+	return "migrations"
+}
+
+// migrationLockID is the key of the PostgreSQL advisory lock held while migrating, so that replicas starting together
+// don't apply the same migration twice.
+const migrationLockID = 0x64656361660001
+
+// downChecks are the preconditions of the rollbacks that would lose data, by dialect and version. A check runs in the
+// transaction of the rollback and refuses it by returning an error.
+var downChecks = map[Dialect]map[int]func(tx *sql.Tx) error{
+	SQLite: {4: checkImagesInDatabase},
+}
+
+// checkImagesInDatabase refuses to roll back the image keys (0004) while some photos have their image only in the blob
+// store: without the key they would lose it.
+func checkImagesInDatabase(tx *sql.Tx) error {
+	var photos int
+	err := tx.QueryRow("SELECT COUNT(*) FROM new_photos WHERE image_data IS NULL AND image_key IS NOT NULL").Scan(&photos)
+	if err != nil {
+		return fmt.Errorf("counting the photos in the blob store: %w", err)
+	}
+	if photos > 0 {
+		return fmt.Errorf("%d photos have their image only in the blob store: copy the images back to image_data first",
+			photos)
+	}
+	return nil
+}
+
+// Migration is a numbered schema change that can be applied (Up) and rolled back (Down). UpNoFTS5, if not empty,
+// replaces Up on SQLite without FTS5.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	UpNoFTS5 string
+	Down     string
+}
+
+// MigrationState describes a migration and whether it has been applied to the database.
+type MigrationState struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrations returns the embedded migrations of the dialect, sorted by version.
+func Migrations(dialect Dialect) ([]Migration, error) {
+	dir := migrationsDir(dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading migrations: %w", err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			// The migrations of another dialect
+			continue
+		}
+		fileName := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file %q", fileName)
+		}
+
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		noFTS5 := direction == "up" && strings.HasSuffix(base, ".nofts5")
+		base = strings.TrimSuffix(base, ".nofts5")
+		sep := strings.Index(base, "_")
+		if sep <= 0 {
+			return nil, fmt.Errorf("migration file %q has no version prefix", fileName)
+		}
+		version, err := strconv.Atoi(base[:sep])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration file %q has an invalid version", fileName)
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join(dir, fileName))
+		if err != nil {
+			return nil, fmt.Errorf("reading migration %q: %w", fileName, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: base[sep+1:]}
+			byVersion[version] = m
+		} else if m.Name != base[sep+1:] {
+			return nil, fmt.Errorf("migration %d has two names: %q and %q", version, m.Name, base[sep+1:])
+		}
+		if noFTS5 {
+			m.UpNoFTS5 = string(content)
+		} else if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be consecutive, found %d after %d", m.Version, i)
+		}
+	}
+	return migrations, nil
+}
+
+// LatestVersion returns the version of the newest embedded migration of the dialect.
+func LatestVersion(dialect Dialect) (int, error) {
+	migrations, err := Migrations(dialect)
+	if err != nil {
+		return 0, err
+	}
+	return len(migrations), nil
+}
+
+// SchemaVersion returns the version of the last migration applied to the database, or 0 for an empty database.
+func SchemaVersion(db *sql.DB) (int, error) {
+	dialect, err := DialectOf(db)
+	if err != nil {
+		return 0, err
+	}
+	if err := createSchemaVersionTable(db, dialect); err != nil {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("reading schema version: %w", err)
+	}
+	return version, nil
+}
+
+// MigrationStatus lists all embedded migrations along with their state in the database.
+func MigrationStatus(db *sql.DB) ([]MigrationState, error) {
+	dialect, err := DialectOf(db)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := Migrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+	if err := createSchemaVersionTable(db, dialect); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, fmt.Errorf("reading applied migrations: %w", err)
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("reading applied migrations: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading applied migrations: %w", err)
+	}
+
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.Version]
+		states = append(states, MigrationState{Migration: m, Applied: ok, AppliedAt: appliedAt})
+	}
+	return states, nil
+}
+
+// Migrate applies all pending migrations.
+func Migrate(db *sql.DB) error {
+	dialect, err := DialectOf(db)
+	if err != nil {
+		return err
+	}
+	latest, err := LatestVersion(dialect)
+	if err != nil {
+		return err
+	}
+	return MigrateTo(db, latest)
+}
+
+// MigrateTo applies or rolls back migrations until the schema is at the given version. Each migration runs in its own
+// transaction, together with the update of the schema_version table.
+func MigrateTo(db *sql.DB, target int) error {
+	dialect, err := DialectOf(db)
+	if err != nil {
+		return err
+	}
+	migrations, err := Migrations(dialect)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockMigrations(db, dialect)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if target < 0 || target > len(migrations) {
+		return fmt.Errorf("unknown schema version %d (latest is %d)", target, len(migrations))
+	}
+
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this executable (latest is %d)", current, len(migrations))
+	}
+
+	fts5 := true
+	if current < target && dialect == SQLite {
+		if fts5, err = hasFTS5(db); err != nil {
+			return err
+		}
+	}
+	for current < target {
+		m := migrations[current]
+		script := m.Up
+		if !fts5 && m.UpNoFTS5 != "" {
+			script = m.UpNoFTS5
+		}
+		if err := runMigration(db, nil, script, dialect.rebind("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)"),
+			m.Version, m.Name, globaltime.Now().UTC()); err != nil {
+			return fmt.Errorf("applying migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		current++
+	}
+	for current > target {
+		m := migrations[current-1]
+		check := downChecks[dialect][m.Version]
+		if err := runMigration(db, check, m.Down, dialect.rebind("DELETE FROM schema_version WHERE version = ?"), m.Version); err != nil {
+			return fmt.Errorf("rolling back migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		current--
+	}
+	return nil
+}
+
+// runMigration executes a migration script and the bookkeeping statement in a single transaction. If check is not nil,
+// it runs first, in the same transaction, and its error stops the migration.
+func runMigration(db *sql.DB, check func(tx *sql.Tx) error, script string, bookkeeping string, args ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("tx.Rollback failed: %v", rbErr)
+			}
+		}
+	}()
+
+	if check != nil {
+		if err = check(tx); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.Exec(script); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(bookkeeping, args...); err != nil {
+		return err
+	}
+	err = tx.Commit()
+	return err
+}
+
+// lockMigrations makes the other processes migrating the same database wait until the returned function is called.
+// Only PostgreSQL needs it: SQLite databases are not shared, and a writer already locks the whole file.
+func lockMigrations(db *sql.DB, dialect Dialect) (func(), error) {
+	if dialect != Postgres {
+		return func() {}, nil
+	}
+	// Advisory locks belong to the session: the lock is taken and released on a connection of its own
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("locking the migrations: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("locking the migrations: %w", err)
+	}
+	return func() {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID); err != nil {
+			log.Printf("unlocking the migrations failed: %v", err)
+		}
+		_ = conn.Close()
+	}, nil
+}
+
+func createSchemaVersionTable(db *sql.DB, dialect Dialect) error {
+	timestampType := "DATETIME"
+	if dialect == Postgres {
+		timestampType = "TIMESTAMPTZ"
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at ` + timestampType + ` NOT NULL
+    );`)
+	if err != nil {
+		return fmt.Errorf("creating schema_version table: %w", err)
+	}
+	return nil
+}
+
+// checkSchemaVersion returns an error if the database is not at the latest schema version.
+func checkSchemaVersion(db *sql.DB) error {
+	dialect, err := DialectOf(db)
+	if err != nil {
+		return err
+	}
+	latest, err := LatestVersion(dialect)
+	if err != nil {
+		return err
+	}
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current != latest {
+		return fmt.Errorf("database schema is at version %d, expected %d: run the migrations first", current, latest)
+	}
+	return nil
+}
+
+// ErrNoMigrations is returned by Rollback when there is nothing to roll back.
+var ErrNoMigrations = errors.New("no migrations applied")
+
+// Rollback rolls back the last applied migration.
+func Rollback(db *sql.DB) error {
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		return ErrNoMigrations
+	}
+	return MigrateTo(db, current-1)
+}
@@ -0,0 +1,8 @@
+DROP TABLE new_bans;
+DROP TABLE new_photos;
+DROP TABLE likes;
+DROP TABLE comments;
+DROP TABLE user_photos;
+DROP TABLE followers;
+DROP TABLE users;
+DROP TABLE errors;
@@ -0,0 +1,63 @@
+-- Schema as it was before migrations were introduced. Tables are created only if missing, so that databases created
+-- by older versions are adopted as they are.
+
+CREATE TABLE IF NOT EXISTS errors (
+    error TEXT
+);
+
+CREATE TABLE IF NOT EXISTS users (
+    user_id TEXT PRIMARY KEY,
+    username TEXT UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS followers (
+    user_id TEXT NOT NULL,
+    follower_id TEXT NOT NULL,
+    PRIMARY KEY (user_id, follower_id),
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    FOREIGN KEY (follower_id) REFERENCES users(user_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_photos (
+    user_id TEXT NOT NULL,
+    photo_id TEXT NOT NULL,
+    PRIMARY KEY (user_id, photo_id),
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    FOREIGN KEY (photo_id) REFERENCES new_photos(photo_id)
+);
+
+CREATE TABLE IF NOT EXISTS comments (
+    comment_id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    photo_id TEXT NOT NULL,
+    content TEXT NOT NULL,
+    timestamp DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    FOREIGN KEY (photo_id) REFERENCES new_photos(photo_id)
+);
+
+CREATE TABLE IF NOT EXISTS likes (
+    user_id TEXT NOT NULL,
+    photo_id TEXT NOT NULL,
+    timestamp DATETIME NOT NULL,
+    PRIMARY KEY (user_id, photo_id),
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    FOREIGN KEY (photo_id) REFERENCES new_photos(photo_id)
+);
+
+CREATE TABLE IF NOT EXISTS new_photos (
+    photo_id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    image_data BLOB,
+    timestamp DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+CREATE TABLE IF NOT EXISTS new_bans (
+    ban_id TEXT PRIMARY KEY,
+    banned_by TEXT NOT NULL,
+    banned_user TEXT NOT NULL,
+    timestamp DATETIME NOT NULL,
+    FOREIGN KEY (banned_by) REFERENCES users(user_id),
+    FOREIGN KEY (banned_user) REFERENCES users(user_id)
+);
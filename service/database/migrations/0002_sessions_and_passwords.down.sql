@@ -0,0 +1,3 @@
+DROP TABLE password_resets;
+DROP TABLE sessions;
+ALTER TABLE users DROP COLUMN password_hash;
@@ -0,0 +1,11 @@
+CREATE TABLE errors (
+    error TEXT
+);
+
+CREATE TABLE user_photos (
+    user_id TEXT NOT NULL,
+    photo_id TEXT NOT NULL,
+    PRIMARY KEY (user_id, photo_id),
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    FOREIGN KEY (photo_id) REFERENCES new_photos(photo_id)
+);
@@ -0,0 +1,3 @@
+-- Neither table has ever been read or written by the application.
+DROP TABLE errors;
+DROP TABLE user_photos;
@@ -0,0 +1,4 @@
+-- Photos whose bytes have already been moved to the blob store keep image_data NULL: MigrateTo refuses to run this
+-- rollback until they are copied back (see checkImagesInDatabase).
+DROP INDEX new_photos_image_key;
+ALTER TABLE new_photos DROP COLUMN image_key;
@@ -0,0 +1,5 @@
+-- Image bytes move to the blob store; the photo only keeps the content key. Existing rows keep their image_data until
+-- webapi moves it to the blob store at startup (see database.MoveImagesToBlobStore).
+ALTER TABLE new_photos ADD COLUMN image_key TEXT;
+
+CREATE INDEX new_photos_image_key ON new_photos (image_key);
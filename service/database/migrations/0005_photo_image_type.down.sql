@@ -0,0 +1 @@
+ALTER TABLE new_photos DROP COLUMN image_type;
@@ -0,0 +1,2 @@
+-- Media type of the image (e.g., image/jpeg), detected at upload and sent as Content-Type when serving it.
+ALTER TABLE new_photos ADD COLUMN image_type TEXT;
@@ -0,0 +1,5 @@
+DROP INDEX followers_follower;
+DROP INDEX users_username_nocase;
+DROP INDEX comments_photo_timestamp;
+DROP INDEX new_photos_user_timestamp;
+DROP INDEX new_photos_timestamp;
@@ -0,0 +1,6 @@
+-- Indexes for the keyset pagination of lists (see database/pagination.go).
+CREATE INDEX new_photos_timestamp ON new_photos (timestamp, photo_id);
+CREATE INDEX new_photos_user_timestamp ON new_photos (user_id, timestamp, photo_id);
+CREATE INDEX comments_photo_timestamp ON comments (photo_id, timestamp, comment_id);
+CREATE INDEX users_username_nocase ON users (username COLLATE NOCASE, user_id);
+CREATE INDEX followers_follower ON followers (follower_id, user_id);
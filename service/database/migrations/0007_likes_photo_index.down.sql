@@ -0,0 +1 @@
+DROP INDEX likes_photo;
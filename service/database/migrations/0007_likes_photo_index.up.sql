@@ -0,0 +1,3 @@
+-- The primary key of likes starts with user_id: counting the likes of a photo (e.g., for each entry of the stream)
+-- needs an index on photo_id.
+CREATE INDEX likes_photo ON likes (photo_id);
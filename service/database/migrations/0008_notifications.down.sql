@@ -0,0 +1,4 @@
+DROP INDEX notifications_photo;
+DROP INDEX notifications_recipient_unread;
+DROP INDEX notifications_recipient_created;
+DROP TABLE notifications;
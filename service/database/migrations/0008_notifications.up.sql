@@ -0,0 +1,18 @@
+-- Notifications of the events concerning a user (likes, comments and follows by other users). photo_id and comment_id
+-- are set only for the types that refer to them.
+CREATE TABLE notifications (
+    notification_id TEXT PRIMARY KEY,
+    recipient_id TEXT NOT NULL,
+    actor_id TEXT NOT NULL,
+    type TEXT NOT NULL,
+    photo_id TEXT,
+    comment_id TEXT,
+    created_at DATETIME NOT NULL,
+    read_at DATETIME,
+    FOREIGN KEY (recipient_id) REFERENCES users(user_id),
+    FOREIGN KEY (actor_id) REFERENCES users(user_id)
+);
+
+CREATE INDEX notifications_recipient_created ON notifications (recipient_id, created_at, notification_id);
+CREATE INDEX notifications_recipient_unread ON notifications (recipient_id) WHERE read_at IS NULL;
+CREATE INDEX notifications_photo ON notifications (photo_id);
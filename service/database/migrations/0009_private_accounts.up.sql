@@ -0,0 +1,12 @@
+-- Private accounts: their photos and relationship lists are visible only to the followers they approved.
+ALTER TABLE users ADD COLUMN private BOOLEAN NOT NULL DEFAULT 0;
+
+-- Pending follows of private accounts, waiting for the approval of user_id.
+CREATE TABLE follow_requests (
+    user_id TEXT NOT NULL,
+    requester_id TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, requester_id),
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    FOREIGN KEY (requester_id) REFERENCES users(user_id)
+);
@@ -0,0 +1,4 @@
+-- The follows removed by the up migration are not restored.
+DROP INDEX new_bans_user_by;
+DROP INDEX new_bans_by_user;
+DROP VIEW blocks;
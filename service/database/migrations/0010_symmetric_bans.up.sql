@@ -0,0 +1,15 @@
+-- A ban separates both users: blocks lists each ban in both directions, so that the ban policy (see
+-- database/ban-policy.go) checks a pair of users with a single lookup.
+CREATE VIEW blocks (user_id, other_id) AS
+    SELECT banned_by, banned_user FROM new_bans
+    UNION ALL
+    SELECT banned_user, banned_by FROM new_bans;
+
+CREATE INDEX new_bans_by_user ON new_bans (banned_by, banned_user);
+CREATE INDEX new_bans_user_by ON new_bans (banned_user, banned_by);
+
+-- Banning now removes the follows in both directions: apply it to the existing bans too.
+DELETE FROM followers WHERE EXISTS (
+    SELECT 1 FROM blocks WHERE blocks.user_id = followers.user_id AND blocks.other_id = followers.follower_id);
+DELETE FROM follow_requests WHERE EXISTS (
+    SELECT 1 FROM blocks WHERE blocks.user_id = follow_requests.user_id AND blocks.other_id = follow_requests.requester_id);
@@ -0,0 +1,4 @@
+DROP TRIGGER search_index_user_delete;
+DROP TRIGGER search_index_user_update;
+DROP TRIGGER search_index_user_insert;
+DROP TABLE search_index;
@@ -0,0 +1,24 @@
+-- 0011_search_index.up.sql for SQLite without FTS5 (an executable built without -tags sqlite_fts5): search_index is a
+-- plain table with the same columns, searched with LIKE (see database/search.go). The triggers are the same.
+CREATE TABLE search_index (
+    kind TEXT NOT NULL,
+    ref_id TEXT NOT NULL,
+    body TEXT NOT NULL
+);
+
+CREATE INDEX search_index_ref ON search_index (kind, ref_id);
+
+INSERT INTO search_index (kind, ref_id, body) SELECT 'user', user_id, username FROM users;
+
+-- The index follows the users table on its own, whatever code changes it.
+CREATE TRIGGER search_index_user_insert AFTER INSERT ON users BEGIN
+    INSERT INTO search_index (kind, ref_id, body) VALUES ('user', NEW.user_id, NEW.username);
+END;
+
+CREATE TRIGGER search_index_user_update AFTER UPDATE OF username ON users BEGIN
+    UPDATE search_index SET body = NEW.username WHERE kind = 'user' AND ref_id = OLD.user_id;
+END;
+
+CREATE TRIGGER search_index_user_delete AFTER DELETE ON users BEGIN
+    DELETE FROM search_index WHERE kind = 'user' AND ref_id = OLD.user_id;
+END;
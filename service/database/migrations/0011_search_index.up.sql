@@ -0,0 +1,26 @@
+-- Full-text index used by search (see database/search.go). Each row indexes the text of an item: kind tells what the
+-- item is and ref_id its ID. Prefix indexes make the "starts with" queries typed in the search box cheap. This needs
+-- SQLite with FTS5, i.e. an executable built with -tags sqlite_fts5: without it, 0011_search_index.nofts5.up.sql runs
+-- instead.
+CREATE VIRTUAL TABLE search_index USING fts5(
+    kind UNINDEXED,
+    ref_id UNINDEXED,
+    body,
+    tokenize = 'unicode61 remove_diacritics 2',
+    prefix = '2 3'
+);
+
+INSERT INTO search_index (kind, ref_id, body) SELECT 'user', user_id, username FROM users;
+
+-- The index follows the users table on its own, whatever code changes it.
+CREATE TRIGGER search_index_user_insert AFTER INSERT ON users BEGIN
+    INSERT INTO search_index (kind, ref_id, body) VALUES ('user', NEW.user_id, NEW.username);
+END;
+
+CREATE TRIGGER search_index_user_update AFTER UPDATE OF username ON users BEGIN
+    UPDATE search_index SET body = NEW.username WHERE kind = 'user' AND ref_id = OLD.user_id;
+END;
+
+CREATE TRIGGER search_index_user_delete AFTER DELETE ON users BEGIN
+    DELETE FROM search_index WHERE kind = 'user' AND ref_id = OLD.user_id;
+END;
@@ -0,0 +1,8 @@
+DROP TRIGGER search_index_photo_delete;
+DROP TRIGGER search_index_photo_update;
+DROP TRIGGER search_index_photo_insert;
+DELETE FROM search_index WHERE kind = 'photo';
+DROP INDEX photo_tags_tag;
+DROP TABLE photo_tags;
+DROP TABLE tags;
+ALTER TABLE new_photos DROP COLUMN caption;
@@ -0,0 +1,32 @@
+-- Photos get an optional caption. The hashtags in the caption are stored apart, each tag once in tags, so that photos
+-- can be listed by tag and tags ranked by use.
+ALTER TABLE new_photos ADD COLUMN caption TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE tags (
+    tag_id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE photo_tags (
+    photo_id TEXT NOT NULL,
+    tag_id INTEGER NOT NULL,
+    PRIMARY KEY (photo_id, tag_id),
+    FOREIGN KEY (photo_id) REFERENCES new_photos(photo_id),
+    FOREIGN KEY (tag_id) REFERENCES tags(tag_id)
+);
+
+CREATE INDEX photo_tags_tag ON photo_tags (tag_id, photo_id);
+
+-- Captions are searchable too (see database/search.go)
+CREATE TRIGGER search_index_photo_insert AFTER INSERT ON new_photos WHEN NEW.caption <> '' BEGIN
+    INSERT INTO search_index (kind, ref_id, body) VALUES ('photo', NEW.photo_id, NEW.caption);
+END;
+
+CREATE TRIGGER search_index_photo_update AFTER UPDATE OF caption ON new_photos BEGIN
+    DELETE FROM search_index WHERE kind = 'photo' AND ref_id = OLD.photo_id;
+    INSERT INTO search_index (kind, ref_id, body) SELECT 'photo', NEW.photo_id, NEW.caption WHERE NEW.caption <> '';
+END;
+
+CREATE TRIGGER search_index_photo_delete AFTER DELETE ON new_photos BEGIN
+    DELETE FROM search_index WHERE kind = 'photo' AND ref_id = OLD.photo_id;
+END;
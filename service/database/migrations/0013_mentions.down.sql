@@ -0,0 +1,2 @@
+DROP INDEX mentions_user;
+DROP TABLE mentions;
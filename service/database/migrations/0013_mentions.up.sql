@@ -0,0 +1,14 @@
+-- Users mentioned with "@username" in a text: source is "comment" or "caption", and source_id the ID of the comment or
+-- of the photo. The mention keeps the user ID, so it survives renames; start and length locate the "@username" text
+-- in characters.
+CREATE TABLE mentions (
+    source TEXT NOT NULL,
+    source_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    start INTEGER NOT NULL,
+    length INTEGER NOT NULL,
+    PRIMARY KEY (source, source_id, start),
+    FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+CREATE INDEX mentions_user ON mentions (user_id);
@@ -0,0 +1,7 @@
+DROP INDEX comment_likes_comment;
+DROP TABLE comment_likes;
+DROP INDEX comments_parent_timestamp;
+-- Replies become plain comments again; tombstones have nothing left to show
+DELETE FROM comments WHERE deleted_at IS NOT NULL;
+ALTER TABLE comments DROP COLUMN deleted_at;
+ALTER TABLE comments DROP COLUMN parent_comment_id;
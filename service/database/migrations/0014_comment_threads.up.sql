@@ -0,0 +1,17 @@
+-- One level of replies: a reply has the ID of the comment it answers in parent_comment_id. A comment deleted while it
+-- has replies is kept as a tombstone (deleted_at set, content cleared), so that the thread stays together.
+ALTER TABLE comments ADD COLUMN parent_comment_id TEXT;
+ALTER TABLE comments ADD COLUMN deleted_at DATETIME;
+
+CREATE INDEX comments_parent_timestamp ON comments (parent_comment_id, timestamp, comment_id);
+
+CREATE TABLE comment_likes (
+    user_id TEXT NOT NULL,
+    comment_id TEXT NOT NULL,
+    timestamp DATETIME NOT NULL,
+    PRIMARY KEY (user_id, comment_id),
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    FOREIGN KEY (comment_id) REFERENCES comments(comment_id)
+);
+
+CREATE INDEX comment_likes_comment ON comment_likes (comment_id);
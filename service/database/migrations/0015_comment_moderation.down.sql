@@ -0,0 +1,5 @@
+DROP INDEX comment_edits_comment;
+DROP TABLE comment_edits;
+ALTER TABLE new_photos DROP COLUMN comments_enabled;
+ALTER TABLE comments DROP COLUMN hidden_at;
+ALTER TABLE comments DROP COLUMN edited_at;
@@ -0,0 +1,15 @@
+-- Comments can be edited by their author: the previous versions are kept in comment_edits, with the time each one was
+-- written. The owner of a photo can hide the comments on it, and turn off new comments.
+ALTER TABLE comments ADD COLUMN edited_at DATETIME;
+ALTER TABLE comments ADD COLUMN hidden_at DATETIME;
+ALTER TABLE new_photos ADD COLUMN comments_enabled BOOLEAN NOT NULL DEFAULT 1;
+
+CREATE TABLE comment_edits (
+    edit_id INTEGER PRIMARY KEY,
+    comment_id TEXT NOT NULL,
+    content TEXT NOT NULL,
+    written_at DATETIME NOT NULL,
+    FOREIGN KEY (comment_id) REFERENCES comments(comment_id)
+);
+
+CREATE INDEX comment_edits_comment ON comment_edits (comment_id, written_at);
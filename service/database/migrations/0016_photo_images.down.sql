@@ -0,0 +1,11 @@
+-- Posts keep only their cover: the other images stay in the blob store, unreferenced.
+ALTER TABLE new_photos ADD COLUMN image_key TEXT;
+ALTER TABLE new_photos ADD COLUMN image_type TEXT;
+CREATE INDEX new_photos_image_key ON new_photos (image_key);
+
+UPDATE new_photos SET
+    image_key = (SELECT i.image_key FROM photo_images i WHERE i.photo_id = new_photos.photo_id AND i.position = 0),
+    image_type = (SELECT i.image_type FROM photo_images i WHERE i.photo_id = new_photos.photo_id AND i.position = 0);
+
+DROP INDEX photo_images_image_key;
+DROP TABLE photo_images;
@@ -0,0 +1,20 @@
+-- A photo is a post of one or more images, in order: the one at position 0 is the cover. Existing photos become posts
+-- of one image; those whose image is still in image_data get their row when webapi moves it to the blob store (see
+-- database.MoveImagesToBlobStore).
+CREATE TABLE photo_images (
+    photo_id TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    image_key TEXT NOT NULL,
+    image_type TEXT,
+    PRIMARY KEY (photo_id, position),
+    FOREIGN KEY (photo_id) REFERENCES new_photos(photo_id)
+);
+
+CREATE INDEX photo_images_image_key ON photo_images (image_key);
+
+INSERT INTO photo_images (photo_id, position, image_key, image_type)
+    SELECT photo_id, 0, image_key, image_type FROM new_photos WHERE image_key IS NOT NULL;
+
+DROP INDEX new_photos_image_key;
+ALTER TABLE new_photos DROP COLUMN image_key;
+ALTER TABLE new_photos DROP COLUMN image_type;
@@ -0,0 +1,24 @@
+DROP TRIGGER search_index_photo ON new_photos;
+DROP TRIGGER search_index_user ON users;
+DROP FUNCTION search_index_photo();
+DROP FUNCTION search_index_user();
+DROP FUNCTION search_index_set(TEXT, TEXT, TEXT);
+DROP TABLE search_index;
+
+DROP TABLE password_resets;
+DROP TABLE sessions;
+DROP TABLE notifications;
+DROP TABLE mentions;
+DROP TABLE comment_edits;
+DROP TABLE comment_likes;
+DROP TABLE comments;
+DROP TABLE likes;
+DROP TABLE photo_tags;
+DROP TABLE tags;
+DROP TABLE photo_images;
+DROP TABLE new_photos;
+DROP VIEW blocks;
+DROP TABLE new_bans;
+DROP TABLE follow_requests;
+DROP TABLE followers;
+DROP TABLE users;
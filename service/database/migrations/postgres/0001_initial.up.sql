@@ -0,0 +1,201 @@
+-- Schema of PostgreSQL databases, equivalent to the SQLite one at version 16 (see the migrations in the parent
+-- directory). Foreign keys are left out, as SQLite doesn't enforce them: the code deletes rows in an order that relies on
+-- it. The search index needs the unaccent extension, which any user owning the database can install (PostgreSQL 13+).
+
+CREATE EXTENSION IF NOT EXISTS unaccent;
+
+CREATE TABLE users (
+    user_id TEXT PRIMARY KEY,
+    username TEXT UNIQUE NOT NULL,
+    password_hash TEXT,
+    private BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE INDEX users_username_lower ON users (LOWER(username), user_id);
+
+CREATE TABLE followers (
+    user_id TEXT NOT NULL,
+    follower_id TEXT NOT NULL,
+    PRIMARY KEY (user_id, follower_id)
+);
+CREATE INDEX followers_follower ON followers (follower_id, user_id);
+
+CREATE TABLE follow_requests (
+    user_id TEXT NOT NULL,
+    requester_id TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, requester_id)
+);
+
+CREATE TABLE new_bans (
+    ban_id TEXT PRIMARY KEY,
+    banned_by TEXT NOT NULL,
+    banned_user TEXT NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX new_bans_by_user ON new_bans (banned_by, banned_user);
+CREATE INDEX new_bans_user_by ON new_bans (banned_user, banned_by);
+
+-- A ban separates both users, whoever made it
+CREATE VIEW blocks (user_id, other_id) AS
+    SELECT banned_by, banned_user FROM new_bans
+    UNION ALL
+    SELECT banned_user, banned_by FROM new_bans;
+
+CREATE TABLE new_photos (
+    photo_id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    image_data BYTEA,
+    timestamp TIMESTAMPTZ NOT NULL,
+    caption TEXT NOT NULL DEFAULT '',
+    comments_enabled BOOLEAN NOT NULL DEFAULT TRUE
+);
+CREATE INDEX new_photos_timestamp ON new_photos (timestamp, photo_id);
+CREATE INDEX new_photos_user_timestamp ON new_photos (user_id, timestamp, photo_id);
+
+CREATE TABLE photo_images (
+    photo_id TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    image_key TEXT NOT NULL,
+    image_type TEXT,
+    PRIMARY KEY (photo_id, position)
+);
+CREATE INDEX photo_images_image_key ON photo_images (image_key);
+
+CREATE TABLE tags (
+    tag_id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE photo_tags (
+    photo_id TEXT NOT NULL,
+    tag_id BIGINT NOT NULL,
+    PRIMARY KEY (photo_id, tag_id)
+);
+CREATE INDEX photo_tags_tag ON photo_tags (tag_id, photo_id);
+
+CREATE TABLE likes (
+    user_id TEXT NOT NULL,
+    photo_id TEXT NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, photo_id)
+);
+CREATE INDEX likes_photo ON likes (photo_id);
+
+CREATE TABLE comments (
+    comment_id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    photo_id TEXT NOT NULL,
+    content TEXT NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    parent_comment_id TEXT,
+    deleted_at TIMESTAMPTZ,
+    edited_at TIMESTAMPTZ,
+    hidden_at TIMESTAMPTZ
+);
+CREATE INDEX comments_photo_timestamp ON comments (photo_id, timestamp, comment_id);
+CREATE INDEX comments_parent_timestamp ON comments (parent_comment_id, timestamp, comment_id);
+
+CREATE TABLE comment_likes (
+    user_id TEXT NOT NULL,
+    comment_id TEXT NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, comment_id)
+);
+CREATE INDEX comment_likes_comment ON comment_likes (comment_id);
+
+CREATE TABLE comment_edits (
+    edit_id BIGSERIAL PRIMARY KEY,
+    comment_id TEXT NOT NULL,
+    content TEXT NOT NULL,
+    written_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX comment_edits_comment ON comment_edits (comment_id, written_at);
+
+CREATE TABLE mentions (
+    source TEXT NOT NULL,
+    source_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    start INTEGER NOT NULL,
+    length INTEGER NOT NULL,
+    PRIMARY KEY (source, source_id, start)
+);
+CREATE INDEX mentions_user ON mentions (user_id);
+
+CREATE TABLE notifications (
+    notification_id TEXT PRIMARY KEY,
+    recipient_id TEXT NOT NULL,
+    actor_id TEXT NOT NULL,
+    type TEXT NOT NULL,
+    photo_id TEXT,
+    comment_id TEXT,
+    created_at TIMESTAMPTZ NOT NULL,
+    read_at TIMESTAMPTZ
+);
+CREATE INDEX notifications_recipient_created ON notifications (recipient_id, created_at, notification_id);
+CREATE INDEX notifications_recipient_unread ON notifications (recipient_id) WHERE read_at IS NULL;
+CREATE INDEX notifications_photo ON notifications (photo_id);
+
+CREATE TABLE sessions (
+    session_id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE password_resets (
+    token_hash TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+-- Full-text index used by search (see database/search.go), like the FTS5 table of SQLite: document holds the words of
+-- body, lowercase and without accents. It follows the users and the photos on its own, through the triggers below.
+CREATE TABLE search_index (
+    kind TEXT NOT NULL,
+    ref_id TEXT NOT NULL,
+    body TEXT NOT NULL,
+    document TSVECTOR NOT NULL,
+    PRIMARY KEY (kind, ref_id)
+);
+CREATE INDEX search_index_document ON search_index USING GIN (document);
+
+-- search_index_set replaces the entry of an item; an empty body removes it.
+CREATE FUNCTION search_index_set(entry_kind TEXT, entry_ref_id TEXT, entry_body TEXT) RETURNS VOID AS $$
+BEGIN
+    DELETE FROM search_index WHERE kind = entry_kind AND ref_id = entry_ref_id;
+    IF entry_body <> '' THEN
+        INSERT INTO search_index (kind, ref_id, body, document)
+        VALUES (entry_kind, entry_ref_id, entry_body, to_tsvector('simple', unaccent(entry_body)));
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION search_index_user() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM search_index_set('user', OLD.user_id, '');
+        RETURN OLD;
+    END IF;
+    PERFORM search_index_set('user', NEW.user_id, NEW.username);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER search_index_user AFTER INSERT OR DELETE OR UPDATE OF username ON users
+    FOR EACH ROW EXECUTE FUNCTION search_index_user();
+
+CREATE FUNCTION search_index_photo() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM search_index_set('photo', OLD.photo_id, '');
+        RETURN OLD;
+    END IF;
+    PERFORM search_index_set('photo', NEW.photo_id, NEW.caption);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER search_index_photo AFTER INSERT OR DELETE OR UPDATE OF caption ON new_photos
+    FOR EACH ROW EXECUTE FUNCTION search_index_photo();
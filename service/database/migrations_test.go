@@ -0,0 +1,40 @@
+package database
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestRollbackKeepsImagesInBlobStore(t *testing.T) {
+	db, err := sql.Open(string(SQLite), filepath.Join(t.TempDir(), "decaf.db"))
+	if err != nil {
+		t.Fatalf("opening the database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	if err := MigrateTo(db, 4); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO users (user_id, username) VALUES ('u1', 'alice')"); err != nil {
+		t.Fatalf("adding a user: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO new_photos (photo_id, user_id, image_key, timestamp)
+		VALUES ('p1', 'u1', 'key', CURRENT_TIMESTAMP)`); err != nil {
+		t.Fatalf("adding a photo: %v", err)
+	}
+
+	if err := MigrateTo(db, 3); err == nil {
+		t.Fatal("rolled back while an image is only in the blob store")
+	}
+	if version, err := SchemaVersion(db); err != nil || version != 4 {
+		t.Fatalf("got version %d (%v), want 4", version, err)
+	}
+
+	if _, err := db.Exec("UPDATE new_photos SET image_data = x'00' WHERE photo_id = 'p1'"); err != nil {
+		t.Fatalf("copying the image back: %v", err)
+	}
+	if err := MigrateTo(db, 3); err != nil {
+		t.Fatalf("rolling back: %v", err)
+	}
+}
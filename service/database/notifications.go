@@ -0,0 +1,137 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// AddNotification stores a new notification. It returns false, without storing anything, if a ban separates the
+// recipient and the actor.
+func (db *appdbimpl) AddNotification(ctx context.Context, n Notification) (bool, error) {
+	// The ban check is part of the INSERT, so that a ban made at the same time can't be missed
+	res, err := db.c.ExecContext(ctx, `
+		INSERT INTO notifications (notification_id, recipient_id, actor_id, type, photo_id, comment_id, created_at)
+		SELECT ?, ?, ?, ?, ?, ?, ?
+		WHERE `+notBlocked("?", "?"),
+		n.ID, n.RecipientID, n.ActorID, n.Type, nullString(n.PhotoID), nullString(n.CommentID), n.CreatedAt,
+		n.RecipientID, n.ActorID)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert notification: %w", err)
+	}
+	added, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to insert notification: %w", err)
+	}
+	return added > 0, nil
+}
+
+// DeleteNotifications removes the notifications matching filter, e.g. when a like is removed. Type and ActorID must be
+// set; RecipientID, PhotoID and CommentID are compared only if not empty.
+func (db *appdbimpl) DeleteNotifications(ctx context.Context, filter Notification) error {
+	_, err := db.c.ExecContext(ctx, `
+		DELETE FROM notifications
+		WHERE type = ? AND actor_id = ? AND (? = '' OR recipient_id = ?) AND (? = '' OR photo_id = ?)
+			AND (? = '' OR comment_id = ?)`,
+		filter.Type, filter.ActorID, filter.RecipientID, filter.RecipientID, filter.PhotoID, filter.PhotoID,
+		filter.CommentID, filter.CommentID)
+	if err != nil {
+		return fmt.Errorf("failed to delete notifications: %w", err)
+	}
+	return nil
+}
+
+// GetNotifications returns a page of the notifications of recipientID, newest first, and the cursor of the next page.
+// Notifications sent by users separated from recipientID by a ban made afterwards are hidden.
+func (db *appdbimpl) GetNotifications(ctx context.Context, recipientID string, page Page) ([]Notification, string,
+	error) {
+	cond, args, err := page.keysetCondition("n.created_at", "n.notification_id", "DESC")
+	if err != nil {
+		return nil, "", err
+	}
+	query := `
+		SELECT n.notification_id, n.recipient_id, n.actor_id, u.username, n.type, COALESCE(n.photo_id, ''),
+			COALESCE(n.comment_id, ''), n.created_at, CAST(n.created_at AS TEXT), n.read_at IS NOT NULL
+		FROM notifications n
+		JOIN users u ON u.user_id = n.actor_id
+		WHERE n.recipient_id = ? AND ` + unbannedActor + ` AND ` + cond + `
+		ORDER BY n.created_at DESC, n.notification_id DESC
+		LIMIT ?`
+	rows, err := db.c.QueryContext(ctx, query, append(append([]interface{}{recipientID}, args...), page.limit()+1)...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query notifications: %w", err)
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	pager := page.pager()
+	for rows.Next() {
+		var n Notification
+		var key string
+		if err := rows.Scan(&n.ID, &n.RecipientID, &n.ActorID, &n.ActorUsername, &n.Type, &n.PhotoID, &n.CommentID,
+			&n.CreatedAt, &key, &n.Read); err != nil {
+			return nil, "", fmt.Errorf("failed to scan notification: %w", err)
+		}
+		if !pager.add(key, n.ID) {
+			break
+		}
+		notifications = append(notifications, n)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("rows error: %w", err)
+	}
+
+	return notifications, pager.next, nil
+}
+
+// CountUnreadNotifications returns the number of unread notifications of recipientID, ignoring those hidden by bans.
+func (db *appdbimpl) CountUnreadNotifications(ctx context.Context, recipientID string) (int, error) {
+	var count int
+	err := db.c.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM notifications n
+		WHERE n.recipient_id = ? AND n.read_at IS NULL AND `+unbannedActor, recipientID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count unread notifications: %w", err)
+	}
+	return count, nil
+}
+
+// SetNotificationRead marks a notification of recipientID as read (or unread). It returns ErrNotFound if recipientID
+// has no such notification.
+func (db *appdbimpl) SetNotificationRead(ctx context.Context, recipientID string, notificationID string, read bool,
+	now time.Time) error {
+	res, err := db.c.ExecContext(ctx, `UPDATE notifications SET read_at = CASE WHEN ? THEN COALESCE(read_at, ?) END
+		WHERE notification_id = ? AND recipient_id = ?`, read, now, notificationID, recipientID)
+	if err != nil {
+		return fmt.Errorf("failed to update notification: %w", err)
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update notification: %w", err)
+	}
+	if updated == 0 {
+		return fmt.Errorf("notification %s: %w", notificationID, ErrNotFound)
+	}
+	return nil
+}
+
+// SetAllNotificationsRead marks all the notifications of recipientID as read (or unread).
+func (db *appdbimpl) SetAllNotificationsRead(ctx context.Context, recipientID string, read bool, now time.Time) error {
+	_, err := db.c.ExecContext(ctx, `UPDATE notifications SET read_at = CASE WHEN ? THEN COALESCE(read_at, ?) END
+		WHERE recipient_id = ?`, read, now, recipientID)
+	if err != nil {
+		return fmt.Errorf("failed to update notifications: %w", err)
+	}
+	return nil
+}
+
+// unbannedActor is the SQL condition excluding the notifications (with the "n" alias) between users separated by a
+// ban.
+var unbannedActor = notBlocked("n.recipient_id", "n.actor_id")
+
+// nullString maps empty strings to NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
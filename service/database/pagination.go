@@ -0,0 +1,108 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// Lists are paginated with keyset queries: each list has a stable order (e.g., newest first, ties broken by ID), and a
+// page starts right after the last item of the previous one. The position is sent to clients as an opaque cursor.
+
+const (
+	// DefaultPageSize is the number of items returned when the page has no limit
+	DefaultPageSize = 20
+
+	// MaxPageSize is the maximum number of items in a page
+	MaxPageSize = 100
+)
+
+// ErrInvalidCursor is returned when a cursor is malformed.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page selects a page of a list. The zero value is the first page, with DefaultPageSize items.
+type Page struct {
+	// Limit is the maximum number of items to return. Values outside 1..MaxPageSize are replaced by the default or the
+	// maximum
+	Limit int
+
+	// Cursor is the Next value of the previous page, or empty for the first page
+	Cursor string
+}
+
+// limit returns the number of items to return in the page.
+func (p Page) limit() int {
+	switch {
+	case p.Limit <= 0:
+		return DefaultPageSize
+	case p.Limit > MaxPageSize:
+		return MaxPageSize
+	default:
+		return p.Limit
+	}
+}
+
+// after decodes the cursor into the sort key and the ID of the last item of the previous page. ok is false for the
+// first page.
+func (p Page) after() (key string, id string, ok bool, err error) {
+	if p.Cursor == "" {
+		return "", "", false, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(p.Cursor)
+	if err != nil {
+		return "", "", false, ErrInvalidCursor
+	}
+	parts := strings.Split(string(raw), "\x00")
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", false, ErrInvalidCursor
+	}
+	return parts[0], parts[1], true, nil
+}
+
+// encodeCursor returns the cursor pointing after the item with the given sort key and ID.
+func encodeCursor(key string, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key + "\x00" + id))
+}
+
+// keysetCondition returns the SQL condition (and its arguments) selecting the rows after the cursor, for a list
+// sorted by keyColumn and idColumn in the given direction ("ASC" or "DESC"). It returns "TRUE" for the first page.
+func (p Page) keysetCondition(keyColumn string, idColumn string, direction string) (string, []interface{}, error) {
+	key, id, ok, err := p.after()
+	if err != nil || !ok {
+		return "TRUE", nil, err
+	}
+	op := ">"
+	if direction == "DESC" {
+		op = "<"
+	}
+	return "(" + keyColumn + ", " + idColumn + ") " + op + " (?, ?)", []interface{}{key, id}, nil
+}
+
+// pager returns the helper used to collect the rows of the page.
+func (p Page) pager() *pager {
+	return &pager{limit: p.limit()}
+}
+
+// pager collects the rows of a page. Queries ask for one row more than the limit: that row only tells that there is a
+// next page.
+type pager struct {
+	limit   int
+	count   int
+	lastKey string
+	lastID  string
+
+	// next is the cursor of the next page, or empty if this is the last page
+	next string
+}
+
+// add records a row, in order. It returns false if the page is already full: the row is the first of the next page and
+// must not be returned.
+func (p *pager) add(key string, id string) bool {
+	if p.count == p.limit {
+		p.next = encodeCursor(p.lastKey, p.lastID)
+		return false
+	}
+	p.count++
+	p.lastKey, p.lastID = key, id
+	return true
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPagerCursor(t *testing.T) {
+	p := Page{Limit: 2}.pager()
+	for i, row := range [][2]string{{"alice", "id1"}, {"bob", "id2"}, {"carol", "id3"}} {
+		if added, want := p.add(row[0], row[1]), i < 2; added != want {
+			t.Fatalf("add(%q): got %v, want %v", row[0], added, want)
+		}
+	}
+	if p.next == "" {
+		t.Fatal("a full page with a row after it must have a next cursor")
+	}
+
+	key, id, ok, err := Page{Cursor: p.next}.after()
+	if err != nil || !ok || key != "bob" || id != "id2" {
+		t.Errorf("after: got (%q, %q, %v, %v), want the last row of the page", key, id, ok, err)
+	}
+}
+
+func TestPagerLastPage(t *testing.T) {
+	p := Page{Limit: 2}.pager()
+	p.add("alice", "id1")
+	p.add("bob", "id2")
+	if p.next != "" {
+		t.Errorf("a page with no row after it must have no next cursor, got %q", p.next)
+	}
+}
+
+func TestAfterFirstPage(t *testing.T) {
+	_, _, ok, err := Page{}.after()
+	if ok || err != nil {
+		t.Errorf("empty cursor: got (%v, %v), want the first page", ok, err)
+	}
+}
+
+func TestAfterInvalidCursor(t *testing.T) {
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+	cursors := map[string]string{
+		"not base64":         "%%%",
+		"padded base64":      base64.URLEncoding.EncodeToString([]byte("ab\x00id")),
+		"no separator":       encode("alice"),
+		"empty ID":           encode("alice\x00"),
+		"too many fields":    encode("alice\x00id1\x00id2"),
+		"standard alphabet":  base64.RawStdEncoding.EncodeToString([]byte("\xfb\xff\x00id")),
+		"separator only":     encode("\x00"),
+		"trailing separator": encode("alice\x00id1\x00"),
+	}
+	for name, cursor := range cursors {
+		if _, _, _, err := (Page{Cursor: cursor}).after(); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("%s: got %v, want ErrInvalidCursor", name, err)
+		}
+	}
+}
+
+func TestAfterEmptyKey(t *testing.T) {
+	// Sort keys can be empty (e.g., a photo without caption); IDs can't
+	key, id, ok, err := Page{Cursor: encodeCursor("", "id1")}.after()
+	if err != nil || !ok || key != "" || id != "id1" {
+		t.Errorf("got (%q, %q, %v, %v), want (\"\", \"id1\", true, nil)", key, id, ok, err)
+	}
+}
+
+func TestKeysetCondition(t *testing.T) {
+	cond, args, err := Page{}.keysetCondition("timestamp", "photo_id", "DESC")
+	if err != nil || cond != "TRUE" || args != nil {
+		t.Errorf("first page: got (%q, %v, %v), want TRUE", cond, args, err)
+	}
+
+	cursor := encodeCursor("2026-01-01", "id1")
+	cond, args, err = Page{Cursor: cursor}.keysetCondition("timestamp", "photo_id", "DESC")
+	if err != nil || cond != "(timestamp, photo_id) < (?, ?)" || !reflect.DeepEqual(args, []interface{}{"2026-01-01", "id1"}) {
+		t.Errorf("DESC: got (%q, %v, %v)", cond, args, err)
+	}
+	cond, _, _ = Page{Cursor: cursor}.keysetCondition("username", "user_id", "ASC")
+	if cond != "(username, user_id) > (?, ?)" {
+		t.Errorf("ASC: got %q", cond)
+	}
+
+	if _, _, err := (Page{Cursor: "%%%"}).keysetCondition("timestamp", "photo_id", "DESC"); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("invalid cursor: got %v, want ErrInvalidCursor", err)
+	}
+}
+
+func TestPageLimit(t *testing.T) {
+	for limit, want := range map[int]int{-1: DefaultPageSize, 0: DefaultPageSize, 5: 5, MaxPageSize + 1: MaxPageSize} {
+		if got := (Page{Limit: limit}).limit(); got != want {
+			t.Errorf("limit %d: got %d, want %d", limit, got, want)
+		}
+	}
+}
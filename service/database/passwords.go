@@ -0,0 +1,64 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// SetPasswordHash replaces the password hash of a user.
+func (db *appdbimpl) SetPasswordHash(ctx context.Context, userID, passwordHash string) error {
+	_, err := db.c.ExecContext(ctx, "UPDATE users SET password_hash = ? WHERE user_id = ?", passwordHash, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update password hash: %w", err)
+	}
+	return nil
+}
+
+// SetFirstPasswordHash sets the first credential of a legacy name-only account. It returns ErrConflict if the user
+// already has a password: the check and the update are one statement, so of two concurrent first logins only one
+// sets it.
+func (db *appdbimpl) SetFirstPasswordHash(ctx context.Context, userID, passwordHash string) error {
+	res, err := db.c.ExecContext(ctx, `UPDATE users SET password_hash = ?
+		WHERE user_id = ? AND (password_hash IS NULL OR password_hash = '')`, passwordHash, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set the first password hash: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to set the first password hash: %w", err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("user %q already has a password: %w", userID, ErrConflict)
+	}
+	return nil
+}
+
+// AddPasswordReset stores a new one-time password reset token.
+func (db *appdbimpl) AddPasswordReset(ctx context.Context, reset PasswordReset) error {
+	_, err := db.c.ExecContext(ctx, "INSERT INTO password_resets (token_hash, user_id, expires_at, used) VALUES (?, ?, ?, FALSE)",
+		reset.TokenHash, reset.UserID, reset.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert password reset: %w", err)
+	}
+	return nil
+}
+
+// ConsumePasswordReset marks a reset token as used and returns the ID of the user it belongs to. An empty ID is
+// returned if the token does not exist, is expired or has already been used. The check and the update are one
+// statement, so that concurrent requests can't both spend the same token.
+func (db *appdbimpl) ConsumePasswordReset(ctx context.Context, tokenHash string) (string, error) {
+	var userID string
+	err := db.c.QueryRowContext(ctx, `UPDATE password_resets SET used = TRUE
+		WHERE token_hash = ? AND NOT used AND expires_at > ?
+		RETURNING user_id`, tokenHash, globaltime.Now().UTC()).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to consume password reset: %w", err)
+	}
+	return userID, nil
+}
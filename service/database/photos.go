@@ -1,53 +1,254 @@
 package database
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 )
 
-// AddPhoto stores metadata about a photo in the database.
-func (db *appdbimpl) AddPhoto(photo Photo) error {
-	stmt, err := db.c.Prepare("INSERT INTO new_photos (photo_id, user_id, image_data, timestamp) VALUES (?, ?, ?, ?)")
+// MaxPhotoImages is the maximum number of images of a photo.
+const MaxPhotoImages = 10
+
+// photoColumns are the columns of new_photos read by scanPhotoPage.
+const photoColumns = `new_photos.photo_id, new_photos.user_id, new_photos.caption, new_photos.comments_enabled,
+	(SELECT COUNT(*) FROM photo_images pi WHERE pi.photo_id = new_photos.photo_id), new_photos.timestamp,
+	CAST(new_photos.timestamp AS TEXT)`
+
+// AddPhoto stores metadata about a photo in the database, along with its images (in the order given; their Position
+// is ignored), the tags and the mentions in its caption, and returns the IDs of the users mentioned.
+func (db *appdbimpl) AddPhoto(ctx context.Context, photo Photo) ([]string, error) {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("tx.Rollback failed: %v", rbErr)
+			}
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO new_photos (photo_id, user_id, caption, timestamp) VALUES (?, ?, ?, ?)`,
+		photo.ID, photo.UserID, photo.Caption, photo.Timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute the photo insert statement: %w", err)
+	}
+	for i, image := range photo.Images {
+		if _, err = tx.ExecContext(ctx, `INSERT INTO photo_images (photo_id, position, image_key, image_type) VALUES (?, ?, ?, ?)`,
+			photo.ID, i, image.ImageKey, image.ImageType); err != nil {
+			return nil, fmt.Errorf("failed to execute the image insert statement: %w", err)
+		}
+	}
+	if err = setPhotoTags(ctx, tx, photo.ID, photo.Caption); err != nil {
+		return nil, err
+	}
+	mentioned, err := setMentions(ctx, tx, mentionInCaption, photo.ID, photo.UserID, photo.Caption)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return mentioned, nil
+}
+
+// GetPhotos returns a page of all the photos visible to viewerID (see CanView and the ban policy), newest first, and
+// the cursor of the next page.
+func (db *appdbimpl) GetPhotos(ctx context.Context, viewerID string, page Page) ([]Photo, string, error) {
+	cond, args, err := page.keysetCondition("timestamp", "photo_id", "DESC")
 	if err != nil {
-		return fmt.Errorf("failed to prepare the photo insert statement: %w", err)
+		return nil, "", err
 	}
-	defer stmt.Close()
+	return db.getPhotoPage(ctx, page, viewerID, `SELECT `+photoColumns+`
+		FROM new_photos
+		WHERE `+visibleTo("new_photos.user_id")+` AND `+notBlocked("new_photos.user_id", "?")+` AND `+cond+`
+		ORDER BY timestamp DESC, photo_id DESC
+		LIMIT ?`, append(append([]interface{}{viewerID, viewerID, viewerID}, args...), page.limit()+1)...)
+}
 
-	_, err = stmt.Exec(photo.ID, photo.UserID, photo.ImageData, photo.Timestamp)
+// GetUserPhotos returns a page of the photos uploaded by the user, newest first, and the cursor of the next page. The
+// page is empty if viewerID can't see them (see CanView and the ban policy).
+func (db *appdbimpl) GetUserPhotos(ctx context.Context, userID string, viewerID string, page Page) ([]Photo,
+	string, error) {
+	cond, args, err := page.keysetCondition("timestamp", "photo_id", "DESC")
 	if err != nil {
-		return fmt.Errorf("failed to execute the photo insert statement: %w", err)
+		return nil, "", err
 	}
+	return db.getPhotoPage(ctx, page, viewerID, `SELECT `+photoColumns+`
+		FROM new_photos
+		WHERE user_id = ? AND `+visibleTo("new_photos.user_id")+` AND `+notBlocked("new_photos.user_id", "?")+`
+			AND `+cond+`
+		ORDER BY timestamp DESC, photo_id DESC
+		LIMIT ?`, append(append([]interface{}{userID, viewerID, viewerID, viewerID}, args...), page.limit()+1)...)
+}
 
-	return nil
+// getPhotoPage runs query, which must select the photoColumns of a page of photos sorted by timestamp, and returns the
+// photos with the mentions in their captions, and the cursor of the next page.
+func (db *appdbimpl) getPhotoPage(ctx context.Context, page Page, viewerID string, query string,
+	args ...interface{}) ([]Photo, string, error) {
+	photos, next, err := db.scanPhotoPage(ctx, page, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := db.addCaptionMentions(ctx, photos, viewerID); err != nil {
+		return nil, "", err
+	}
+	return photos, next, nil
 }
 
-// function to get all photos
-func (db *appdbimpl) GetPhotos() ([]Photo, error) {
-	rows, err := db.c.Query("SELECT * FROM new_photos")
+func (db *appdbimpl) scanPhotoPage(ctx context.Context, page Page, query string, args ...interface{}) ([]Photo,
+	string, error) {
+	rows, err := db.c.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query photos: %w", err)
+		return nil, "", fmt.Errorf("failed to query photos: %w", err)
 	}
 	defer rows.Close()
 
-	var photos []Photo
+	photos := []Photo{}
+	pager := page.pager()
 	for rows.Next() {
 		var photo Photo
-		if err := rows.Scan(&photo.ID, &photo.UserID, &photo.ImageData, &photo.Timestamp); err != nil {
-			return nil, fmt.Errorf("failed to scan photo: %w", err)
+		var key string
+		if err := rows.Scan(&photo.ID, &photo.UserID, &photo.Caption, &photo.CommentsEnabled, &photo.ImagesCount,
+			&photo.Timestamp, &key); err != nil {
+			return nil, "", fmt.Errorf("failed to scan photo: %w", err)
+		}
+		if !pager.add(key, photo.ID) {
+			break
 		}
 		photos = append(photos, photo)
 	}
 
 	// Check for errors that may have occurred during iteration
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("rows error: %w", err)
+	}
+
+	return photos, pager.next, nil
+}
+
+// GetPhotoOwner returns the ID of the user who uploaded the photo, or an empty string if the photo does not exist.
+func (db *appdbimpl) GetPhotoOwner(ctx context.Context, photoID string) (string, error) {
+	var userID string
+	err := db.c.QueryRowContext(ctx, "SELECT user_id FROM new_photos WHERE photo_id = ?", photoID).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to query photo owner: %w", err)
+	}
+	return userID, nil
+}
+
+// GetPhotoMetadata returns the photo with its images, without likes and comments, or nil if the photo does not exist.
+func (db *appdbimpl) GetPhotoMetadata(ctx context.Context, photoID string) (*Photo, error) {
+	var photo Photo
+	err := db.c.QueryRowContext(ctx, `SELECT photo_id, user_id, caption, comments_enabled, timestamp
+		FROM new_photos WHERE photo_id = ?`, photoID).Scan(
+		&photo.ID, &photo.UserID, &photo.Caption, &photo.CommentsEnabled, &photo.Timestamp,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to query photo: %w", err)
+	}
+
+	rows, err := db.c.QueryContext(ctx, `SELECT position, image_key, COALESCE(image_type, '') FROM photo_images
+		WHERE photo_id = ? ORDER BY position`, photoID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query images: %w", err)
+	}
+	defer rows.Close()
+
+	photo.Images = []Image{}
+	for rows.Next() {
+		var image Image
+		if err := rows.Scan(&image.Position, &image.ImageKey, &image.ImageType); err != nil {
+			return nil, fmt.Errorf("failed to scan image: %w", err)
+		}
+		photo.Images = append(photo.Images, image)
+	}
 	if err = rows.Err(); err != nil {
 		return nil, fmt.Errorf("rows error: %w", err)
 	}
+	photo.ImagesCount = len(photo.Images)
+	return &photo, nil
+}
+
+// IsImageKeyUsed checks whether any photo still references the image. Identical uploads share the same key, so the
+// blob can be deleted only when the last photo using it is gone.
+func (db *appdbimpl) IsImageKeyUsed(ctx context.Context, imageKey string) (bool, error) {
+	var used bool
+	err := db.c.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM photo_images WHERE image_key = ?)", imageKey).Scan(&used)
+	if err != nil {
+		return false, fmt.Errorf("failed to query image key usage: %w", err)
+	}
+	return used, nil
+}
+
+// MoveImagesToBlobStore moves the image bytes still saved in the database (photos uploaded before the blob store was
+// introduced) out of it. For each photo, put must store the data and return its key; the key becomes the only image of
+// the photo, and its image_data is cleared. It returns the number of photos moved, and can be run again safely if
+// interrupted.
+func (db *appdbimpl) MoveImagesToBlobStore(ctx context.Context, put func(imageData []byte) (string, error)) (int,
+	error) {
+	moved := 0
+	for {
+		// One photo at a time, to avoid loading all the images in memory
+		var photoID string
+		var imageData []byte
+		err := db.c.QueryRowContext(ctx, `SELECT photo_id, image_data FROM new_photos WHERE image_data IS NOT NULL LIMIT 1`).Scan(
+			&photoID, &imageData)
+		if errors.Is(err, sql.ErrNoRows) {
+			return moved, nil
+		} else if err != nil {
+			return moved, fmt.Errorf("failed to query photos to move: %w", err)
+		}
+
+		imageKey, err := put(imageData)
+		if err != nil {
+			return moved, fmt.Errorf("failed to store the image of photo %s: %w", photoID, err)
+		}
+		if err := db.setMovedImage(ctx, photoID, imageKey); err != nil {
+			return moved, fmt.Errorf("failed to update photo %s: %w", photoID, err)
+		}
+		moved++
+	}
+}
+
+// setMovedImage makes the image the only one of the photo, and clears the image_data of the photo.
+func (db *appdbimpl) setMovedImage(ctx context.Context, photoID string, imageKey string) error {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("tx.Rollback failed: %v", rbErr)
+			}
+		}
+	}()
 
-	return photos, nil
+	if _, err = tx.ExecContext(ctx, `INSERT INTO photo_images (photo_id, position, image_key) VALUES (?, 0, ?)
+		ON CONFLICT (photo_id, position) DO UPDATE SET image_key = excluded.image_key, image_type = NULL`,
+		photoID, imageKey); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "UPDATE new_photos SET image_data = NULL WHERE photo_id = ?", photoID); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return nil
 }
 
-func (db *appdbimpl) DeletePhoto(photoID string) error {
-	tx, err := db.c.Begin()
+func (db *appdbimpl) DeletePhoto(ctx context.Context, photoID string) error {
+	tx, err := db.c.BeginTx(ctx)
 	if err != nil {
 		return err
 	}
@@ -62,18 +263,48 @@ func (db *appdbimpl) DeletePhoto(photoID string) error {
 		}
 	}()
 
-	// Delete comments
-	if _, err = tx.Exec("DELETE FROM comments WHERE photo_id = ?", photoID); err != nil {
+	// Delete the mentions in the caption and in the comments
+	if _, err = tx.ExecContext(ctx, `DELETE FROM mentions WHERE (source = ? AND source_id = ?)
+		OR (source = ? AND source_id IN (SELECT comment_id FROM comments WHERE photo_id = ?))`,
+		mentionInCaption, photoID, mentionInComment, photoID); err != nil {
+		return err
+	}
+
+	// Delete the likes and the edit history of the comments, then the comments
+	if _, err = tx.ExecContext(ctx, `DELETE FROM comment_likes WHERE comment_id IN (SELECT comment_id FROM comments WHERE photo_id = ?)`,
+		photoID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM comment_edits WHERE comment_id IN (SELECT comment_id FROM comments WHERE photo_id = ?)`,
+		photoID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM comments WHERE photo_id = ?", photoID); err != nil {
 		return err
 	}
 
 	// Delete likes
-	if _, err = tx.Exec("DELETE FROM likes WHERE photo_id = ?", photoID); err != nil {
+	if _, err = tx.ExecContext(ctx, "DELETE FROM likes WHERE photo_id = ?", photoID); err != nil {
+		return err
+	}
+
+	// Delete the tags
+	if _, err = tx.ExecContext(ctx, "DELETE FROM photo_tags WHERE photo_id = ?", photoID); err != nil {
+		return err
+	}
+
+	// Delete the images; the blobs are released by the caller
+	if _, err = tx.ExecContext(ctx, "DELETE FROM photo_images WHERE photo_id = ?", photoID); err != nil {
+		return err
+	}
+
+	// Delete the notifications about the photo
+	if _, err = tx.ExecContext(ctx, "DELETE FROM notifications WHERE photo_id = ?", photoID); err != nil {
 		return err
 	}
 
 	// Delete the photo
-	if _, err = tx.Exec("DELETE FROM new_photos WHERE photo_id = ?", photoID); err != nil {
+	if _, err = tx.ExecContext(ctx, "DELETE FROM new_photos WHERE photo_id = ?", photoID); err != nil {
 		return err
 	}
 
@@ -87,89 +318,111 @@ func (db *appdbimpl) DeletePhoto(photoID string) error {
 	return nil
 }
 
-func (db *appdbimpl) GetMyStream(userID string) ([]string, error) {
-	var photoIds []string
+// GetMyStream returns a page of the stream of userID, newest first, and the cursor of the next page. The stream contains
+// the photos uploaded by the users followed by userID, except those separated from userID by a ban. Each entry is read
+// in the same query as the photo, so a page costs a single query whatever its size. Private accounts appear only once
+// they approved the follow, since pending follow requests are kept apart (see FollowUser).
+func (db *appdbimpl) GetMyStream(ctx context.Context, userID string, page Page) ([]StreamEntry, string, error) {
+	cond, args, err := page.keysetCondition("p.timestamp", "p.photo_id", "DESC")
+	if err != nil {
+		return nil, "", err
+	}
+	entries := []StreamEntry{}
+	// Replies are counted, but not the tombstones nor the comments hidden from userID by the ban policy or by the owner
 	query := `
-    SELECT p.photo_id
+    SELECT p.photo_id, p.user_id, u.username, p.caption, p.comments_enabled,
+           (SELECT COUNT(*) FROM photo_images pi WHERE pi.photo_id = p.photo_id), p.timestamp, CAST(p.timestamp AS TEXT),
+           (SELECT COUNT(*) FROM likes l WHERE l.photo_id = p.photo_id),
+           EXISTS(SELECT 1 FROM likes l WHERE l.photo_id = p.photo_id AND l.user_id = ?),
+           (SELECT COUNT(*) FROM comments c WHERE c.photo_id = p.photo_id AND c.deleted_at IS NULL
+               AND ` + notBlocked("c.user_id", "?") + ` AND ` + shownTo("c") + `)
     FROM new_photos p
     JOIN followers f ON p.user_id = f.user_id
-    LEFT JOIN new_bans b ON p.user_id = b.banned_by AND b.banned_user = ?
-    WHERE f.follower_id = ? AND b.ban_id IS NULL
+    JOIN users u ON p.user_id = u.user_id
+    WHERE f.follower_id = ? AND ` + notBlocked("p.user_id", "?") + ` AND ` + cond + `
+    ORDER BY p.timestamp DESC, p.photo_id DESC
+    LIMIT ?
     `
-	rows, err := db.c.Query(query, userID, userID)
+	rows, err := db.c.QueryContext(ctx, query,
+		append(append([]interface{}{userID, userID, userID, userID, userID}, args...), page.limit()+1)...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query my stream: %w", err)
+		return nil, "", fmt.Errorf("failed to query my stream: %w", err)
 	}
 	defer rows.Close()
 
+	pager := page.pager()
 	for rows.Next() {
-		var photoId string
-		if err := rows.Scan(&photoId); err != nil {
-			return nil, fmt.Errorf("failed to scan photo ID: %w", err)
+		var entry StreamEntry
+		var key string
+		if err := rows.Scan(&entry.PhotoID, &entry.UserID, &entry.Username, &entry.Caption, &entry.CommentsEnabled,
+			&entry.ImagesCount, &entry.Timestamp, &key, &entry.LikesCount, &entry.LikedByMe, &entry.CommentsCount); err != nil {
+			return nil, "", fmt.Errorf("failed to scan stream entry: %w", err)
 		}
-		photoIds = append(photoIds, photoId)
+		if !pager.add(key, entry.PhotoID) {
+			break
+		}
+		entries = append(entries, entry)
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("rows error: %w", err)
+		return nil, "", fmt.Errorf("rows error: %w", err)
+	}
+	rows.Close()
+
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.PhotoID
+	}
+	mentions, err := db.getMentions(ctx, mentionInCaption, ids, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range entries {
+		entries[i].Mentions = orEmpty(mentions[entries[i].PhotoID])
 	}
 
-	return photoIds, nil
+	return entries, pager.next, nil
 }
 
-func (db *appdbimpl) GetPhoto(photoId, userId string) (*PhotoDetail, error) {
+// GetPhoto returns the photo with its likes count and the first page of the threads of comments visible to userID. It
+// returns ErrNotFound if the photo doesn't exist or a ban separates userID from its owner, and ErrForbidden if userID
+// can't see the photos of its owner (see CanView).
+func (db *appdbimpl) GetPhoto(ctx context.Context, photoId, userId string) (*PhotoDetail, error) {
 	var photo PhotoDetail
+	var visible bool
 
 	// First, fetch the basic photo details and count of likes
-	err := db.c.QueryRow(`
-    SELECT p.photo_id, p.user_id, u.username, p.image_data, p.timestamp,
-           (SELECT COUNT(*) FROM likes WHERE photo_id = p.photo_id) AS likes_count
+	err := db.c.QueryRowContext(ctx, `
+    SELECT p.photo_id, p.user_id, u.username, p.caption, p.comments_enabled, p.timestamp,
+           (SELECT COUNT(*) FROM photo_images WHERE photo_id = p.photo_id) AS images_count,
+           (SELECT COUNT(*) FROM likes WHERE photo_id = p.photo_id) AS likes_count,
+           `+visibleTo("p.user_id")+`
     FROM new_photos p
     JOIN users u ON p.user_id = u.user_id
-    WHERE p.photo_id = ?`, photoId).Scan(
-		&photo.PhotoID, &photo.UserID, &photo.Username, &photo.ImageData, &photo.Timestamp, &photo.LikesCount,
+    WHERE p.photo_id = ? AND `+notBlocked("p.user_id", "?"), userId, userId, photoId, userId).Scan(
+		&photo.PhotoID, &photo.UserID, &photo.Username, &photo.Caption, &photo.CommentsEnabled, &photo.Timestamp,
+		&photo.ImagesCount, &photo.LikesCount, &visible,
 	)
-	if err != nil {
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("photo %s: %w", photoId, ErrNotFound)
+	} else if err != nil {
 		return nil, err
 	}
+	// Photos of private accounts are shown only to approved followers
+	if !visible {
+		return nil, fmt.Errorf("photo %s of a private account: %w", photoId, ErrForbidden)
+	}
 
-	// Query for comments related to the photo
-	commentsQuery := `
-    SELECT c.comment_id, c.user_id, u.username, c.content, c.timestamp
-    FROM comments c
-    JOIN users u ON u.user_id = c.user_id
-    WHERE c.photo_id = ?
-    ORDER BY c.timestamp DESC
-    `
-	rows, err := db.c.Query(commentsQuery, photoId)
+	// The first page of the threads; the others are loaded with GetCommentsByPhotoId
+	photo.Comments, photo.CommentsNext, err = db.GetCommentsByPhotoId(ctx, photoId, userId, Page{})
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	photo.Comments = []Comment{} // Initialize the slice to store comments
-
-	// Iterate over the results and populate the comments slice
-	for rows.Next() {
-		var comment Comment
-		if err := rows.Scan(&comment.ID, &comment.UserID, &comment.PhotoID, &comment.Content, &comment.Timestamp); err != nil {
-			return nil, err
-		}
-
-		// Check if the comment's user is banned by the current user
-		isBanned, err := db.IsBannedBy(comment.UserID, userId)
-		if err != nil {
-			return nil, err
-		}
-
-		if !isBanned {
-			photo.Comments = append(photo.Comments, comment)
-		}
-	}
-
-	if err = rows.Err(); err != nil {
+	mentions, err := db.getMentions(ctx, mentionInCaption, []string{photo.PhotoID}, userId)
+	if err != nil {
 		return nil, err
 	}
+	photo.Mentions = orEmpty(mentions[photo.PhotoID])
 
 	return &photo, nil
 }
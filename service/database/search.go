@@ -0,0 +1,262 @@
+package database
+
+// Search is done here, on the search_index full-text table. The index is kept in sync with the searchable tables by
+// triggers (see the migrations), so write paths don't need to care about it. SQLite indexes the text with FTS5,
+// PostgreSQL with a tsvector column: searchMatches hides the difference.
+//
+// SQLite libraries built without FTS5 (executables built without -tags sqlite_fts5) get a plain search_index table
+// instead, searched with LIKE: words match anywhere in the text, case is ignored for ASCII letters only, accents are
+// not, and shorter texts rank first. A database created that way gets the FTS5 index from the first executable with
+// FTS5 that opens it (see UpgradeSearchIndex); one with the FTS5 index needs FTS5 from then on.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// errNoFTS5 is returned when the search index uses FTS5 and the SQLite library has no FTS5 support.
+var errNoFTS5 = errors.New("the search index needs SQLite with FTS5: build with -tags sqlite_fts5")
+
+// FullTextSearch reports whether search uses a full-text index (FTS5 or PostgreSQL), rather than the LIKE fallback.
+func (db *appdbimpl) FullTextSearch() bool {
+	return !db.c.likeSearch
+}
+
+// SearchUsers returns a page of the users whose username matches query, best matches first, and the cursor of the next
+// page. Each word in the query matches the words of the username starting with it, ignoring case and accents; users
+// separated from viewerID by a ban are left out. A query without words matches nothing.
+//
+// Pages follow the rank, which depends on the whole index: the next page may skip or repeat some users if the index
+// changed in between.
+func (db *appdbimpl) SearchUsers(ctx context.Context, query string, viewerID string, page Page) ([]User, string,
+	error) {
+	matches, matchArgs := db.c.searchMatches("user", query)
+	if matches == "" {
+		return []User{}, "", nil
+	}
+	cond, cursorArgs, err := rankCondition(page, "s.score", "u.user_id")
+	if err != nil {
+		return nil, "", err
+	}
+
+	args := append(append(matchArgs, viewerID), cursorArgs...)
+	args = append(args, page.limit()+1)
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT u.user_id, u.username, s.score
+		FROM (`+matches+`) s
+		JOIN users u ON u.user_id = s.ref_id
+		WHERE `+notBlocked("u.user_id", "?")+` AND `+cond+`
+		ORDER BY s.score DESC, u.user_id DESC
+		LIMIT ?`, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to search users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []User{}
+	pager := page.pager()
+	for rows.Next() {
+		var user User
+		var score float64
+		if err := rows.Scan(&user.ID, &user.Username, &score); err != nil {
+			return nil, "", fmt.Errorf("failed to scan user: %w", err)
+		}
+		if !pager.add(strconv.FormatFloat(score, 'g', -1, 64), user.ID) {
+			break
+		}
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("rows error: %w", err)
+	}
+	return users, pager.next, nil
+}
+
+// SearchPhotos returns a page of the photos whose caption matches query, best matches first, and the cursor of the next
+// page. Words match as in SearchUsers, so hashtags are found with or without the "#". Only the photos viewerID can see
+// are returned (see CanView and the ban policy).
+func (db *appdbimpl) SearchPhotos(ctx context.Context, query string, viewerID string, page Page) ([]Photo, string,
+	error) {
+	matches, matchArgs := db.c.searchMatches("photo", query)
+	if matches == "" {
+		return []Photo{}, "", nil
+	}
+	cond, cursorArgs, err := rankCondition(page, "s.score", "p.photo_id")
+	if err != nil {
+		return nil, "", err
+	}
+
+	args := append(append(matchArgs, viewerID, viewerID, viewerID), cursorArgs...)
+	args = append(args, page.limit()+1)
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT p.photo_id, p.user_id, p.caption, p.comments_enabled,
+			(SELECT COUNT(*) FROM photo_images pi WHERE pi.photo_id = p.photo_id), p.timestamp, s.score
+		FROM (`+matches+`) s
+		JOIN new_photos p ON p.photo_id = s.ref_id
+		WHERE `+visibleTo("p.user_id")+` AND `+notBlocked("p.user_id", "?")+` AND `+cond+`
+		ORDER BY s.score DESC, p.photo_id DESC
+		LIMIT ?`, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to search photos: %w", err)
+	}
+	defer rows.Close()
+
+	photos := []Photo{}
+	pager := page.pager()
+	for rows.Next() {
+		var photo Photo
+		var score float64
+		if err := rows.Scan(&photo.ID, &photo.UserID, &photo.Caption, &photo.CommentsEnabled, &photo.ImagesCount,
+			&photo.Timestamp, &score); err != nil {
+			return nil, "", fmt.Errorf("failed to scan photo: %w", err)
+		}
+		if !pager.add(strconv.FormatFloat(score, 'g', -1, 64), photo.ID) {
+			break
+		}
+		photos = append(photos, photo)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("rows error: %w", err)
+	}
+	rows.Close()
+	if err = db.addCaptionMentions(ctx, photos, viewerID); err != nil {
+		return nil, "", err
+	}
+	return photos, pager.next, nil
+}
+
+// searchMatches returns the subquery selecting the ref_id and the score (higher is better) of the entries of the given
+// kind in the search index that match text, and its arguments. Every word of text must match the start of a word of
+// the indexed text (anywhere in it, with the LIKE fallback). It returns "" if text has no words.
+func (c *dbConn) searchMatches(kind string, text string) (string, []interface{}) {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return "", nil
+	}
+
+	terms := make([]string, len(words))
+	switch {
+	case c.dialect == Postgres:
+		// tsquery operators are symbols, which words never contain
+		for i, word := range words {
+			terms[i] = word + ":*"
+		}
+		return `SELECT ref_id, ts_rank(document, q)::float8 AS score
+			FROM search_index, to_tsquery('simple', unaccent(?)) q
+			WHERE kind = '` + kind + `' AND document @@ q`, []interface{}{strings.Join(terms, " & ")}
+	case c.likeSearch:
+		// Words have no LIKE wildcards either
+		args := make([]interface{}, len(words))
+		for i, word := range words {
+			terms[i] = "body LIKE ?"
+			args[i] = "%" + word + "%"
+		}
+		return `SELECT ref_id, CAST(-LENGTH(body) AS REAL) AS score
+			FROM search_index
+			WHERE kind = '` + kind + `' AND ` + strings.Join(terms, " AND "), args
+	default:
+		// Words are quoted for FTS5, so that its keywords (e.g., NOT) are taken literally
+		for i, word := range words {
+			terms[i] = `"` + word + `"*`
+		}
+		return `SELECT ref_id, -bm25(search_index) AS score
+			FROM search_index
+			WHERE search_index MATCH ? AND kind = '` + kind + `'`, []interface{}{strings.Join(terms, " ")}
+	}
+}
+
+// rankCondition is keysetCondition for lists sorted by a REAL score, best first, and then by ID in descending order.
+func rankCondition(page Page, scoreColumn string, idColumn string) (string, []interface{}, error) {
+	key, id, ok, err := page.after()
+	if err != nil || !ok {
+		return "TRUE", nil, err
+	}
+	score, err := strconv.ParseFloat(key, 64)
+	if err != nil {
+		return "", nil, ErrInvalidCursor
+	}
+	return "(" + scoreColumn + ", " + idColumn + ") < (?, ?)", []interface{}{score, id}, nil
+}
+
+// hasFTS5 reports whether the SQLite library was built with FTS5.
+func hasFTS5(c *sql.DB) (bool, error) {
+	var enabled bool
+	if err := c.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&enabled); err != nil {
+		return false, fmt.Errorf("checking the SQLite options: %w", err)
+	}
+	return enabled, nil
+}
+
+// fts5SearchIndex creates the FTS5 search index of 0011_search_index.up.sql and fills it like the migrations do; keep
+// them in sync. The triggers that follow the users and the photos are left as they are: they only name the table.
+const fts5SearchIndex = `
+	CREATE VIRTUAL TABLE search_index USING fts5(
+		kind UNINDEXED,
+		ref_id UNINDEXED,
+		body,
+		tokenize = 'unicode61 remove_diacritics 2',
+		prefix = '2 3'
+	);
+	INSERT INTO search_index (kind, ref_id, body) SELECT 'user', user_id, username FROM users;
+	INSERT INTO search_index (kind, ref_id, body) SELECT 'photo', photo_id, caption FROM new_photos WHERE caption <> '';`
+
+// UpgradeSearchIndex replaces the plain search index of the LIKE fallback with the FTS5 one, if the SQLite library has
+// FTS5, and reports whether it did. The database must be at the latest schema version. Other databases are left as
+// they are.
+func UpgradeSearchIndex(c *sql.DB) (bool, error) {
+	dialect, err := DialectOf(c)
+	if err != nil || dialect != SQLite {
+		return false, err
+	}
+	if fts5, err := hasFTS5(c); err != nil || !fts5 {
+		return false, err
+	}
+	if like, err := likeSearch(c); err != nil || !like {
+		return false, err
+	}
+
+	tx, err := c.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if _, err = tx.Exec("DROP TABLE search_index"); err != nil {
+		return false, fmt.Errorf("dropping the search index: %w", err)
+	}
+	if _, err = tx.Exec(fts5SearchIndex); err != nil {
+		return false, fmt.Errorf("creating the search index: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// likeSearch reports whether the SQLite search index is the plain table of the LIKE fallback. It returns errNoFTS5 if
+// the index uses FTS5 and the SQLite library has no FTS5.
+func likeSearch(c *sql.DB) (bool, error) {
+	var ddl string
+	err := c.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'search_index'`).Scan(&ddl)
+	if err != nil {
+		return false, fmt.Errorf("reading the search index: %w", err)
+	}
+	if !strings.Contains(strings.ToLower(ddl), "using fts5") {
+		return true, nil
+	}
+	fts5, err := hasFTS5(c)
+	if err == nil && !fts5 {
+		err = errNoFTS5
+	}
+	return false, err
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestRankConditionInvalidScore(t *testing.T) {
+	_, _, err := rankCondition(Page{Cursor: encodeCursor("high", "id1")}, "s.score", "u.user_id")
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("got %v, want ErrInvalidCursor", err)
+	}
+}
+
+// TestUpgradeSearchIndex turns the search index into the plain table of the LIKE fallback, as on a database created
+// without FTS5, and checks that it is rebuilt as an FTS5 index when the SQLite library has FTS5.
+func TestUpgradeSearchIndex(t *testing.T) {
+	c, err := sql.Open(string(SQLite), filepath.Join(t.TempDir(), "decaf.db"))
+	if err != nil {
+		t.Fatalf("opening the database: %v", err)
+	}
+	defer func() { _ = c.Close() }()
+	if err := Migrate(c); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	_, err = c.Exec(`
+		DROP TABLE search_index;
+		CREATE TABLE search_index (kind TEXT NOT NULL, ref_id TEXT NOT NULL, body TEXT NOT NULL);
+		INSERT INTO users (user_id, username) VALUES ('u1', 'alice');
+		INSERT INTO new_photos (photo_id, user_id, caption, timestamp) VALUES ('p1', 'u1', 'Café', CURRENT_TIMESTAMP);`)
+	if err != nil {
+		t.Fatalf("making a plain search index: %v", err)
+	}
+
+	fts5, err := hasFTS5(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgraded, err := UpgradeSearchIndex(c)
+	if err != nil || upgraded != fts5 {
+		t.Fatalf("got %v (%v), want %v", upgraded, err, fts5)
+	}
+	if !fts5 {
+		return
+	}
+	if like, err := likeSearch(c); err != nil || like {
+		t.Errorf("got a LIKE index (%v) after the upgrade", err)
+	}
+	var matches int
+	err = c.QueryRow("SELECT COUNT(*) FROM search_index WHERE search_index MATCH 'ali* OR cafe'").Scan(&matches)
+	if err != nil || matches != 2 {
+		t.Errorf("got %d matches (%v), want the user and the photo", matches, err)
+	}
+	// The triggers keep following the users
+	if _, err := c.Exec("INSERT INTO users (user_id, username) VALUES ('u2', 'bob')"); err != nil {
+		t.Fatalf("adding a user: %v", err)
+	}
+	err = c.QueryRow("SELECT COUNT(*) FROM search_index WHERE search_index MATCH 'bob'").Scan(&matches)
+	if err != nil || matches != 1 {
+		t.Errorf("got %d matches (%v) for a new user, want 1", matches, err)
+	}
+	if upgraded, err := UpgradeSearchIndex(c); err != nil || upgraded {
+		t.Errorf("upgraded an FTS5 index again (%v)", err)
+	}
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// AddSession stores a newly issued session.
+func (db *appdbimpl) AddSession(ctx context.Context, session Session) error {
+	_, err := db.c.ExecContext(ctx, "INSERT INTO sessions (session_id, user_id, created_at, expires_at, revoked) VALUES (?, ?, ?, ?, FALSE)",
+		session.ID, session.UserID, session.CreatedAt, session.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert session: %w", err)
+	}
+	return nil
+}
+
+// GetSession returns the session with the given ID, or nil if it does not exist.
+func (db *appdbimpl) GetSession(ctx context.Context, sessionID string) (*Session, error) {
+	var session Session
+	err := db.c.QueryRowContext(ctx, "SELECT session_id, user_id, created_at, expires_at, revoked FROM sessions WHERE session_id = ?", sessionID).
+		Scan(&session.ID, &session.UserID, &session.CreatedAt, &session.ExpiresAt, &session.Revoked)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil // Session not found is not an error here
+		}
+		return nil, fmt.Errorf("failed to query session: %w", err)
+	}
+	return &session, nil
+}
+
+// RevokeSession marks a single session as revoked (logout from one device).
+func (db *appdbimpl) RevokeSession(ctx context.Context, sessionID string) error {
+	_, err := db.c.ExecContext(ctx, "UPDATE sessions SET revoked = TRUE WHERE session_id = ?", sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	return nil
+}
+
+// RevokeUserSessions marks every session of a user as revoked (logout from all devices).
+func (db *appdbimpl) RevokeUserSessions(ctx context.Context, userID string) error {
+	_, err := db.c.ExecContext(ctx, "UPDATE sessions SET revoked = TRUE WHERE user_id = ? AND NOT revoked", userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke user sessions: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package database
+
+// Captions and hashtags are handled here. The tags of a photo are always derived from its caption, in the same
+// transaction that saves the caption, so they can't get out of sync.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// MaxTagLength is the maximum number of characters in a hashtag; longer ones are not tags
+	MaxTagLength = 50
+
+	// maxPhotoTags is the maximum number of tags stored for a photo; further hashtags in the caption are plain text
+	maxPhotoTags = 30
+)
+
+// hashtagPattern matches a hashtag in a caption: a "#" not glued to a preceding word, followed by letters, digits and
+// underscores. The tag is the first group.
+var hashtagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_#])#([\p{L}\p{N}_]+)`)
+
+// TrendingTag is a tag along with the number of recent photos using it.
+type TrendingTag struct {
+	Name        string `json:"tag"`
+	PhotosCount int    `json:"photosCount"` // Number of photos using the tag in the time window
+}
+
+// NormalizeTag returns the canonical form of tag, as stored: without the leading "#" and in lower case. ok is false if
+// tag is not a valid hashtag.
+func NormalizeTag(tag string) (name string, ok bool) {
+	name = strings.ToLower(strings.TrimPrefix(tag, "#"))
+	if name == "" || len([]rune(name)) > MaxTagLength {
+		return "", false
+	}
+	letters := false
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			return "", false
+		}
+		letters = letters || unicode.IsLetter(r)
+	}
+	// "#1" is a number, not a tag
+	return name, letters
+}
+
+// hashtags returns the normalized tags in caption, each once, in order of appearance.
+func hashtags(caption string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, match := range hashtagPattern.FindAllStringSubmatch(caption, -1) {
+		name, ok := NormalizeTag(match[1])
+		if !ok || seen[name] {
+			continue
+		}
+		if len(tags) == maxPhotoTags {
+			break
+		}
+		seen[name] = true
+		tags = append(tags, name)
+	}
+	return tags
+}
+
+// SetCaption replaces the caption of the photo, and its tags and mentions along with it. It returns the IDs of the
+// users mentioned by the new caption but not by the old one, or ErrNotFound if the photo doesn't exist.
+func (db *appdbimpl) SetCaption(ctx context.Context, photoID string, caption string) ([]string, error) {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("tx.Rollback failed: %v", rbErr)
+			}
+		}
+	}()
+
+	var ownerID string
+	err = tx.QueryRowContext(ctx, "SELECT user_id FROM new_photos WHERE photo_id = ?", photoID).Scan(&ownerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("photo %s: %w", photoID, ErrNotFound)
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to query photo owner: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, "UPDATE new_photos SET caption = ? WHERE photo_id = ?", caption, photoID); err != nil {
+		return nil, fmt.Errorf("failed to update caption: %w", err)
+	}
+	if err = setPhotoTags(ctx, tx, photoID, caption); err != nil {
+		return nil, err
+	}
+	mentioned, err := setMentions(ctx, tx, mentionInCaption, photoID, ownerID, caption)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return mentioned, nil
+}
+
+// GetTagPhotos returns a page of the photos tagged with tag and visible to viewerID (see CanView and the ban policy),
+// newest first, and the cursor of the next page. tag must be normalized (see NormalizeTag).
+func (db *appdbimpl) GetTagPhotos(ctx context.Context, tag string, viewerID string, page Page) ([]Photo, string,
+	error) {
+	cond, args, err := page.keysetCondition("new_photos.timestamp", "new_photos.photo_id", "DESC")
+	if err != nil {
+		return nil, "", err
+	}
+	return db.getPhotoPage(ctx, page, viewerID, `SELECT `+photoColumns+`
+		FROM tags t
+		JOIN photo_tags pt ON pt.tag_id = t.tag_id
+		JOIN new_photos ON new_photos.photo_id = pt.photo_id
+		WHERE t.name = ? AND `+visibleTo("new_photos.user_id")+` AND `+notBlocked("new_photos.user_id", "?")+`
+			AND `+cond+`
+		ORDER BY new_photos.timestamp DESC, new_photos.photo_id DESC
+		LIMIT ?`, append(append([]interface{}{tag, viewerID, viewerID, viewerID}, args...), page.limit()+1)...)
+}
+
+// GetTrendingTags returns up to limit tags, the most used first, counting the photos uploaded since the given time
+// that viewerID can see (see CanView and the ban policy). Ties are sorted by name.
+func (db *appdbimpl) GetTrendingTags(ctx context.Context, since time.Time, viewerID string,
+	limit int) ([]TrendingTag, error) {
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT t.name, COUNT(*) AS photos_count
+		FROM new_photos
+		JOIN photo_tags pt ON pt.photo_id = new_photos.photo_id
+		JOIN tags t ON t.tag_id = pt.tag_id
+		WHERE new_photos.timestamp >= ? AND `+visibleTo("new_photos.user_id")+`
+			AND `+notBlocked("new_photos.user_id", "?")+`
+		GROUP BY t.tag_id
+		ORDER BY photos_count DESC, t.name
+		LIMIT ?`, since, viewerID, viewerID, viewerID, Page{Limit: limit}.limit())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trending tags: %w", err)
+	}
+	defer rows.Close()
+
+	tags := []TrendingTag{}
+	for rows.Next() {
+		var tag TrendingTag
+		if err := rows.Scan(&tag.Name, &tag.PhotosCount); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+	return tags, nil
+}
+
+// setPhotoTags replaces the tags of the photo with the hashtags in caption.
+func setPhotoTags(ctx context.Context, tx *dbTx, photoID string, caption string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM photo_tags WHERE photo_id = ?", photoID); err != nil {
+		return fmt.Errorf("failed to delete photo tags: %w", err)
+	}
+	for _, name := range hashtags(caption) {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO tags (name) VALUES (?) ON CONFLICT DO NOTHING", name); err != nil {
+			return fmt.Errorf("failed to add tag: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO photo_tags (photo_id, tag_id) SELECT ?, tag_id FROM tags WHERE name = ?`,
+			photoID, name); err != nil {
+			return fmt.Errorf("failed to tag photo: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+const (
+	// maxTxAttempts is how many times WithTx runs a transaction that keeps failing because of concurrent ones
+	maxTxAttempts = 5
+
+	// txRetryDelay is the wait before the second attempt; it grows linearly with the attempts
+	txRetryDelay = 20 * time.Millisecond
+)
+
+// WithTx runs fn in a transaction, which is committed if fn returns nil and rolled back otherwise. The transaction is
+// serializable: what fn reads doesn't change until the commit.
+//
+// If the transaction fails because of a concurrent one (SQLITE_BUSY, or a serialization failure on PostgreSQL), it is
+// rolled back and fn runs again, up to maxTxAttempts times: fn must not have effects outside tx.
+//
+// When an operation of tx fails, fn should return the error: PostgreSQL refuses any further statement in the
+// transaction.
+func (db *appdbimpl) WithTx(ctx context.Context, fn func(tx Tx) error) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		return fn(tx)
+	})
+}
+
+// withTx is WithTx for the methods of appdbimpl, which can run their own statements on tx.c. Inside a transaction, fn
+// runs in it: the methods that use withTx are operations of Tx too.
+func (db *appdbimpl) withTx(ctx context.Context, fn func(tx *appdbimpl) error) error {
+	if db.c.tx != nil {
+		return fn(db)
+	}
+	for attempt := 1; ; attempt++ {
+		err := db.runTx(ctx, fn)
+		if attempt == maxTxAttempts || !isRetryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * txRetryDelay):
+		}
+	}
+}
+
+// runTx is an attempt of withTx.
+func (db *appdbimpl) runTx(ctx context.Context, fn func(tx *appdbimpl) error) error {
+	// SQLite transactions are always serializable; the option is for PostgreSQL
+	tx, err := db.c.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// A panic in fn must not leave the transaction (and, with SQLite, the lock on the database) open
+		p := recover()
+		if err != nil || p != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("tx.Rollback failed: %v", rbErr)
+			}
+		}
+		if p != nil {
+			panic(p)
+		}
+	}()
+
+	c := *db.c
+	c.tx = tx
+	if err = fn(&appdbimpl{c: &c}); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// TestWithTxRetries checks the retries of WithTx with the PostgreSQL errors, which the conformance suite only meets
+// when it runs on PostgreSQL (see test-postgres.sh).
+func TestWithTxRetries(t *testing.T) {
+	c, err := sql.Open(string(SQLite), filepath.Join(t.TempDir(), "decaf.db"))
+	if err != nil {
+		t.Fatalf("opening the database: %v", err)
+	}
+	defer func() { _ = c.Close() }()
+	if err := Migrate(c); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	db, err := New(c)
+	if err != nil {
+		t.Fatalf("creating the database: %v", err)
+	}
+
+	cases := []struct {
+		code     pq.ErrorCode
+		failures int
+		want     int // Attempts
+		wantErr  bool
+	}{
+		{"40001", 2, 3, false},                        // serialization_failure
+		{"40P01", 1, 2, false},                        // deadlock_detected
+		{"40001", maxTxAttempts, maxTxAttempts, true}, // still failing at the last attempt
+		{"23505", 1, 1, true},                         // unique_violation: not retried
+	}
+	for _, tc := range cases {
+		attempts := 0
+		err := db.WithTx(context.Background(), func(tx Tx) error {
+			attempts++
+			if attempts <= tc.failures {
+				return fmt.Errorf("updating: %w", &pq.Error{Code: tc.code})
+			}
+			return nil
+		})
+		var pqErr *pq.Error
+		if attempts != tc.want || (err != nil) != tc.wantErr || (err != nil && !errors.As(err, &pqErr)) {
+			t.Errorf("%s failing %d times: got %d attempts (%v), want %d", tc.code, tc.failures, attempts, err, tc.want)
+		}
+	}
+}
@@ -3,10 +3,12 @@ package database
 // All User related methods are defined here
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"errors"
 	"fmt"
+	"log"
 	"strings"
 )
 
@@ -22,40 +24,53 @@ func generateRandomString(length int) (string, error) {
 	return string(bytes), nil
 }
 
-func (db *appdbimpl) GetUser(userID string) (*User, error) {
+func (db *appdbimpl) GetUser(ctx context.Context, userID string) (*User, error) {
 	if userID == "" {
 		return nil, nil
 	}
 	var user User
 
+	var passwordHash sql.NullString
+
 	// SQL query to select the user by user_id
-	query := "SELECT user_id, username FROM users WHERE user_id = ?"
+	query := "SELECT user_id, username, password_hash, private FROM users WHERE user_id = ?"
 
 	// Execute the query
-	err := db.c.QueryRow(query, userID).Scan(&user.ID, &user.Username)
-	if err != nil {
-		// Other error occurred
-		return nil, err
+	err := db.c.QueryRowContext(ctx, query, userID).Scan(&user.ID, &user.Username, &passwordHash, &user.Private)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("user %s: %w", userID, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to query user: %w", err)
 	}
+	user.PasswordHash = passwordHash.String
 	return &user, nil
 }
 
 // checkUserIDExists now returns an error as well
-func (db *appdbimpl) checkUserIDExists(userID string) (bool, error) {
+func (db *appdbimpl) checkUserIDExists(ctx context.Context, userID string) (bool, error) {
 	var exists bool
-	err := db.c.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE user_id = ?)", userID).Scan(&exists)
+	err := db.c.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE user_id = ?)", userID).Scan(&exists)
 	return exists, err // return the error
 }
 
+// UserExists reports whether a user with the given ID exists.
+func (db *appdbimpl) UserExists(ctx context.Context, userID string) (bool, error) {
+	exists, err := db.checkUserIDExists(ctx, userID)
+	if err != nil {
+		return false, fmt.Errorf("error checking if user exists: %w", err)
+	}
+	return exists, nil
+}
+
 // generateUniqueID now has a receiver and returns errors
-func (db *appdbimpl) generateUniqueID() (string, error) {
+func (db *appdbimpl) generateUniqueID(ctx context.Context) (string, error) {
 	for {
 		userID, err := generateRandomString(10)
 		if err != nil {
 			return "", err
 		}
 
-		exists, err := db.checkUserIDExists(userID) // use the method of appdbimpl
+		exists, err := db.checkUserIDExists(ctx, userID) // use the method of appdbimpl
 		if err != nil {
 			return "", err // return the error
 		}
@@ -67,79 +82,84 @@ func (db *appdbimpl) generateUniqueID() (string, error) {
 }
 
 // AddUser uses the generateUniqueID method of appdbimpl
-func (db *appdbimpl) AddUser(user *User) error {
-	userID, err := db.generateUniqueID()
+func (db *appdbimpl) AddUser(ctx context.Context, user *User) error {
+	userID, err := db.generateUniqueID(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to generate user ID: %w", err)
 	}
 	user.ID = userID
 
-	stmt, err := db.c.Prepare("INSERT INTO users (user_id, username) VALUES (?, ?)")
+	stmt, err := db.c.PrepareContext(ctx, "INSERT INTO users (user_id, username, password_hash) VALUES (?, ?, ?)")
 	if err != nil {
 		return fmt.Errorf("failed to prepare statement: %w", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(user.ID, user.Username)
-	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-			return fmt.Errorf("username already exists: %w", err)
-		}
+	passwordHash := sql.NullString{String: user.PasswordHash, Valid: user.PasswordHash != ""}
+	_, err = stmt.ExecContext(ctx, user.ID, user.Username, passwordHash)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("username %q already exists: %w", user.Username, ErrConflict)
+	} else if err != nil {
 		return fmt.Errorf("failed to execute statement: %w", err)
 	}
 
 	return nil
 }
 
-func (db *appdbimpl) SetUsername(userID, newUsername string) error {
-	// Check if the username already exists (case-insensitive)
-	var existingID string
-	err := db.c.QueryRow(`SELECT user_id FROM users WHERE username LIKE ? COLLATE NOCASE`, newUsername).Scan(&existingID)
-	if err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
+// SetUsername renames the user. It returns ErrConflict if another user has the same username, ignoring case.
+func (db *appdbimpl) SetUsername(ctx context.Context, userID, newUsername string) error {
+	// The check and the update run in one transaction, so that two users can't take the same name at once
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		// Check if the username already exists (case-insensitive)
+		var existingID string
+		err := tx.c.QueryRowContext(ctx, `SELECT user_id FROM users WHERE `+tx.c.dialect.equalsCaseless("username")+` AND user_id != ?`,
+			newUsername, userID).Scan(&existingID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
 			return fmt.Errorf("failed to check existing username: %w", err)
 		}
-	}
-
-	if existingID != "" {
-		return fmt.Errorf("username already taken")
-	}
-
-	// Update the username if it's not taken
-	_, err = db.c.Exec(`UPDATE users SET username = $1 WHERE user_id = $2`, newUsername, userID)
-	if err != nil {
-		return fmt.Errorf("failed to update username: %w", err)
-	}
+		if existingID != "" {
+			return fmt.Errorf("username %q already taken: %w", newUsername, ErrConflict)
+		}
 
-	return nil
+		// Update the username if it's not taken
+		_, err = tx.c.ExecContext(ctx, `UPDATE users SET username = ? WHERE user_id = ?`, newUsername, userID)
+		if isUniqueViolation(err) {
+			return fmt.Errorf("username %q already taken: %w", newUsername, ErrConflict)
+		} else if err != nil {
+			return fmt.Errorf("failed to update username: %w", err)
+		}
+		return nil
+	})
 }
 
-func (db *appdbimpl) GetUserByUsername(username string) (*User, error) {
+func (db *appdbimpl) GetUserByUsername(ctx context.Context, username string) (*User, error) {
 	var user User
-	err := db.c.QueryRow(`SELECT user_id, username FROM users WHERE username LIKE ? COLLATE NOCASE`, username).Scan(&user.ID, &user.Username)
+	var passwordHash sql.NullString
+	err := db.c.QueryRowContext(ctx, `SELECT user_id, username, password_hash FROM users WHERE `+db.c.dialect.equalsCaseless("username"), username).Scan(&user.ID, &user.Username, &passwordHash)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil // User not found is not an error here
 		}
 		return nil, err
 	}
+	user.PasswordHash = passwordHash.String
 	return &user, nil
 }
 
-func (db *appdbimpl) GetUserProfile(username string) (*User, error) {
+func (db *appdbimpl) GetUserProfile(ctx context.Context, username string) (*User, error) {
 	var user User
 
 	// Fetch basic user info
-	err := db.c.QueryRow("SELECT user_id, username FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username)
+	err := db.c.QueryRowContext(ctx, "SELECT user_id, username FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf("user not found")
+			return nil, fmt.Errorf("user %q: %w", username, ErrNotFound)
 		}
 		return nil, fmt.Errorf("query error: %w", err)
 	}
 
 	// Fetch followers
-	rows, err := db.c.Query("SELECT follower_id FROM followers WHERE user_id = ?", user.ID)
+	rows, err := db.c.QueryContext(ctx, "SELECT follower_id FROM followers WHERE user_id = ?", user.ID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch followers: %w", err)
 	}
@@ -156,7 +176,7 @@ func (db *appdbimpl) GetUserProfile(username string) (*User, error) {
 	}
 
 	// Fetch following
-	rows, err = db.c.Query("SELECT user_id FROM followers WHERE follower_id = ?", user.ID)
+	rows, err = db.c.QueryContext(ctx, "SELECT user_id FROM followers WHERE follower_id = ?", user.ID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch following: %w", err)
 	}
@@ -173,7 +193,7 @@ func (db *appdbimpl) GetUserProfile(username string) (*User, error) {
 	}
 
 	// Fetch photos
-	rows, err = db.c.Query("SELECT photo_id FROM new_photos WHERE user_id = ?", user.ID)
+	rows, err = db.c.QueryContext(ctx, "SELECT photo_id FROM new_photos WHERE user_id = ?", user.ID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch photos: %w", err)
 	}
@@ -192,138 +212,186 @@ func (db *appdbimpl) GetUserProfile(username string) (*User, error) {
 	return &user, nil
 }
 
-func (db *appdbimpl) GetUserProfileByID(userID string) (*User, error) {
-	// Fetch basic user info
-	var user User
-	err := db.c.QueryRow("SELECT user_id, username FROM users WHERE user_id = ?", userID).Scan(&user.ID, &user.Username)
+// GetUserProfileByID returns the user with the number of followers, followed users and photos, as seen by viewerID.
+// The lists themselves are paginated: see GetFollowers, GetFollowing and GetUserPhotos. If the account is private and
+// viewerID is not an approved follower, Visible is false and the counts are zero. Bans apply as well: the profile is
+// not found if userID banned viewerID, and not visible if viewerID banned userID, who can still be unbanned.
+func (db *appdbimpl) GetUserProfileByID(ctx context.Context, userID string, viewerID string) (*UserProfile, error) {
+	var profile UserProfile
+	err := db.c.QueryRowContext(ctx, `
+		SELECT user_id, username, private, visible,
+			CASE WHEN visible THEN (SELECT COUNT(*) FROM followers WHERE user_id = u.user_id) ELSE 0 END,
+			CASE WHEN visible THEN (SELECT COUNT(*) FROM followers WHERE follower_id = u.user_id) ELSE 0 END,
+			CASE WHEN visible THEN (SELECT COUNT(*) FROM new_photos WHERE user_id = u.user_id) ELSE 0 END,
+			EXISTS (SELECT 1 FROM follow_requests WHERE user_id = u.user_id AND requester_id = ?)
+		FROM (
+			SELECT pu.user_id, pu.username, pu.private,
+				`+visibleTo("pu.user_id")+` AND `+notBlocked("pu.user_id", "?")+` AS visible
+			FROM users pu
+			WHERE pu.user_id = ? AND NOT EXISTS (
+				SELECT 1 FROM new_bans WHERE banned_by = pu.user_id AND banned_user = ?)
+		) u`, viewerID, viewerID, viewerID, viewerID, userID, viewerID).Scan(
+		&profile.ID, &profile.Username, &profile.Private, &profile.Visible, &profile.FollowersCount,
+		&profile.FollowingCount, &profile.PhotosCount, &profile.Requested,
+	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf("user not found")
+			return nil, fmt.Errorf("user %s: %w", userID, ErrNotFound)
 		}
 		return nil, fmt.Errorf("query error: %w", err)
 	}
+	return &profile, nil
+}
 
-	// Fetch followers
-	rows, err := db.c.Query("SELECT follower_id FROM followers WHERE user_id = ?", user.ID)
+// GetFollowers returns a page of the users following userID, sorted by username, and the cursor of the next page.
+// Users separated from viewerID by a ban are left out.
+func (db *appdbimpl) GetFollowers(ctx context.Context, userID string, viewerID string, page Page) ([]User, string,
+	error) {
+	return db.getUserPage(ctx, `
+		SELECT u.user_id, u.username
+		FROM followers f
+		JOIN users u ON u.user_id = f.follower_id
+		WHERE f.user_id = ? AND `+notBlocked("u.user_id", "?"), []interface{}{userID, viewerID}, page)
+}
+
+// GetFollowing returns a page of the users followed by userID, sorted by username, and the cursor of the next page.
+// Users separated from viewerID by a ban are left out.
+func (db *appdbimpl) GetFollowing(ctx context.Context, userID string, viewerID string, page Page) ([]User, string,
+	error) {
+	return db.getUserPage(ctx, `
+		SELECT u.user_id, u.username
+		FROM followers f
+		JOIN users u ON u.user_id = f.user_id
+		WHERE f.follower_id = ? AND `+notBlocked("u.user_id", "?"), []interface{}{userID, viewerID}, page)
+}
+
+// getUserPage runs a query selecting the ID and the username of users (with the "u" alias), and returns the requested
+// page sorted by username. The query must have a WHERE clause.
+func (db *appdbimpl) getUserPage(ctx context.Context, query string, args []interface{}, page Page) ([]User, string,
+	error) {
+	username := db.c.dialect.caseless("u.username")
+	cond, cursorArgs, err := page.keysetCondition(username, "u.user_id", "ASC")
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch followers: %w", err)
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var followerID string
-		if err := rows.Scan(&followerID); err != nil {
-			return nil, fmt.Errorf("failed to read follower row: %w", err)
-		}
-		user.Followers = append(user.Followers, followerID)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iteration error while fetching followers: %w", err)
+		return nil, "", err
 	}
-	rows.Close()
-
-	// Fetch following
-	rows, err = db.c.Query("SELECT user_id FROM followers WHERE follower_id = ?", user.ID)
+	args = append(append(args, cursorArgs...), page.limit()+1)
+	rows, err := db.c.QueryContext(ctx, query+" AND "+cond+" ORDER BY "+username+", u.user_id LIMIT ?", args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch following: %w", err)
+		return nil, "", fmt.Errorf("failed to query users: %w", err)
 	}
 	defer rows.Close()
+
+	users := []User{}
+	pager := page.pager()
 	for rows.Next() {
-		var followingID string
-		if err := rows.Scan(&followingID); err != nil {
-			return nil, fmt.Errorf("failed to read following row: %w", err)
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username); err != nil {
+			return nil, "", fmt.Errorf("failed to scan user: %w", err)
 		}
-		user.Following = append(user.Following, followingID)
+		// Both dialects compare the key ignoring case, but PostgreSQL doesn't lower the parameter
+		if !pager.add(strings.ToLower(user.Username), user.ID) {
+			break
+		}
+		users = append(users, user)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iteration error while fetching following: %w", err)
+
+	// Check for errors that may have occurred during iteration
+	if err = rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("rows error: %w", err)
 	}
-	rows.Close()
 
-	// Fetch photos
-	rows, err = db.c.Query("SELECT photo_id FROM new_photos WHERE user_id = ?", user.ID)
+	return users, pager.next, nil
+}
+
+// FollowUser makes followerID follow followedID. If followedID is a private account, a follow request is stored instead
+// and FollowUser returns true; the follow starts when followedID approves it (see ApproveFollowRequest). It returns
+// ErrNotFound if followedID doesn't exist or a ban separates the users, and ErrConflict if followerID already follows
+// followedID or already asked to.
+func (db *appdbimpl) FollowUser(ctx context.Context, followerID, followedID string) (bool, error) {
+	tx, err := db.c.BeginTx(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch photos: %w", err)
+		return false, err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var photoID string
-		if err := rows.Scan(&photoID); err != nil {
-			return nil, fmt.Errorf("failed to read photo row: %w", err)
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("tx.Rollback failed: %v", rbErr)
+			}
+		}
+	}()
+
+	// Users separated by a ban can't follow each other
+	var private bool
+	err = tx.QueryRowContext(ctx, `SELECT u.private FROM users u WHERE u.user_id = ? AND `+notBlocked("u.user_id", "?"),
+		followedID, followerID).Scan(&private)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("user %s: %w", followedID, ErrNotFound)
+		return false, err
+	} else if err != nil {
+		return false, fmt.Errorf("error following user: %w", err)
+	}
+
+	if private {
+		if err = addFollowRequest(ctx, tx, followedID, followerID); err != nil {
+			return false, err
+		}
+	} else {
+		_, err = tx.ExecContext(ctx, `INSERT INTO followers (user_id, follower_id) VALUES (?, ?)`, followedID, followerID)
+		if isUniqueViolation(err) {
+			return false, fmt.Errorf("user %s already follows %s: %w", followerID, followedID, ErrConflict)
+		} else if err != nil {
+			return false, fmt.Errorf("error following user: %w", err)
 		}
-		user.Photos = append(user.Photos, photoID)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iteration error while fetching photos: %w", err)
 	}
 
-	return &user, nil
-}
-
-func (db *appdbimpl) FollowUser(followerID, followedID string) error {
-	_, err := db.c.Exec(`INSERT INTO followers (user_id, follower_id) VALUES (?, ?)`, followedID, followerID)
-	if err != nil {
-		return fmt.Errorf("error following user: %w", err)
+	if err = tx.Commit(); err != nil {
+		return false, err
 	}
-	return nil
+	return private, nil
 }
 
-func (db *appdbimpl) UnfollowUser(followerID, followedID string) error {
-	_, err := db.c.Exec(`DELETE FROM followers WHERE user_id = ? AND follower_id = ?`, followedID, followerID)
+// UnfollowUser stops followerID from following followedID, and withdraws their pending follow request, if any.
+func (db *appdbimpl) UnfollowUser(ctx context.Context, followerID, followedID string) error {
+	_, err := db.c.ExecContext(ctx, `DELETE FROM followers WHERE user_id = ? AND follower_id = ?`, followedID, followerID)
 	if err != nil {
 		return fmt.Errorf("error unfollowing user: %w", err)
 	}
+	err = db.DeleteFollowRequest(ctx, followedID, followerID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("error unfollowing user: %w", err)
+	}
 	return nil
 }
 
-func (db *appdbimpl) GetUserIDByUsername(username string) (string, error) {
+func (db *appdbimpl) GetUserIDByUsername(ctx context.Context, username string) (string, error) {
 	var userID string
-	err := db.c.QueryRow("SELECT user_id FROM users WHERE username = ?", username).Scan(&userID)
+	err := db.c.QueryRowContext(ctx, "SELECT user_id FROM users WHERE username = ?", username).Scan(&userID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return "", fmt.Errorf("user not found")
+			return "", fmt.Errorf("user %q: %w", username, ErrNotFound)
 		}
 		return "", fmt.Errorf("query error: %w", err)
 	}
 	return userID, nil
 }
 
-func (db *appdbimpl) GetAllUsers(currentUserID string) ([]User, error) {
-	query := `
-		SELECT user_id, username
-		FROM users
-		WHERE user_id NOT IN (
+// GetAllUsers returns a page of all the users, except those who banned currentUserID, sorted by username, and the
+// cursor of the next page. Users banned by currentUserID are listed, so that they can be unbanned.
+func (db *appdbimpl) GetAllUsers(ctx context.Context, currentUserID string, page Page) ([]User, string, error) {
+	return db.getUserPage(ctx, `
+		SELECT u.user_id, u.username
+		FROM users u
+		WHERE u.user_id NOT IN (
 			SELECT banned_by
 			FROM new_bans
 			WHERE banned_user = ?
-		)
-	`
-	rows, err := db.c.Query(query, currentUserID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query users: %w", err)
-	}
-	defer rows.Close()
-
-	var users []User
-	for rows.Next() {
-		var user User
-		if err := rows.Scan(&user.ID, &user.Username); err != nil {
-			return nil, fmt.Errorf("failed to scan user: %w", err)
-		}
-		users = append(users, user)
-	}
-
-	// Check for errors that may have occurred during iteration
-	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("rows error: %w", err)
-	}
-
-	return users, nil
+		)`, []interface{}{currentUserID}, page)
 }
 
-func (db *appdbimpl) GetFollowersByUsername(username string) ([]string, error) {
+func (db *appdbimpl) GetFollowersByUsername(ctx context.Context, username string) ([]string, error) {
 	var followers []string
 	query := `SELECT follower_id FROM followers WHERE user_id = (SELECT user_id FROM users WHERE username = ?)`
-	rows, err := db.c.Query(query, username)
+	rows, err := db.c.QueryContext(ctx, query, username)
 	if err != nil {
 		return nil, fmt.Errorf("error querying followers: %w", err)
 	}
@@ -344,18 +412,18 @@ func (db *appdbimpl) GetFollowersByUsername(username string) ([]string, error) {
 	return followers, nil
 }
 
-func (db *appdbimpl) GetUsername(userID string) (string, error) {
+func (db *appdbimpl) GetUsername(ctx context.Context, userID string) (string, error) {
 	var username string
-	err := db.c.QueryRow("SELECT username FROM users WHERE user_id = ?", userID).Scan(&username)
+	err := db.c.QueryRowContext(ctx, "SELECT username FROM users WHERE user_id = ?", userID).Scan(&username)
 	if err != nil {
 		return "", fmt.Errorf("error getting username: %w", err)
 	}
 	return username, nil
 }
 
-func (db *appdbimpl) IsUserFollowed(followedID, followerID string) (bool, error) {
+func (db *appdbimpl) IsUserFollowed(ctx context.Context, followedID, followerID string) (bool, error) {
 	var exists bool
-	err := db.c.QueryRow("SELECT EXISTS(SELECT 1 FROM followers WHERE user_id = ? AND follower_id = ?)", followedID, followerID).Scan(&exists)
+	err := db.c.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM followers WHERE user_id = ? AND follower_id = ?)", followedID, followerID).Scan(&exists)
 	if err != nil {
 		return false, fmt.Errorf("error checking if user is followed: %w", err)
 	}
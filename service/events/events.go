@@ -0,0 +1,257 @@
+/*
+Package events delivers what happens in the app to the users it concerns while they are connected: new photos from the
+users they follow, likes and comments on their photos, and new followers.
+
+The Hub is an in-process publish/subscribe broker. Each connected client subscribes with the ID of its user and reads
+from Subscription.Events(); the API handlers publish an Event after the change is saved, and the Hub works out the
+recipients. Events are never delivered to the actor, nor between users when either of them banned the other. Nothing is
+stored: users that are not connected will see the change the next time they load the data.
+
+Example:
+
+	hub, err := events.New(events.Config{
+		Database: appdb,
+		Logger:   logger,
+	})
+	if err != nil {
+		return fmt.Errorf("creating the event hub: %w", err)
+	}
+	defer hub.Close()
+
+	sub, err := hub.Subscribe(user.ID)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	for e := range sub.Events() {
+		// send e to the client
+	}
+*/
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/sirupsen/logrus"
+)
+
+// Event types
+const (
+	// TypePhoto is sent to the followers of the actor when they upload a photo
+	TypePhoto = "photo"
+	// TypeLike is sent to the owner of the photo liked by the actor
+	TypeLike = "like"
+	// TypeComment is sent to the owner of the photo commented by the actor
+	TypeComment = "comment"
+	// TypeFollow is sent to the user followed by the actor
+	TypeFollow = "follow"
+)
+
+// defaultBufferSize is the number of events kept for a slow subscriber, if Config.BufferSize is not set.
+const defaultBufferSize = 16
+
+// ErrClosed is returned by Subscribe after the hub has been closed.
+var ErrClosed = errors.New("event hub closed")
+
+// Event is something that happened in the app.
+type Event struct {
+	Type          string    `json:"type"`                // One of the Type* constants
+	ActorID       string    `json:"actorId"`             // ID of the user who caused the event
+	ActorUsername string    `json:"actorUsername"`       // Username of the actor
+	UserID        string    `json:"userId,omitempty"`    // ID of the followed user, for follow events
+	PhotoID       string    `json:"photoId,omitempty"`   // ID of the photo, for photo, like and comment events
+	CommentID     string    `json:"commentId,omitempty"` // ID of the comment, for comment events
+	Timestamp     time.Time `json:"timestamp"`           // Timestamp of the event
+}
+
+// Config is used to provide dependencies and configuration to the New function.
+type Config struct {
+	// Database is used to find the recipients of the events and to check the bans
+	Database database.AppDatabase
+
+	// Logger where log entries are sent
+	Logger logrus.FieldLogger
+
+	// BufferSize is the number of events that can wait for a subscriber. A subscriber that falls further behind is
+	// disconnected. Defaults to 16.
+	BufferSize int
+}
+
+// Hub dispatches the published events to the subscriptions of their recipients.
+type Hub struct {
+	db         database.AppDatabase
+	logger     logrus.FieldLogger
+	bufferSize int
+
+	mu sync.Mutex
+	// subscriptions holds the open subscriptions of each user; a user may be connected from several clients
+	subscriptions map[string]map[*Subscription]struct{}
+	closed        bool
+}
+
+// New returns a new Hub instance
+func New(cfg Config) (*Hub, error) {
+	if cfg.Database == nil {
+		return nil, errors.New("database is required")
+	}
+	if cfg.Logger == nil {
+		return nil, errors.New("logger is required")
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = defaultBufferSize
+	}
+	return &Hub{
+		db:            cfg.Database,
+		logger:        cfg.Logger,
+		bufferSize:    cfg.BufferSize,
+		subscriptions: make(map[string]map[*Subscription]struct{}),
+	}, nil
+}
+
+// Subscription receives the events for a user until it is closed.
+type Subscription struct {
+	hub    *Hub
+	userID string
+	events chan Event
+}
+
+// Subscribe starts receiving the events for userID. The caller must Close the subscription when done.
+func (h *Hub) Subscribe(userID string) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrClosed
+	}
+	sub := &Subscription{
+		hub:    h,
+		userID: userID,
+		events: make(chan Event, h.bufferSize),
+	}
+	if h.subscriptions[userID] == nil {
+		h.subscriptions[userID] = make(map[*Subscription]struct{})
+	}
+	h.subscriptions[userID][sub] = struct{}{}
+	return sub, nil
+}
+
+// Events returns the channel of the events. It is closed when the hub is closed, or when the subscriber doesn't keep
+// up with the events.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close stops the subscription. It is safe to call Close more than once.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// Publish delivers e to the connected recipients: the followers of the actor for photo events, the owner of the photo
+// for like and comment events, and the followed user for follow events. ctx bounds the queries that find the recipients.
+func (h *Hub) Publish(ctx context.Context, e Event) error {
+	if !h.hasSubscribers() {
+		return nil
+	}
+
+	var recipients []string
+	switch e.Type {
+	case TypePhoto:
+		followers, err := h.db.GetFollowersByUsername(ctx, e.ActorUsername)
+		if err != nil {
+			return fmt.Errorf("getting the followers: %w", err)
+		}
+		recipients = followers
+	case TypeLike, TypeComment:
+		ownerID, err := h.db.GetPhotoOwner(ctx, e.PhotoID)
+		if err != nil {
+			return fmt.Errorf("getting the photo owner: %w", err)
+		}
+		if ownerID != "" {
+			recipients = []string{ownerID}
+		}
+	case TypeFollow:
+		recipients = []string{e.UserID}
+	default:
+		return fmt.Errorf("unknown event type %q", e.Type)
+	}
+
+	for _, userID := range h.connected(recipients) {
+		if userID == e.ActorID {
+			continue
+		}
+		blocked, err := h.db.Blocked(ctx, userID, e.ActorID)
+		if err != nil {
+			return fmt.Errorf("checking the bans: %w", err)
+		}
+		if !blocked {
+			h.deliver(userID, e)
+		}
+	}
+	return nil
+}
+
+// Close disconnects all the subscribers; Subscribe fails afterwards.
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for _, subs := range h.subscriptions {
+		for sub := range subs {
+			h.remove(sub)
+		}
+	}
+	return nil
+}
+
+func (h *Hub) hasSubscribers() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscriptions) > 0
+}
+
+// connected returns the users in userIDs that have at least one subscription.
+func (h *Hub) connected(userIDs []string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var ret []string
+	for _, id := range userIDs {
+		if len(h.subscriptions[id]) > 0 {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+// deliver sends e to every subscription of userID without blocking. A subscription whose buffer is full is closed:
+// the client is expected to reconnect and reload the data.
+func (h *Hub) deliver(userID string, e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subscriptions[userID] {
+		select {
+		case sub.events <- e:
+		default:
+			h.logger.WithField("user", userID).Warning("event subscriber too slow, disconnecting")
+			h.remove(sub)
+		}
+	}
+}
+
+// remove deletes the subscription and closes its channel, if still open. The caller must hold h.mu.
+func (h *Hub) remove(sub *Subscription) {
+	subs := h.subscriptions[sub.userID]
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subscriptions, sub.userID)
+	}
+	close(sub.events)
+}
@@ -0,0 +1,191 @@
+/*
+Package imaging validates and normalizes the images uploaded by users, and generates their thumbnails.
+
+Process accepts JPEG, PNG, GIF and WebP files and rejects everything else. The returned image has no metadata (EXIF,
+GPS coordinates, XMP, comments, etc.) and is already rotated according to its EXIF orientation, so clients can display
+it as-is. When the image does not need to be rotated, metadata are removed without re-encoding the pixels.
+
+Example:
+
+	img, err := imaging.Process(data)
+	if errors.Is(err, imaging.ErrUnsupportedFormat) {
+		// reply with 415 Unsupported Media Type
+	} else if err != nil {
+		// reply with 400 Bad Request: the file is corrupted or too big
+	}
+	// img.Data, img.ContentType, img.Thumbnails
+*/
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	// Register the WebP decoder for image.Decode
+	_ "golang.org/x/image/webp"
+)
+
+// MaxPixels is the maximum number of pixels (width * height) of an accepted image. Decoding allocates memory
+// proportional to the number of pixels, so the limit protects from small files with huge dimensions.
+const MaxPixels = 50_000_000
+
+// ThumbnailSizes are the sizes, in pixels, of the longest side of the generated thumbnails, in ascending order.
+var ThumbnailSizes = []int{160, 320, 640}
+
+var (
+	// ErrUnsupportedFormat is returned for files that are not JPEG, PNG, GIF or WebP images
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+
+	// ErrInvalidImage is returned for corrupted images, or images bigger than MaxPixels
+	ErrInvalidImage = errors.New("invalid image")
+)
+
+// Image is a processed image.
+type Image struct {
+	// Data is the normalized image file, in the same format of the upload
+	Data []byte
+
+	// ContentType is the media type of Data, e.g. "image/jpeg"
+	ContentType string
+
+	// Width and Height are the dimensions of the image, after the rotation
+	Width  int
+	Height int
+
+	// Thumbnails contains a JPEG file for each of the ThumbnailSizes smaller than the image
+	Thumbnails map[int][]byte
+}
+
+type format struct {
+	contentType string
+	magic       func(data []byte) bool
+	// strip returns the file without metadata, and the EXIF orientation found (1 if none)
+	strip func(data []byte) ([]byte, int, error)
+	// encode is used to write the image again when it must be rotated
+	encode func(img image.Image) ([]byte, error)
+}
+
+var formats = []format{
+	{
+		contentType: "image/jpeg",
+		magic:       func(data []byte) bool { return bytes.HasPrefix(data, []byte("\xff\xd8\xff")) },
+		strip:       stripJPEG,
+		encode:      encodeJPEG,
+	},
+	{
+		contentType: "image/png",
+		magic:       func(data []byte) bool { return bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) },
+		strip:       stripPNG,
+		encode:      encodePNG,
+	},
+	{
+		contentType: "image/gif",
+		magic: func(data []byte) bool {
+			return bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))
+		},
+		strip: stripGIF,
+	},
+	{
+		contentType: "image/webp",
+		magic: func(data []byte) bool {
+			return len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WEBP"
+		},
+		strip: stripWebP,
+		// There is no WebP encoder in the standard library: rotated WebP images are stored as PNG
+		encode: encodePNG,
+	},
+}
+
+// Process validates data and returns the normalized image along with its thumbnails.
+func Process(data []byte) (*Image, error) {
+	var f *format
+	for i := range formats {
+		if formats[i].magic(data) {
+			f = &formats[i]
+			break
+		}
+	}
+	if f == nil {
+		return nil, ErrUnsupportedFormat
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return nil, fmt.Errorf("%w: %dx%d pixels", ErrInvalidImage, cfg.Width, cfg.Height)
+	}
+
+	stripped, orientation, err := f.strip(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+
+	// Decoding the whole file also makes sure that it is not truncated or corrupted
+	img, _, err := image.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+
+	result := &Image{Data: stripped, ContentType: f.contentType}
+	if orientation != 1 && f.encode != nil {
+		img = orient(img, orientation)
+		result.Data, err = f.encode(img)
+		if err != nil {
+			return nil, fmt.Errorf("encoding the rotated image: %w", err)
+		}
+		if f.contentType == "image/webp" {
+			result.ContentType = "image/png"
+		}
+	}
+	result.Width = img.Bounds().Dx()
+	result.Height = img.Bounds().Dy()
+
+	// Each thumbnail is scaled from the previous (bigger) one, which is much faster than starting from the original
+	result.Thumbnails = make(map[int][]byte, len(ThumbnailSizes))
+	src := img
+	for i := len(ThumbnailSizes) - 1; i >= 0; i-- {
+		size := ThumbnailSizes[i]
+		if size >= result.Width && size >= result.Height {
+			continue
+		}
+		src = scale(src, size)
+		result.Thumbnails[size], err = encodeThumbnail(src)
+		if err != nil {
+			return nil, fmt.Errorf("generating the %d pixels thumbnail: %w", size, err)
+		}
+	}
+	return result, nil
+}
+
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	return buf.Bytes(), err
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+// stripGIF writes the GIF again: the encoder keeps frames, delays, disposal and loop count, but not the comment and
+// application extensions where metadata are stored. GIF files have no EXIF orientation.
+func stripGIF(data []byte) ([]byte, int, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), 1, nil
+}
@@ -0,0 +1,181 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var errTruncated = errors.New("truncated file")
+
+// stripJPEG removes the APP1 (EXIF, XMP), APP13 (IPTC) and COM segments. Other segments (e.g., the ICC color profile)
+// and the compressed data are copied verbatim, and anything after the end of the image is dropped.
+func stripJPEG(data []byte) ([]byte, int, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...) // SOI
+	orientation := 1
+
+	i := 2
+	for i+2 <= len(data) {
+		if data[i] != 0xff {
+			return nil, 0, errors.New("invalid JPEG marker")
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xff:
+			// Fill byte before a marker
+			i++
+			continue
+		case marker == 0xd9:
+			// EOI: end of image
+			out = append(out, 0xff, 0xd9)
+			return out, orientation, nil
+		case marker >= 0xd0 && marker <= 0xd7, marker == 0x01:
+			// Markers without a payload
+			out = append(out, data[i:i+2]...)
+			i += 2
+			continue
+		}
+
+		if i+4 > len(data) {
+			return nil, 0, errTruncated
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, 0, errTruncated
+		}
+		segment := data[i : i+2+length]
+		switch marker {
+		case 0xe1:
+			if payload := segment[4:]; bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+				orientation = exifOrientation(payload[6:])
+			}
+		case 0xed, 0xfe:
+		default:
+			out = append(out, segment...)
+		}
+		i += len(segment)
+
+		if marker == 0xda {
+			// SOS: the compressed data follows, up to the next marker that is not a restart marker. 0xff bytes in the
+			// data are followed by 0x00.
+			start := i
+			for i+1 < len(data) && (data[i] != 0xff || data[i+1] == 0x00 || (data[i+1] >= 0xd0 && data[i+1] <= 0xd7)) {
+				i++
+			}
+			out = append(out, data[start:i]...)
+		}
+	}
+	return nil, 0, errTruncated
+}
+
+// stripPNG removes the eXIf, tEXt, zTXt, iTXt and tIME chunks.
+func stripPNG(data []byte) ([]byte, int, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:8]...) // signature
+	orientation := 1
+
+	i := 8
+	for i+12 <= len(data) {
+		length := int64(binary.BigEndian.Uint32(data[i:]))
+		if int64(i)+12+length > int64(len(data)) {
+			return nil, 0, errTruncated
+		}
+		end := i + 12 + int(length)
+		chunkType := string(data[i+4 : i+8])
+		switch chunkType {
+		case "eXIf":
+			orientation = exifOrientation(data[i+8 : end-4])
+		case "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+		if chunkType == "IEND" {
+			return out, orientation, nil
+		}
+	}
+	return nil, 0, errTruncated
+}
+
+// stripWebP removes the EXIF and XMP chunks of an extended WebP file, and clears their flags in the VP8X header.
+func stripWebP(data []byte) ([]byte, int, error) {
+	end := 8 + int64(binary.LittleEndian.Uint32(data[4:8]))
+	if end > int64(len(data)) {
+		return nil, 0, errTruncated
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:12]...) // RIFF header
+	orientation := 1
+	vp8x := -1
+
+	i := int64(12)
+	for i < end {
+		if i+8 > end {
+			return nil, 0, errTruncated
+		}
+		size := int64(binary.LittleEndian.Uint32(data[i+4:]))
+		next := i + 8 + size + size%2 // chunks are padded to an even size
+		if i+8+size > end {
+			return nil, 0, errTruncated
+		} else if next > end {
+			next = end
+		}
+		switch string(data[i : i+4]) {
+		case "EXIF":
+			exif := data[i+8 : i+8+size]
+			orientation = exifOrientation(bytes.TrimPrefix(exif, []byte("Exif\x00\x00")))
+		case "XMP ":
+		case "VP8X":
+			vp8x = len(out)
+			out = append(out, data[i:next]...)
+		default:
+			out = append(out, data[i:next]...)
+		}
+		i = next
+	}
+
+	if vp8x >= 0 && vp8x+9 <= len(out) {
+		const exifFlag, xmpFlag = 0x08, 0x04
+		out[vp8x+8] &^= exifFlag | xmpFlag
+	}
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out, orientation, nil
+}
+
+// exifOrientation reads the Orientation tag from the first IFD of EXIF data (a TIFF structure). It returns 1 (normal
+// orientation) if the tag is missing or invalid.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int64(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > int64(len(tiff)) {
+		return 1
+	}
+	entries := int64(order.Uint16(tiff[ifd:]))
+	for k := int64(0); k < entries; k++ {
+		entry := ifd + 2 + 12*k
+		if entry+12 > int64(len(tiff)) {
+			return 1
+		}
+		const orientationTag, shortType = 0x0112, 3
+		if order.Uint16(tiff[entry:]) == orientationTag && order.Uint16(tiff[entry+2:]) == shortType {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
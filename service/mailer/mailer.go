@@ -0,0 +1,25 @@
+/*
+Package mailer delivers to the users the messages that must not go anywhere else, like the password reset tokens: the
+tokens are secrets, so they are never written to the log or returned by the API.
+
+There is no mail server integration yet, and the users have no e-mail address: without a Mailer in api.Config, the
+password reset routes reply 501 Not Implemented. Pass an implementation to enable them:
+
+	apirouter, err := api.New(api.Config{
+		// ...
+		Mailer: smtpMailer,
+	})
+*/
+package mailer
+
+import (
+	"context"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+// Mailer is the interface implemented by all message deliveries.
+type Mailer interface {
+	// SendPasswordReset delivers a one-time password reset token to user
+	SendPasswordReset(ctx context.Context, user database.User, token string) error
+}
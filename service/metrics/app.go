@@ -0,0 +1,35 @@
+package metrics
+
+import "runtime"
+
+// HTTPRequests counts the API requests, by method, route (the name of the handler) and status code.
+var HTTPRequests = NewCounterVec("decaf_http_requests_total",
+	"API requests handled, by method, route and status code.", "method", "route", "code")
+
+// HTTPRequestDuration is the time spent handling the API requests, by method and route. Streams (GET /events) are not
+// observed, since they last as long as the client is connected.
+var HTTPRequestDuration = NewHistogramVec("decaf_http_request_duration_seconds",
+	"Time spent handling API requests, by method and route.", DefaultBuckets, "method", "route")
+
+// DBQueryDuration is the time spent executing database statements, by operation: the AppDatabase method, or the helper
+// of the database package, that runs the statement.
+var DBQueryDuration = NewHistogramVec("decaf_db_query_duration_seconds",
+	"Time spent executing database statements, by database operation.", DefaultBuckets, "operation")
+
+// PhotosUploaded counts the photos uploaded.
+var PhotosUploaded = NewCounterVec("decaf_photos_uploaded_total", "Photos uploaded.")
+
+// ImagesUploaded counts the images of the photos uploaded.
+var ImagesUploaded = NewCounterVec("decaf_images_uploaded_total", "Images of the photos uploaded.")
+
+// Likes counts the likes added, by target ("photo" or "comment").
+var Likes = NewCounterVec("decaf_likes_total", "Likes added, by target.", "target")
+
+// Comments counts the comments added, by kind ("comment" or "reply").
+var Comments = NewCounterVec("decaf_comments_total", "Comments added, by kind.", "kind")
+
+func init() {
+	NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+}
@@ -0,0 +1,289 @@
+/*
+Package metrics collects counters and latency histograms and exposes them in the Prometheus text format, so that the
+debug server can serve them at /metrics.
+
+Metrics are registered once, when they are created, in a registry shared by the whole process (like expvar). The
+metrics of the app are declared in app.go; other packages only update them.
+
+Example:
+
+	start := time.Now()
+	// ... handle the request
+	metrics.HTTPRequests.Inc("GET", "handleGetPhoto", "200")
+	metrics.HTTPRequestDuration.Observe(time.Since(start).Seconds(), "GET", "handleGetPhoto")
+
+	// In the debug server
+	mux.Handle("/metrics", metrics.Handler())
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector is a metric that can be written in the Prometheus text format.
+type collector interface {
+	// name returns the name of the metric, unique in the registry
+	name() string
+
+	// write appends the HELP and TYPE lines of the metric, followed by its samples
+	write(w *bufio.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]collector{}
+)
+
+// register adds the metric to the registry. It panics if the name is already used, like expvar.Publish.
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[c.name()]; ok {
+		panic("metrics: duplicate metric name " + c.name())
+	}
+	registry[c.name()] = c
+}
+
+// Handler returns an HTTP handler that writes all the registered metrics, sorted by name.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryMu.Lock()
+		collectors := make([]collector, 0, len(registry))
+		for _, c := range registry {
+			collectors = append(collectors, c)
+		}
+		registryMu.Unlock()
+		sort.Slice(collectors, func(i, j int) bool { return collectors[i].name() < collectors[j].name() })
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buf := bufio.NewWriter(w)
+		for _, c := range collectors {
+			c.write(buf)
+		}
+		_ = buf.Flush()
+	})
+}
+
+// desc holds what every metric has: the name, the help text and the names of the labels.
+type desc struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+// writeHeader writes the HELP and TYPE lines of the metric.
+func (d *desc) writeHeader(w *bufio.Writer, kind string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metricName, escapeHelp(d.help), d.metricName, kind)
+}
+
+// key returns the key of the series with the given label values. It panics if the number of values doesn't match the
+// labels of the metric, as it's a programming error.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.metricName, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels returns the labels of a sample, e.g. `{method="GET",code="200"}`, followed by the extra label if
+// given (used for the "le" label of the histogram buckets).
+func (d *desc) formatLabels(values []string, extraName string, extraValue string) string {
+	if len(d.labels) == 0 && extraName == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, label := range d.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(label + `="` + escapeLabel(values[i]) + `"`)
+	}
+	if extraName != "" {
+		if len(d.labels) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extraName + `="` + escapeLabel(extraValue) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// CounterVec is a counter with labels: each combination of label values is a separate series.
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	values []string
+	count  float64
+}
+
+// NewCounterVec creates and registers a counter. The name should end with "_total".
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{metricName: name, help: help, labels: labels},
+		series: map[string]*counterSeries{},
+	}
+	register(c)
+	return c
+}
+
+// Inc increments by one the series with the given label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add increments the series with the given label values. Counters can only go up: negative values are ignored.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if delta < 0 {
+		return
+	}
+	key := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{values: append([]string(nil), values...)}
+		c.series[key] = s
+	}
+	s.count += delta
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Sorted, so that consecutive scrapes are easy to compare
+	keys := make([]string, 0, len(c.series))
+	for k := range c.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := c.series[k]
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.formatLabels(s.values, "", ""), formatFloat(s.count))
+	}
+}
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of latency histograms: from 1 millisecond to 10
+// seconds.
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// HistogramVec is a histogram with labels: each combination of label values is a separate series.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64 // One per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec creates and registers a histogram with the given bucket upper bounds, in increasing order.
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{metricName: name, help: help, labels: labels},
+		buckets: buckets,
+		series:  map[string]*histogramSeries{},
+	}
+	register(h)
+	return h
+}
+
+// Observe adds a value to the series with the given label values.
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	key := h.key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: append([]string(nil), values...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Sorted, so that consecutive scrapes are easy to compare
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.formatLabels(s.values, "le", formatFloat(upper)),
+				cumulative)
+		}
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.formatLabels(s.values, "le", "+Inf"), s.count)
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.formatLabels(s.values, "", ""), formatFloat(s.sum))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.formatLabels(s.values, "", ""), s.count)
+	}
+}
+
+// GaugeFunc is a gauge without labels whose value is read when the metrics are written.
+type GaugeFunc struct {
+	desc
+	value func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge that reports the value returned by fn.
+func NewGaugeFunc(name string, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{metricName: name, help: help}, value: fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w, "gauge")
+	_, _ = fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.value()))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,225 @@
+/*
+Package notifications records the events that concern a user: another user liked or commented one of their photos,
+replied to one of their comments, started following them, or mentioned them in a comment or a caption.
+
+The API handlers report each event after the change is saved; the Notifier works out the recipient and stores the
+notification through database.AppDatabase. Users never get notifications for their own actions, nor from users they
+banned (the ban check is done by the database when the notification is stored, and again when it is listed).
+
+Example:
+
+	notifier, err := notifications.New(notifications.Config{
+		Database: appdb,
+	})
+	if err != nil {
+		return fmt.Errorf("creating the notifier: %w", err)
+	}
+
+	if err := notifier.Liked(r.Context(), user.ID, photoID); err != nil {
+		// the like is saved anyway: log the error
+	}
+*/
+package notifications
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/gofrs/uuid"
+)
+
+// Config is used to provide dependencies and configuration to the New function.
+type Config struct {
+	// Database is where notifications are persisted
+	Database database.AppDatabase
+}
+
+// Notifier turns the events reported by the API into notifications.
+type Notifier struct {
+	db database.AppDatabase
+}
+
+// New returns a new Notifier instance
+func New(cfg Config) (*Notifier, error) {
+	if cfg.Database == nil {
+		return nil, errors.New("database is required")
+	}
+	return &Notifier{db: cfg.Database}, nil
+}
+
+// Liked notifies the owner of the photo that actorID liked it.
+func (n *Notifier) Liked(ctx context.Context, actorID string, photoID string) error {
+	return n.notifyPhotoOwner(ctx, database.NotificationLike, actorID, photoID, "")
+}
+
+// Unliked withdraws the notification sent by Liked.
+func (n *Notifier) Unliked(ctx context.Context, actorID string, photoID string) error {
+	return n.db.DeleteNotifications(ctx, database.Notification{
+		Type:    database.NotificationLike,
+		ActorID: actorID,
+		PhotoID: photoID,
+	})
+}
+
+// Commented notifies the owner of the photo that actorID added a comment. Notifications about a comment are removed
+// by the database along with the comment.
+func (n *Notifier) Commented(ctx context.Context, actorID string, photoID string, commentID string) error {
+	return n.notifyPhotoOwner(ctx, database.NotificationComment, actorID, photoID, commentID)
+}
+
+// Replied notifies the author of the comment repliedToID that actorID replied to it with commentID, and the owner of
+// the photo that a comment was added, unless they are the same user. Deleted comments have no author to notify.
+func (n *Notifier) Replied(ctx context.Context, actorID string, photoID string, commentID string,
+	repliedToID string) error {
+	authorID, err := n.db.GetCommentOwner(ctx, repliedToID)
+	if err != nil {
+		return fmt.Errorf("getting the comment owner: %w", err)
+	}
+	if authorID != "" {
+		if err := n.notify(ctx, database.Notification{
+			RecipientID: authorID,
+			ActorID:     actorID,
+			Type:        database.NotificationReply,
+			PhotoID:     photoID,
+			CommentID:   commentID,
+		}); err != nil {
+			return err
+		}
+	}
+	ownerID, err := n.db.GetPhotoOwner(ctx, photoID)
+	if err != nil {
+		return fmt.Errorf("getting the photo owner: %w", err)
+	}
+	if ownerID == "" || ownerID == authorID {
+		return nil
+	}
+	return n.notify(ctx, database.Notification{
+		RecipientID: ownerID,
+		ActorID:     actorID,
+		Type:        database.NotificationComment,
+		PhotoID:     photoID,
+		CommentID:   commentID,
+	})
+}
+
+// Followed notifies userID that actorID started following them.
+func (n *Notifier) Followed(ctx context.Context, actorID string, userID string) error {
+	return n.notify(ctx, database.Notification{
+		RecipientID: userID,
+		ActorID:     actorID,
+		Type:        database.NotificationFollow,
+	})
+}
+
+// Unfollowed withdraws the notification sent by Followed.
+func (n *Notifier) Unfollowed(ctx context.Context, actorID string, userID string) error {
+	return n.db.DeleteNotifications(ctx, database.Notification{
+		Type:        database.NotificationFollow,
+		ActorID:     actorID,
+		RecipientID: userID,
+	})
+}
+
+// Mentioned notifies userIDs that actorID mentioned them in the caption of the photo or, if commentID is set, in a
+// comment of the photo. Users who can't see the photo (see database.AppDatabase.CanView) are not notified, and neither
+// are the ones Commented or Replied already notified of the comment: one action, one notification.
+func (n *Notifier) Mentioned(ctx context.Context, actorID string, photoID string, commentID string,
+	userIDs []string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	ownerID, err := n.db.GetPhotoOwner(ctx, photoID)
+	if err != nil {
+		return fmt.Errorf("getting the photo owner: %w", err)
+	}
+	if ownerID == "" {
+		// The photo was deleted in the meantime
+		return nil
+	}
+	notified, err := n.notifiedOfComment(ctx, ownerID, commentID)
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		if notified[userID] {
+			continue
+		}
+		visible, err := n.db.CanView(ctx, userID, ownerID)
+		if err != nil {
+			return fmt.Errorf("checking the photo visibility: %w", err)
+		}
+		if !visible {
+			continue
+		}
+		if err := n.notify(ctx, database.Notification{
+			RecipientID: userID,
+			ActorID:     actorID,
+			Type:        database.NotificationMention,
+			PhotoID:     photoID,
+			CommentID:   commentID,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifiedOfComment returns the users that Commented or Replied notify of commentID, a comment of the photo of ownerID:
+// the owner, and the author of the comment replied to. It returns no one for a caption (commentID not set).
+func (n *Notifier) notifiedOfComment(ctx context.Context, ownerID string, commentID string) (map[string]bool, error) {
+	if commentID == "" {
+		return nil, nil
+	}
+	notified := map[string]bool{ownerID: true}
+	comment, err := n.db.GetComment(ctx, commentID)
+	if err != nil {
+		return nil, fmt.Errorf("getting the comment: %w", err)
+	}
+	if comment != nil && comment.ParentID != "" {
+		authorID, err := n.db.GetCommentOwner(ctx, comment.ParentID)
+		if err != nil {
+			return nil, fmt.Errorf("getting the comment owner: %w", err)
+		}
+		notified[authorID] = true
+	}
+	return notified, nil
+}
+
+func (n *Notifier) notifyPhotoOwner(ctx context.Context, notificationType string, actorID string, photoID string,
+	commentID string) error {
+	ownerID, err := n.db.GetPhotoOwner(ctx, photoID)
+	if err != nil {
+		return fmt.Errorf("getting the photo owner: %w", err)
+	}
+	if ownerID == "" {
+		// The photo was deleted in the meantime
+		return nil
+	}
+	return n.notify(ctx, database.Notification{
+		RecipientID: ownerID,
+		ActorID:     actorID,
+		Type:        notificationType,
+		PhotoID:     photoID,
+		CommentID:   commentID,
+	})
+}
+
+// notify stores the notification, unless the actor is the recipient.
+func (n *Notifier) notify(ctx context.Context, notification database.Notification) error {
+	if notification.ActorID == notification.RecipientID {
+		return nil
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return fmt.Errorf("generating the notification ID: %w", err)
+	}
+	notification.ID = id.String()
+	notification.CreatedAt = globaltime.Now().UTC()
+	if _, err := n.db.AddNotification(ctx, notification); err != nil {
+		return fmt.Errorf("storing the notification: %w", err)
+	}
+	return nil
+}
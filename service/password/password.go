@@ -0,0 +1,87 @@
+/*
+Package password hashes and verifies account passwords using Argon2id.
+
+Hashes are stored in the PHC string format, so that parameters can be raised in the future without breaking existing
+hashes:
+
+	$argon2id$v=19$m=65536,t=1,p=4$<base64 salt>$<base64 key>
+*/
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// MinLength is the minimum accepted password length
+	MinLength = 8
+	// MaxLength is the maximum accepted password length, to bound the hashing cost of a request
+	MaxLength = 256
+
+	memory     = 64 * 1024
+	iterations = 1
+	threads    = 4
+	keyLen     = 32
+	saltLen    = 16
+)
+
+// ErrInvalidHash is returned when a stored hash cannot be parsed.
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// Validate checks that a password respects the length policy.
+func Validate(password string) error {
+	if len(password) < MinLength {
+		return fmt.Errorf("password must be at least %d characters long", MinLength)
+	}
+	if len(password) > MaxLength {
+		return fmt.Errorf("password must be at most %d characters long", MaxLength)
+	}
+	return nil
+}
+
+// Hash derives a salted Argon2id hash of the password, encoded as a PHC string.
+func Hash(password string) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("generating salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, iterations, memory, threads, keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, memory, iterations, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify reports whether the password matches the encoded hash.
+func Verify(password, encoded string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, ErrInvalidHash
+	}
+	var m, t uint32
+	var p uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil {
+		return false, ErrInvalidHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, ErrInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, ErrInvalidHash
+	}
+
+	other := argon2.IDKey([]byte(password), salt, t, m, p, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
@@ -0,0 +1,92 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	hash, err := Hash("correct horse battery")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=1,p=4$") {
+		t.Errorf("Hash: %q is not a PHC string with the current parameters", hash)
+	}
+
+	for pw, want := range map[string]bool{
+		"correct horse battery":  true,
+		"correct horse batterY":  false,
+		"correct horse battery ": false,
+		"":                       false,
+	} {
+		ok, err := Verify(pw, hash)
+		if err != nil || ok != want {
+			t.Errorf("Verify(%q): got (%v, %v), want (%v, nil)", pw, ok, err, want)
+		}
+	}
+}
+
+func TestHashIsSalted(t *testing.T) {
+	first, err := Hash("correct horse battery")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	second, err := Hash("correct horse battery")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if first == second {
+		t.Error("two hashes of the same password must differ")
+	}
+}
+
+func TestVerifyParameters(t *testing.T) {
+	// A hash made with other parameters (e.g., before they were raised) must still verify: they are read from the hash
+	const hash = "$argon2id$v=19$m=8,t=2,p=1$c29tZXNhbHRzb21lc2FsdA$FfkJZkhmHfSV2WdQ7IDLMJ0yiB/lvkidHyOUCw9zXfU"
+	if ok, err := Verify("password", hash); !ok || err != nil {
+		t.Errorf("Verify: got (%v, %v), want (true, nil)", ok, err)
+	}
+	if ok, err := Verify("password", strings.Replace(hash, "t=2", "t=3", 1)); ok || err != nil {
+		t.Errorf("Verify with tampered parameters: got (%v, %v), want (false, nil)", ok, err)
+	}
+}
+
+func TestVerifyInvalidHash(t *testing.T) {
+	const salt, key = "c29tZXNhbHRzb21lc2FsdA", "FfkJZkhmHfSV2WdQ7IDLMJ0yiB/lvkidHyOUCw9zXfU"
+	hashes := map[string]string{
+		"empty":             "",
+		"bcrypt":            "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+		"argon2i":           "$argon2i$v=19$m=65536,t=1,p=4$" + salt + "$" + key,
+		"missing field":     "$argon2id$v=19$m=65536,t=1,p=4$" + salt,
+		"extra field":       "$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$" + key + "$x",
+		"old version":       "$argon2id$v=16$m=65536,t=1,p=4$" + salt + "$" + key,
+		"no version":        "$argon2id$m=65536,t=1,p=4$" + salt + "$" + key + "$",
+		"bad parameters":    "$argon2id$v=19$m=lots,t=1,p=4$" + salt + "$" + key,
+		"threads overflow":  "$argon2id$v=19$m=65536,t=1,p=256$" + salt + "$" + key,
+		"salt not base64":   "$argon2id$v=19$m=65536,t=1,p=4$!!!$" + key,
+		"key not base64":    "$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$!!!",
+		"padded salt":       "$argon2id$v=19$m=65536,t=1,p=4$" + salt + "==$" + key,
+		"no leading dollar": "argon2id$v=19$m=65536,t=1,p=4$" + salt + "$" + key + "$",
+	}
+	for name, hash := range hashes {
+		ok, err := Verify("password", hash)
+		if ok || !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("%s: got (%v, %v), want ErrInvalidHash", name, ok, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for pw, valid := range map[string]bool{
+		strings.Repeat("a", MinLength-1): false,
+		strings.Repeat("a", MinLength):   true,
+		strings.Repeat("a", MaxLength):   true,
+		strings.Repeat("a", MaxLength+1): false,
+	} {
+		if err := Validate(pw); (err == nil) != valid {
+			t.Errorf("Validate(%d characters): got %v", len(pw), err)
+		}
+	}
+}
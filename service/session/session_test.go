@@ -0,0 +1,194 @@
+package session
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// fakeDB keeps the sessions in memory. Only the session methods are implemented: the others panic.
+type fakeDB struct {
+	database.AppDatabase
+	sessions map[string]database.Session
+}
+
+func (db *fakeDB) AddSession(_ context.Context, s database.Session) error {
+	db.sessions[s.ID] = s
+	return nil
+}
+
+func (db *fakeDB) GetSession(_ context.Context, sessionID string) (*database.Session, error) {
+	s, ok := db.sessions[sessionID]
+	if !ok {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+func (db *fakeDB) RevokeSession(_ context.Context, sessionID string) error {
+	s := db.sessions[sessionID]
+	s.Revoked = true
+	db.sessions[sessionID] = s
+	return nil
+}
+
+func (db *fakeDB) RevokeUserSessions(_ context.Context, userID string) error {
+	for id, s := range db.sessions {
+		if s.UserID == userID {
+			s.Revoked = true
+			db.sessions[id] = s
+		}
+	}
+	return nil
+}
+
+const ttl = time.Hour
+
+func newManager(t *testing.T, key string) *Manager {
+	m, err := New(Config{Key: []byte(key), TTL: ttl, Database: &fakeDB{sessions: map[string]database.Session{}}})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return m
+}
+
+func issue(t *testing.T, m *Manager, userID string) Token {
+	token, err := m.Issue(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	return token
+}
+
+func assertInvalid(t *testing.T, m *Manager, what string, token string) {
+	t.Helper()
+	if s, err := m.Verify(context.Background(), token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("%s: got (%+v, %v), want ErrInvalidToken", what, s, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	m := newManager(t, "key")
+	token := issue(t, m, "user1")
+	s, err := m.Verify(context.Background(), token.Value)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if s.UserID != "user1" || !s.ExpiresAt.Equal(token.ExpiresAt) {
+		t.Errorf("Verify: got %+v, want a session of user1 expiring at %v", s, token.ExpiresAt)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	m := newManager(t, "key")
+	token := issue(t, m, "user1").Value
+	parts := strings.Split(token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		t.Fatalf("decoding the payload: %v", err)
+	}
+
+	// A later expiry, keeping the signature of the original payload
+	fields := strings.Split(string(payload), ".")
+	extended := base64.RawURLEncoding.EncodeToString([]byte(fields[0] + ".9999999999"))
+	assertInvalid(t, m, "extended expiry", extended+"."+parts[1])
+
+	// Another session ID
+	other := base64.RawURLEncoding.EncodeToString([]byte("other." + fields[1]))
+	assertInvalid(t, m, "other session", other+"."+parts[1])
+
+	signature := []byte(parts[1])
+	signature[0] ^= 1
+	assertInvalid(t, m, "altered signature", parts[0]+"."+string(signature))
+	assertInvalid(t, m, "no signature", parts[0]+".")
+	assertInvalid(t, m, "signed with another key", newManager(t, "other").sign(fields[0], time.Now().Add(ttl)))
+
+	for _, malformed := range []string{"", ".", "abc", token + ".x", "%%%." + parts[1], parts[0] + ".%%%"} {
+		assertInvalid(t, m, "malformed "+malformed, malformed)
+	}
+}
+
+func TestVerifyBadPayload(t *testing.T) {
+	// Correctly signed, but not "<session id>.<expiry>": the key leaked or the format changed
+	m := newManager(t, "key")
+	for _, payload := range []string{"session", "session.soon", "a.b.c"} {
+		token := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+			base64.RawURLEncoding.EncodeToString(m.mac([]byte(payload)))
+		assertInvalid(t, m, "payload "+payload, token)
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	defer func() { globaltime.FixedTime = time.Time{} }()
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	globaltime.FixedTime = start
+	m := newManager(t, "key")
+	token := issue(t, m, "user1").Value
+
+	globaltime.FixedTime = start.Add(ttl - time.Second)
+	if _, err := m.Verify(context.Background(), token); err != nil {
+		t.Errorf("just before the expiry: %v", err)
+	}
+	globaltime.FixedTime = start.Add(ttl)
+	assertInvalid(t, m, "at the expiry", token)
+	globaltime.FixedTime = start.Add(24 * ttl)
+	assertInvalid(t, m, "after the expiry", token)
+}
+
+func TestVerifyRevoked(t *testing.T) {
+	ctx := context.Background()
+	m := newManager(t, "key")
+	first := issue(t, m, "user1").Value
+	second := issue(t, m, "user1").Value
+	other := issue(t, m, "user2").Value
+
+	s, err := m.Verify(ctx, first)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if err := m.Revoke(ctx, s.ID); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	assertInvalid(t, m, "revoked", first)
+	if _, err := m.Verify(ctx, second); err != nil {
+		t.Errorf("another session of the same user must stay valid: %v", err)
+	}
+
+	if err := m.RevokeAll(ctx, "user1"); err != nil {
+		t.Fatalf("RevokeAll: %v", err)
+	}
+	assertInvalid(t, m, "revoked with all the sessions of the user", second)
+	if _, err := m.Verify(ctx, other); err != nil {
+		t.Errorf("the sessions of other users must stay valid: %v", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	ctx := context.Background()
+	m := newManager(t, "key")
+	old := issue(t, m, "user1").Value
+	s, err := m.Verify(ctx, old)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	refreshed, err := m.Refresh(ctx, s)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	assertInvalid(t, m, "refreshed", old)
+	if s, err := m.Verify(ctx, refreshed.Value); err != nil || s.UserID != "user1" {
+		t.Errorf("new token: got (%+v, %v), want a session of user1", s, err)
+	}
+}
+
+func TestVerifyUnknownSession(t *testing.T) {
+	// Correctly signed, but the session was never stored (e.g., the database was reset)
+	m := newManager(t, "key")
+	assertInvalid(t, m, "unknown session", m.sign("missing", time.Now().Add(ttl)))
+}
@@ -5,4 +5,13 @@ const instance = axios.create({
 	timeout: 1000 * 5
 });
 
+// Attach the session token to every request, if the user is logged in
+instance.interceptors.request.use(config => {
+	const token = localStorage.getItem('token');
+	if (token) {
+		config.headers.Authorization = `Bearer ${token}`;
+	}
+	return config;
+});
+
 export default instance;
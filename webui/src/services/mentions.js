@@ -0,0 +1,19 @@
+// Splits a comment or a caption into the parts to display: plain text, and mentions linking to the profile of the
+// user. Mention positions are in characters (code points), and the mention shows the current username of the user,
+// which differs from the text if they renamed since.
+export function mentionParts(text, mentions) {
+  const chars = Array.from(text || '');
+  const parts = [];
+  let position = 0;
+  for (const mention of mentions || []) {
+    if (mention.start > position) {
+      parts.push({ text: chars.slice(position, mention.start).join('') });
+    }
+    parts.push({ text: '@' + mention.username, userId: mention.userId });
+    position = mention.start + mention.length;
+  }
+  if (position < chars.length) {
+    parts.push({ text: chars.slice(position).join('') });
+  }
+  return parts;
+}